@@ -0,0 +1,194 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions
+
+import (
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown/builtins"
+	"github.com/open-policy-agent/opa/types"
+
+	"github.com/indykite/opa-indykite-plugin/utilities"
+)
+
+var allowedSubjectType = types.NewAny(
+	types.NewObject([]*types.StaticProperty{
+		types.NewStaticProperty("id", types.S),
+	}, nil),
+	types.NewObject([]*types.StaticProperty{
+		types.NewStaticProperty("id", types.S),
+		types.NewStaticProperty("subjectType", types.S),
+	}, nil),
+	types.NewObject([]*types.StaticProperty{
+		types.NewStaticProperty("id", types.S),
+		types.NewStaticProperty("subjectType", types.S),
+		types.NewStaticProperty("property", types.S),
+	}, nil),
+	types.NewObject([]*types.StaticProperty{
+		types.NewStaticProperty("id", types.S),
+		types.NewStaticProperty("subjectType", types.S),
+		types.NewStaticProperty("type", types.S),
+	}, nil),
+)
+
+var allowedResourceType = types.NewObject([]*types.StaticProperty{
+	types.NewStaticProperty("externalId", types.S),
+	types.NewStaticProperty("type", types.S),
+}, nil)
+
+func init() {
+	// Builtins can not have optional arguments, so inputParams, policyTags and connection are passed
+	// in options object of indy.allowed_with_options.
+	rego.RegisterBuiltin3(
+		&rego.Function{
+			Name: "indy.allowed",
+			Decl: types.NewFunction(
+				types.Args(
+					types.Named("subject", allowedSubjectType),
+					types.Named("resource", allowedResourceType),
+					types.Named("action", types.S),
+				),
+				types.Named("allowed", types.B),
+			),
+		},
+		func(bCtx rego.BuiltinContext, subject, resource, action *ast.Term) (*ast.Term, error) {
+			return allowed(bCtx, "indy.allowed", subject, resource, action, nil)
+		},
+	)
+
+	rego.RegisterBuiltin4(
+		&rego.Function{
+			Name: "indy.allowed_with_options",
+			Decl: types.NewFunction(
+				types.Args(
+					types.Named("subject", allowedSubjectType),
+					types.Named("resource", allowedResourceType),
+					types.Named("action", types.S),
+					// All of inputParams, policyTags and connection are optional, so keys are checked at runtime.
+					types.Named("options", types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
+				),
+				types.Named("allowed", types.B),
+			),
+		},
+		func(bCtx rego.BuiltinContext, subject, resource, action, options *ast.Term) (*ast.Term, error) {
+			return allowed(bCtx, "indy.allowed_with_options", subject, resource, action, options)
+		},
+	)
+}
+
+// allowed decides if subject can do action on resource. IndyKite user errors and missing decision
+// are returned as false, so the builtin fails closed. Service errors are returned as error.
+func allowed(
+	bCtx rego.BuiltinContext,
+	builtin string,
+	subject, resource, action, options *ast.Term,
+) (*ast.Term, error) {
+	var (
+		req        = &authorizationpb.IsAuthorizedRequest{}
+		connection *ast.Term
+	)
+	plugin, err := resolvePlugin(bCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Subject, err = extractSubject(subject.Value, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := parseAllowedResource(resource, action)
+	if err != nil {
+		return nil, err
+	}
+	req.Resources = []*authorizationpb.IsAuthorizedRequest_Resource{res}
+
+	if options != nil {
+		var opts ast.Object
+		if opts, err = builtins.ObjectOperand(options.Value, 4); err != nil {
+			return nil, err
+		}
+		if keys := opts.Keys(); ast.NewSet(keys...).Diff(allowedKeys).Len() > 0 {
+			return nil, builtins.NewOperandErr(4, "allowed keys are %v", allowedKeys)
+		}
+		req.InputParams, err = parseInputParams(plugin, opts.Get(ast.StringTerm(inputParamsKey)), 4)
+		if err != nil {
+			return nil, err
+		}
+		req.PolicyTags, err = parsePolicyTags(opts.Get(ast.StringTerm(policyTagsKey)), 4)
+		if err != nil {
+			return nil, err
+		}
+		connection = opts.Get(ast.StringTerm(connectionKey))
+	}
+
+	var conn string
+	if err = validateSubject(bCtx.Context, plugin, req.GetSubject()); err == nil {
+		conn, err = resolveConnection(bCtx.Context, plugin, connection, req.GetSubject(), 4)
+	}
+	if _, ok := rejectedObject(err); ok {
+		return ast.BooleanTerm(false), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	obj, err := evalIsAuthorized(bCtx, plugin, conn, builtin, req)
+	if err != nil {
+		return nil, err
+	}
+	return ast.BooleanTerm(isAllowed(obj, res)), nil
+}
+
+func parseAllowedResource(resource, action *ast.Term) (*authorizationpb.IsAuthorizedRequest_Resource, error) {
+	obj, err := builtins.ObjectOperand(resource.Value, 2)
+	if err != nil {
+		return nil, err
+	}
+	externalID, err := utilities.RequiredStringField(obj, "externalId", 2)
+	if err != nil {
+		return nil, err
+	}
+	resourceType, err := utilities.RequiredStringField(obj, "type", 2)
+	if err != nil {
+		return nil, err
+	}
+	actionName, err := builtins.StringOperand(action.Value, 3)
+	if err != nil {
+		return nil, err
+	}
+	return &authorizationpb.IsAuthorizedRequest_Resource{
+		ExternalId: externalID,
+		Type:       resourceType,
+		Actions:    []string{string(actionName)},
+	}, nil
+}
+
+// isAllowed looks up decision of resource in indy.is_authorized result object.
+// Missing decision and user error are treated as denied.
+func isAllowed(obj ast.Object, resource *authorizationpb.IsAuthorizedRequest_Resource) bool {
+	allow, err := obj.Find(ast.Ref{
+		ast.StringTerm("decisions"),
+		ast.StringTerm(resource.GetType()),
+		ast.StringTerm(resource.GetExternalId()),
+		ast.StringTerm(resource.GetActions()[0]),
+		ast.StringTerm("allow"),
+	})
+	if err != nil {
+		return false
+	}
+	allowed, ok := allow.(ast.Boolean)
+	return ok && bool(allowed)
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions_test
+
+import (
+	"context"
+
+	"github.com/indykite/indykite-sdk-go/authorization"
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	"github.com/indykite/indykite-sdk-go/test"
+	authorizationm "github.com/indykite/indykite-sdk-go/test/authorization/v1beta1"
+	"github.com/open-policy-agent/opa/rego"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/indykite/opa-indykite-plugin/functions"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("indy.allowed", func() {
+	var (
+		mockAuthorizationClient *authorizationm.MockAuthorizationAPIClient
+		ctx                     context.Context
+	)
+
+	BeforeEach(func() {
+		mockCtrl := gomock.NewController(GinkgoT())
+		mockAuthorizationClient = authorizationm.NewMockAuthorizationAPIClient(mockCtrl)
+		client, _ := authorization.NewClientFromGRPCClient(mockAuthorizationClient)
+		ctx = functions.WithAuthorizationClient(context.Background(), client)
+	})
+
+	subject := `{"id": "` + testAccessToken + `"}`
+	resource := `{"externalId": "res1", "type": "Type"}`
+
+	eval := func(builtin, args string) (rego.ResultSet, error) {
+		query, err := rego.New(
+			rego.Query(`x = `+builtin+`(`+args+`)`),
+			rego.StrictBuiltinErrors(true),
+		).PrepareForEval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return query.Eval(ctx)
+	}
+
+	respond := func(allow bool) *authorizationpb.IsAuthorizedResponse {
+		return &authorizationpb.IsAuthorizedResponse{
+			Decisions: map[string]*authorizationpb.IsAuthorizedResponse_ResourceType{
+				"Type": {Resources: map[string]*authorizationpb.IsAuthorizedResponse_Resource{
+					"res1": {Actions: map[string]*authorizationpb.IsAuthorizedResponse_Action{
+						"READ": {Allow: allow},
+					}},
+				}},
+			},
+		}
+	}
+
+	DescribeTable("Returns decision for single action",
+		func(allow bool) {
+			mockAuthorizationClient.EXPECT().IsAuthorized(gomock.Any(), test.WrapMatcher(test.EqualProto(
+				&authorizationpb.IsAuthorizedRequest{
+					Subject: &authorizationpb.Subject{Subject: &authorizationpb.Subject_AccessToken{
+						AccessToken: testAccessToken,
+					}},
+					Resources: []*authorizationpb.IsAuthorizedRequest_Resource{
+						{ExternalId: "res1", Type: "Type", Actions: []string{"READ"}},
+					},
+				},
+			))).Return(respond(allow), nil)
+
+			rs, err := eval("indy.allowed", subject+`, `+resource+`, "READ"`)
+			Expect(err).To(Succeed())
+			Expect(rs[0].Bindings["x"]).To(Equal(allow))
+		},
+		Entry("Allowed", true),
+		Entry("Denied", false),
+	)
+
+	It("Passes optional inputParams and policyTags", func() {
+		mockAuthorizationClient.EXPECT().IsAuthorized(gomock.Any(), test.WrapMatcher(SatisfyAll(
+			HaveField("InputParams", HaveKey("age")),
+			HaveField("PolicyTags", Equal([]string{"tag"})),
+		))).Return(respond(true), nil)
+
+		rs, err := eval("indy.allowed_with_options", subject+`, `+resource+`, "READ", {
+			"inputParams": {"age": {"integer_value": 21}},
+			"policyTags": ["tag"]
+		}`)
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings["x"]).To(BeTrue())
+	})
+
+	It("Accepts options with policyTags only", func() {
+		mockAuthorizationClient.EXPECT().IsAuthorized(gomock.Any(), test.WrapMatcher(SatisfyAll(
+			HaveField("InputParams", BeEmpty()),
+			HaveField("PolicyTags", Equal([]string{"tag"})),
+		))).Return(respond(true), nil)
+
+		rs, err := eval("indy.allowed_with_options", subject+`, `+resource+`, "READ", {"policyTags": ["tag"]}`)
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings["x"]).To(BeTrue())
+	})
+
+	It("Denies action missing in response", func() {
+		mockAuthorizationClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any()).Return(respond(true), nil)
+
+		rs, err := eval("indy.allowed", subject+`, {"externalId": "res1", "type": "Type"}, "WRITE"`)
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings["x"]).To(BeFalse())
+	})
+
+	It("Fails closed on user error", func() {
+		rs, err := eval("indy.allowed", `{"id": "a"}, `+resource+`, "READ"`)
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings["x"]).To(BeFalse())
+	})
+
+	It("Returns service errors", func() {
+		mockAuthorizationClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any()).
+			Return(nil, status.Error(codes.Internal, "oops"))
+
+		rs, err := eval("indy.allowed", subject+`, `+resource+`, "READ"`)
+		Expect(rs).To(BeEmpty())
+		Expect(err).To(MatchError(ContainSubstring("indy.allowed: client error: code = Internal desc = oops")))
+	})
+
+	DescribeTable("Rejects invalid arguments",
+		func(builtin, args, errMsg string) {
+			_, err := eval(builtin, args)
+			Expect(err).To(MatchError(ContainSubstring(errMsg)))
+		},
+		Entry("Missing action", "indy.allowed", subject+`, `+resource, "arity mismatch"),
+		Entry("Action is not string", "indy.allowed", subject+`, `+resource+`, 1`, "invalid argument(s)"),
+		Entry("Unknown option", "indy.allowed_with_options", subject+`, `+resource+`, "READ", {"tags": []}`,
+			"operand 4 allowed keys are"),
+	)
+
+	It("Rejects resource without type from input", func() {
+		query, err := rego.New(
+			rego.Query(`x = indy.allowed(`+subject+`, input.resource, "READ")`),
+			rego.StrictBuiltinErrors(true),
+		).PrepareForEval(ctx)
+		Expect(err).To(Succeed())
+
+		_, err = query.Eval(ctx, rego.EvalInput(map[string]interface{}{
+			"resource": map[string]interface{}{"externalId": "res1"},
+		}))
+		Expect(err).To(MatchError(ContainSubstring("indy.allowed: operand 2 missing type")))
+	})
+})
@@ -0,0 +1,291 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+)
+
+type (
+	isAuthorizedFunc func(
+		ctx context.Context,
+		req *authorizationpb.IsAuthorizedRequest,
+	) (*authorizationpb.IsAuthorizedResponse, error)
+
+	// batcher merges concurrent IsAuthorized calls with the same subject, input params and policy tags
+	// into a single request and splits decisions back to the callers.
+	batcher struct {
+		send         isAuthorizedFunc
+		pending      map[string]*batch
+		window       time.Duration
+		maxResources int
+		mtx          sync.Mutex
+	}
+
+	batch struct {
+		deadline   time.Time
+		ctx        context.Context
+		req        *authorizationpb.IsAuthorizedRequest
+		timer      *time.Timer
+		done       chan struct{}
+		resp       *authorizationpb.IsAuthorizedResponse
+		err        error
+		key        string
+		noDeadline bool
+		flushed    bool
+	}
+)
+
+type (
+	// pluginBatcher is batcher of a plugin connection together with configuration it was created from.
+	pluginBatcher struct {
+		cfg plugins.BatchingConfig
+		b   *batcher
+	}
+
+	batcherKey struct {
+		plugin     *plugins.IndyKitePlugin
+		connection string
+	}
+)
+
+var (
+	batchersMtx sync.Mutex
+	batchers    = make(map[batcherKey]pluginBatcher)
+)
+
+func init() {
+	plugins.RegisterConnectionReleaseHook(releaseBatcher)
+}
+
+// releaseBatcher removes batcher of the plugin connection and sends its pending batches.
+func releaseBatcher(plugin *plugins.IndyKitePlugin, connection string) {
+	batchersMtx.Lock()
+	key := batcherKey{plugin: plugin, connection: connection}
+	active, ok := batchers[key]
+	delete(batchers, key)
+	batchersMtx.Unlock()
+	if ok {
+		active.b.stop()
+	}
+}
+
+// currentBatcher returns batcher of the plugin connection, or nil when batching is disabled.
+// Each plugin connection has own batcher, so calls of different OPA instances or connections are never merged.
+func currentBatcher(plugin *plugins.IndyKitePlugin, connection string) *batcher {
+	if plugin == nil {
+		return nil
+	}
+	cfg := plugin.Config().Batching
+	if cfg == nil || cfg.WindowMillis <= 0 {
+		return nil
+	}
+
+	batchersMtx.Lock()
+	defer batchersMtx.Unlock()
+	key := batcherKey{plugin: plugin, connection: connection}
+	active, ok := batchers[key]
+	if !ok || active.cfg != *cfg {
+		active = pluginBatcher{cfg: *cfg, b: newBatcher(cfg, sendIsAuthorized(plugin, connection))}
+		batchers[key] = active
+	}
+	return active.b
+}
+
+// sendIsAuthorized returns function calling IndyKite with own client reference of plugin connection,
+// so the connection stays open for the whole batch regardless of callers which already gave up waiting.
+func sendIsAuthorized(plugin *plugins.IndyKitePlugin, connection string) isAuthorizedFunc {
+	return func(
+		ctx context.Context,
+		req *authorizationpb.IsAuthorizedRequest,
+	) (*authorizationpb.IsAuthorizedResponse, error) {
+		client, release := plugin.AcquireConnectionClient(connection)
+		if client == nil {
+			return nil, errNotConnected(connection)
+		}
+		defer release()
+		return client.IsAuthorizedWithRawRequest(ctx, req)
+	}
+}
+
+func newBatcher(cfg *plugins.BatchingConfig, send isAuthorizedFunc) *batcher {
+	maxResources := cfg.MaxResources
+	if maxResources <= 0 || maxResources > maxRequestResources {
+		maxResources = maxRequestResources
+	}
+	return &batcher{
+		send:         send,
+		pending:      make(map[string]*batch),
+		window:       time.Duration(cfg.WindowMillis) * time.Millisecond,
+		maxResources: maxResources,
+	}
+}
+
+// isAuthorized joins req into pending batch and waits for its decisions.
+// Requests which do not fit into a single batch are sent directly, so are invalid requests,
+// which would make the merged request of other callers fail validation.
+func (b *batcher) isAuthorized(
+	ctx context.Context,
+	req *authorizationpb.IsAuthorizedRequest,
+) (*authorizationpb.IsAuthorizedResponse, error) {
+	if len(req.GetResources()) > b.maxResources || req.Validate() != nil {
+		return b.send(ctx, req)
+	}
+	key, err := batchKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mtx.Lock()
+	bt := b.pending[key]
+	if bt != nil && len(bt.req.GetResources())+len(req.GetResources()) > b.maxResources {
+		b.flushLocked(bt)
+		bt = nil
+	}
+	if bt == nil {
+		bt = &batch{
+			key:  key,
+			ctx:  ctx,
+			done: make(chan struct{}),
+			req: &authorizationpb.IsAuthorizedRequest{
+				Subject:     req.GetSubject(),
+				InputParams: req.GetInputParams(),
+				PolicyTags:  req.GetPolicyTags(),
+			},
+		}
+		b.pending[key] = bt
+		bt.timer = time.AfterFunc(b.window, func() {
+			b.mtx.Lock()
+			defer b.mtx.Unlock()
+			b.flushLocked(bt)
+		})
+	}
+	bt.join(ctx, req)
+	if len(bt.req.GetResources()) == b.maxResources {
+		b.flushLocked(bt)
+	}
+	b.mtx.Unlock()
+
+	select {
+	case <-bt.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if bt.err != nil {
+		return nil, bt.err
+	}
+	return splitIsAuthorizedResponse(bt.resp, req), nil
+}
+
+// stop sends all pending batches without waiting for the end of their window.
+func (b *batcher) stop() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for _, bt := range b.pending {
+		b.flushLocked(bt)
+	}
+}
+
+// flushLocked removes batch from pending ones and sends it. Must be called with b.mtx held.
+func (b *batcher) flushLocked(bt *batch) {
+	if bt.flushed {
+		return
+	}
+	bt.flushed = true
+	bt.timer.Stop()
+	if b.pending[bt.key] == bt {
+		delete(b.pending, bt.key)
+	}
+	go bt.run(b.send)
+}
+
+// join adds resources of req and extends batch deadline to cover the caller.
+func (bt *batch) join(ctx context.Context, req *authorizationpb.IsAuthorizedRequest) {
+	bt.req.Resources = append(bt.req.Resources, req.GetResources()...)
+	deadline, ok := ctx.Deadline()
+	switch {
+	case !ok:
+		bt.noDeadline = true
+	case deadline.After(bt.deadline):
+		bt.deadline = deadline
+	}
+}
+
+// run sends merged request. Request is detached from cancellation of the first caller, because
+// other callers wait for the same response, but keeps the latest deadline of all callers.
+func (bt *batch) run(send isAuthorizedFunc) {
+	defer close(bt.done)
+	ctx := context.WithoutCancel(bt.ctx)
+	if !bt.noDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, bt.deadline)
+		defer cancel()
+	}
+	bt.resp, bt.err = send(ctx, bt.req)
+}
+
+// batchKey returns key of request which identifies calls that can be merged together.
+func batchKey(req *authorizationpb.IsAuthorizedRequest) (string, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(&authorizationpb.IsAuthorizedRequest{
+		Subject:     req.GetSubject(),
+		InputParams: req.GetInputParams(),
+		PolicyTags:  req.GetPolicyTags(),
+	})
+	return string(data), err
+}
+
+// splitIsAuthorizedResponse returns decisions from merged response, which were requested by req.
+func splitIsAuthorizedResponse(
+	resp *authorizationpb.IsAuthorizedResponse,
+	req *authorizationpb.IsAuthorizedRequest,
+) *authorizationpb.IsAuthorizedResponse {
+	out := &authorizationpb.IsAuthorizedResponse{
+		DecisionTime: resp.GetDecisionTime(),
+		Decisions:    make(map[string]*authorizationpb.IsAuthorizedResponse_ResourceType),
+	}
+	for _, res := range req.GetResources() {
+		resourceDecision := resp.GetDecisions()[res.GetType()].GetResources()[res.GetExternalId()]
+		if resourceDecision == nil {
+			continue
+		}
+		resourceType, ok := out.Decisions[res.GetType()]
+		if !ok {
+			resourceType = &authorizationpb.IsAuthorizedResponse_ResourceType{
+				Resources: make(map[string]*authorizationpb.IsAuthorizedResponse_Resource),
+			}
+			out.Decisions[res.GetType()] = resourceType
+		}
+		resource, ok := resourceType.Resources[res.GetExternalId()]
+		if !ok {
+			resource = &authorizationpb.IsAuthorizedResponse_Resource{
+				Actions: make(map[string]*authorizationpb.IsAuthorizedResponse_Action),
+			}
+			resourceType.Resources[res.GetExternalId()] = resource
+		}
+		for _, action := range res.GetActions() {
+			if decision, found := resourceDecision.GetActions()[action]; found {
+				resource.Actions[action] = decision
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/indykite/opa-indykite-plugin/functions"
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Batcher", func() {
+	var (
+		mtx      sync.Mutex
+		requests []*authorizationpb.IsAuthorizedRequest
+		sendErr  error
+	)
+
+	// send grants every requested action, except DELETE.
+	send := func(_ context.Context, req *authorizationpb.IsAuthorizedRequest,
+	) (*authorizationpb.IsAuthorizedResponse, error) {
+		mtx.Lock()
+		requests = append(requests, req)
+		mtx.Unlock()
+		if sendErr != nil {
+			return nil, sendErr
+		}
+		resp := &authorizationpb.IsAuthorizedResponse{
+			DecisionTime: timestamppb.New(time.Date(2022, 02, 22, 15, 18, 22, 0, time.UTC)),
+			Decisions:    map[string]*authorizationpb.IsAuthorizedResponse_ResourceType{},
+		}
+		for _, r := range req.GetResources() {
+			rt, ok := resp.Decisions[r.GetType()]
+			if !ok {
+				rt = &authorizationpb.IsAuthorizedResponse_ResourceType{
+					Resources: map[string]*authorizationpb.IsAuthorizedResponse_Resource{},
+				}
+				resp.Decisions[r.GetType()] = rt
+			}
+			res, ok := rt.Resources[r.GetExternalId()]
+			if !ok {
+				res = &authorizationpb.IsAuthorizedResponse_Resource{
+					Actions: map[string]*authorizationpb.IsAuthorizedResponse_Action{},
+				}
+				rt.Resources[r.GetExternalId()] = res
+			}
+			for _, a := range r.GetActions() {
+				res.Actions[a] = &authorizationpb.IsAuthorizedResponse_Action{Allow: a != "DELETE"}
+			}
+		}
+		return resp, nil
+	}
+
+	newReq := func(token string, resources ...*authorizationpb.IsAuthorizedRequest_Resource,
+	) *authorizationpb.IsAuthorizedRequest {
+		return &authorizationpb.IsAuthorizedRequest{
+			Subject:   &authorizationpb.Subject{Subject: &authorizationpb.Subject_AccessToken{AccessToken: token}},
+			Resources: resources,
+		}
+	}
+
+	BeforeEach(func() {
+		requests = nil
+		sendErr = nil
+	})
+
+	It("Merges concurrent calls for the same subject and splits decisions", func() {
+		b := functions.NewBatcher(&plugins.BatchingConfig{WindowMillis: 50}, send)
+
+		var wg sync.WaitGroup
+		responses := make([]*authorizationpb.IsAuthorizedResponse, 2)
+		for i, req := range []*authorizationpb.IsAuthorizedRequest{
+			newReq(testAccessToken, &authorizationpb.IsAuthorizedRequest_Resource{
+				ExternalId: "res1", Type: "Type", Actions: []string{"READ"},
+			}),
+			newReq(testAccessToken, &authorizationpb.IsAuthorizedRequest_Resource{
+				ExternalId: "res2", Type: "Type", Actions: []string{"READ", "DELETE"},
+			}),
+		} {
+			wg.Add(1)
+			go func(i int, req *authorizationpb.IsAuthorizedRequest) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				var err error
+				responses[i], err = b.IsAuthorized(context.Background(), req)
+				Expect(err).To(Succeed())
+			}(i, req)
+		}
+		wg.Wait()
+
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].GetResources()).To(HaveLen(2))
+
+		Expect(responses[0].GetDecisions()["Type"].GetResources()).To(HaveLen(1))
+		Expect(responses[0].GetDecisions()["Type"].GetResources()["res1"].GetActions()["READ"].GetAllow()).To(BeTrue())
+		Expect(responses[1].GetDecisions()["Type"].GetResources()).To(HaveLen(1))
+		res2 := responses[1].GetDecisions()["Type"].GetResources()["res2"]
+		Expect(res2.GetActions()["READ"].GetAllow()).To(BeTrue())
+		Expect(res2.GetActions()["DELETE"].GetAllow()).To(BeFalse())
+		Expect(responses[1].GetDecisionTime().AsTime()).To(Equal(responses[0].GetDecisionTime().AsTime()))
+	})
+
+	It("Does not merge calls for different subjects", func() {
+		b := functions.NewBatcher(&plugins.BatchingConfig{WindowMillis: 20}, send)
+
+		var wg sync.WaitGroup
+		for _, token := range []string{testAccessToken + "1", testAccessToken + "2"} {
+			wg.Add(1)
+			go func(token string) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				req := newReq(token, &authorizationpb.IsAuthorizedRequest_Resource{
+					ExternalId: "res1", Type: "Type", Actions: []string{"READ"},
+				})
+				_, err := b.IsAuthorized(context.Background(), req)
+				Expect(err).To(Succeed())
+			}(token)
+		}
+		wg.Wait()
+
+		Expect(requests).To(HaveLen(2))
+	})
+
+	It("Sends invalid request alone, so it does not fail other callers", func() {
+		b := functions.NewBatcher(&plugins.BatchingConfig{WindowMillis: 50}, send)
+
+		var wg sync.WaitGroup
+		for _, actions := range [][]string{{"READ"}, {}} {
+			wg.Add(1)
+			go func(actions []string) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				req := newReq(testAccessToken, &authorizationpb.IsAuthorizedRequest_Resource{
+					ExternalId: "res1", Type: "Type", Actions: actions,
+				})
+				_, err := b.IsAuthorized(context.Background(), req)
+				Expect(err).To(Succeed())
+			}(actions)
+		}
+		wg.Wait()
+
+		Expect(requests).To(HaveLen(2))
+		Expect(requests).To(ContainElement(HaveField("Resources", ConsistOf(
+			HaveField("Actions", ConsistOf("READ")),
+		))))
+		Expect(requests).To(ContainElement(HaveField("Resources", ConsistOf(
+			HaveField("Actions", BeEmpty()),
+		))))
+	})
+
+	It("Sends batch immediately when resource limit is reached", func() {
+		b := functions.NewBatcher(&plugins.BatchingConfig{WindowMillis: 60000, MaxResources: 2}, send)
+
+		resp, err := b.IsAuthorized(context.Background(), newReq(testAccessToken,
+			&authorizationpb.IsAuthorizedRequest_Resource{ExternalId: "res1", Type: "Type", Actions: []string{"READ"}},
+			&authorizationpb.IsAuthorizedRequest_Resource{ExternalId: "res2", Type: "Type", Actions: []string{"READ"}},
+		))
+		Expect(err).To(Succeed())
+		Expect(resp.GetDecisions()["Type"].GetResources()).To(HaveLen(2))
+		Expect(requests).To(HaveLen(1))
+	})
+
+	It("Returns error of merged request to every caller", func() {
+		sendErr = status.Error(codes.Unavailable, "oops")
+		b := functions.NewBatcher(&plugins.BatchingConfig{WindowMillis: 1}, send)
+
+		_, err := b.IsAuthorized(context.Background(), newReq(testAccessToken,
+			&authorizationpb.IsAuthorizedRequest_Resource{ExternalId: "res1", Type: "Type", Actions: []string{"READ"}},
+		))
+		Expect(err).To(MatchError(ContainSubstring("oops")))
+	})
+
+	It("Sends pending batches when stopped", func() {
+		b := functions.NewBatcher(&plugins.BatchingConfig{WindowMillis: 60000}, send)
+
+		done := make(chan error, 1)
+		go func() {
+			req := newReq(testAccessToken, &authorizationpb.IsAuthorizedRequest_Resource{
+				ExternalId: "res1", Type: "Type", Actions: []string{"READ"},
+			})
+			_, err := b.IsAuthorized(context.Background(), req)
+			done <- err
+		}()
+		Eventually(func() int {
+			b.Stop()
+			mtx.Lock()
+			defer mtx.Unlock()
+			return len(requests)
+		}).Should(Equal(1))
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("Releases batchers of unregistered plugin", func() {
+		plugin := plugins.NewEmbedded(nil, &plugins.Config{
+			Batching: &plugins.BatchingConfig{WindowMillis: 50},
+		}, nil, nil)
+		Expect(functions.CurrentBatcher(plugin, plugins.DefaultConnectionName)).NotTo(BeNil())
+		Expect(functions.HasBatcher(plugin, plugins.DefaultConnectionName)).To(BeTrue())
+
+		plugin.Unregister()
+		Expect(functions.HasBatcher(plugin, plugins.DefaultConnectionName)).To(BeFalse())
+	})
+})
@@ -0,0 +1,188 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	sdkerrors "github.com/indykite/indykite-sdk-go/errors"
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	"github.com/open-policy-agent/opa/ast"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+	"github.com/indykite/opa-indykite-plugin/utilities"
+)
+
+// circuitOpenError is returned instead of calling IndyKite while the circuit breaker is open.
+type circuitOpenError struct {
+	outcome plugins.BreakerOutcome
+}
+
+func (*circuitOpenError) Error() string {
+	return "IndyKite circuit breaker is open"
+}
+
+// asCircuitOpen returns circuitOpenError, if err is one.
+func asCircuitOpen(err error) (*circuitOpenError, bool) {
+	var openErr *circuitOpenError
+	ok := errors.As(err, &openErr)
+	return openErr, ok
+}
+
+// isUnavailable reports whether err means IndyKite could not be reached, either because of service
+// error or because the circuit breaker is open.
+func isUnavailable(err error) bool {
+	if _, ok := asCircuitOpen(err); ok {
+		return true
+	}
+	return sdkerrors.IsServiceError(sdkerrors.FromError(err))
+}
+
+// currentCircuitBreaker returns circuit breaker of the plugin connection, or nil when not enabled.
+func currentCircuitBreaker(plugin *plugins.IndyKitePlugin, connection string) *plugins.CircuitBreaker {
+	if plugin == nil {
+		return nil
+	}
+	return plugin.ConnectionCircuitBreaker(connection)
+}
+
+// callWithBreaker calls IndyKite unless breaker is open. Only service errors are counted as failures,
+// user errors mean IndyKite is reachable. Errors after ctx of the caller is canceled or its deadline passed
+// are not counted at all. With nil breaker the call is made directly.
+func callWithBreaker[T any](
+	ctx context.Context,
+	breaker *plugins.CircuitBreaker,
+	builtin string,
+	call func() (T, error),
+) (T, error) {
+	if breaker == nil {
+		return call()
+	}
+	allowed, probe := breaker.Allow()
+	if !allowed {
+		var zero T
+		return zero, &circuitOpenError{outcome: breaker.Outcome(builtin)}
+	}
+	resp, err := call()
+	switch {
+	case err != nil && ctx.Err() != nil:
+		breaker.Abandon(probe)
+	case err != nil && sdkerrors.IsServiceError(sdkerrors.FromError(err)):
+		breaker.Failure(probe)
+	default:
+		breaker.Success(probe)
+	}
+	return resp, err
+}
+
+// circuitOpenErrorObject returns error object in the same shape as for other user errors.
+func circuitOpenErrorObject(openErr *circuitOpenError) ast.Object {
+	statusErr := sdkerrors.FromError(status.Error(codes.Unavailable, openErr.Error()))
+	return ast.NewObject(ast.Item(ast.StringTerm("error"), utilities.BuildUserError(statusErr)))
+}
+
+// circuitOpenIsAuthorized returns synthetic indy.is_authorized result according to configured outcome.
+// In allow mode, only resources with configured types are allowed.
+func circuitOpenIsAuthorized(openErr *circuitOpenError, req *authorizationpb.IsAuthorizedRequest) ast.Object {
+	if openErr.outcome.Mode != plugins.BreakerModeDeny && openErr.outcome.Mode != plugins.BreakerModeAllow {
+		return circuitOpenErrorObject(openErr)
+	}
+	resp := &authorizationpb.IsAuthorizedResponse{
+		DecisionTime: timestamppb.Now(),
+		Decisions:    make(map[string]*authorizationpb.IsAuthorizedResponse_ResourceType),
+	}
+	for _, resource := range req.GetResources() {
+		allow := openErr.outcome.Mode == plugins.BreakerModeAllow &&
+			slices.Contains(openErr.outcome.AllowResourceTypes, resource.GetType())
+		dec, ok := resp.Decisions[resource.GetType()]
+		if !ok {
+			dec = &authorizationpb.IsAuthorizedResponse_ResourceType{
+				Resources: make(map[string]*authorizationpb.IsAuthorizedResponse_Resource),
+			}
+			resp.Decisions[resource.GetType()] = dec
+		}
+		res, ok := dec.Resources[resource.GetExternalId()]
+		if !ok {
+			res = &authorizationpb.IsAuthorizedResponse_Resource{
+				Actions: make(map[string]*authorizationpb.IsAuthorizedResponse_Action),
+			}
+			dec.Resources[resource.GetExternalId()] = res
+		}
+		for _, action := range resource.GetActions() {
+			res.Actions[action] = &authorizationpb.IsAuthorizedResponse_Action{Allow: allow}
+		}
+	}
+	return buildIsAuthorizedObjectFromResponse(resp)
+}
+
+// circuitOpenWhatAuthorized returns indy.what_authorized result with no resources in deny mode.
+func circuitOpenWhatAuthorized(openErr *circuitOpenError, req *authorizationpb.WhatAuthorizedRequest) ast.Object {
+	if openErr.outcome.Mode != plugins.BreakerModeDeny {
+		return circuitOpenErrorObject(openErr)
+	}
+	resp := &authorizationpb.WhatAuthorizedResponse{
+		DecisionTime: timestamppb.Now(),
+		Decisions:    make(map[string]*authorizationpb.WhatAuthorizedResponse_ResourceType),
+	}
+	for _, resourceType := range req.GetResourceTypes() {
+		dec, ok := resp.Decisions[resourceType.GetType()]
+		if !ok {
+			dec = &authorizationpb.WhatAuthorizedResponse_ResourceType{
+				Actions: make(map[string]*authorizationpb.WhatAuthorizedResponse_Action),
+			}
+			resp.Decisions[resourceType.GetType()] = dec
+		}
+		for _, action := range resourceType.GetActions() {
+			dec.Actions[action] = &authorizationpb.WhatAuthorizedResponse_Action{}
+		}
+	}
+	return buildWhatAuthorizedObjectFromResponse(resp)
+}
+
+// circuitOpenWhoAuthorized returns indy.who_authorized result with no subjects in deny mode.
+func circuitOpenWhoAuthorized(openErr *circuitOpenError, req *authorizationpb.WhoAuthorizedRequest) ast.Object {
+	if openErr.outcome.Mode != plugins.BreakerModeDeny {
+		return circuitOpenErrorObject(openErr)
+	}
+	resp := &authorizationpb.WhoAuthorizedResponse{
+		DecisionTime: timestamppb.Now(),
+		Decisions:    make(map[string]*authorizationpb.WhoAuthorizedResponse_ResourceType),
+	}
+	for _, resource := range req.GetResources() {
+		dec, ok := resp.Decisions[resource.GetType()]
+		if !ok {
+			dec = &authorizationpb.WhoAuthorizedResponse_ResourceType{
+				Resources: make(map[string]*authorizationpb.WhoAuthorizedResponse_Resource),
+			}
+			resp.Decisions[resource.GetType()] = dec
+		}
+		res, ok := dec.Resources[resource.GetExternalId()]
+		if !ok {
+			res = &authorizationpb.WhoAuthorizedResponse_Resource{
+				Actions: make(map[string]*authorizationpb.WhoAuthorizedResponse_Action),
+			}
+			dec.Resources[resource.GetExternalId()] = res
+		}
+		for _, action := range resource.GetActions() {
+			res.Actions[action] = &authorizationpb.WhoAuthorizedResponse_Action{}
+		}
+	}
+	return buildWhoAuthorizedObjectFromResponse(resp)
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions_test
+
+import (
+	"context"
+
+	"github.com/indykite/indykite-sdk-go/authorization"
+	"github.com/indykite/indykite-sdk-go/errors"
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	authorizationm "github.com/indykite/indykite-sdk-go/test/authorization/v1beta1"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/indykite/opa-indykite-plugin/functions"
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Circuit breaker", func() {
+	failWith := func(code codes.Code) func() (int, error) {
+		return func() (int, error) {
+			return 0, errors.FromError(status.Error(code, "oops"))
+		}
+	}
+	isReq := &authorizationpb.IsAuthorizedRequest{
+		Resources: []*authorizationpb.IsAuthorizedRequest_Resource{
+			{ExternalId: "door1", Type: "Door", Actions: []string{"OPEN"}},
+			{ExternalId: "car1", Type: "Car", Actions: []string{"DRIVE"}},
+		},
+	}
+
+	asJSON := func(term *ast.Term) interface{} {
+		Expect(term).NotTo(BeNil())
+		v, err := ast.JSON(term.Value)
+		Expect(err).To(Succeed())
+		return v
+	}
+
+	// openBreaker trips breaker and returns error of builtin call made while it is open.
+	openBreaker := func(cfg *plugins.CircuitBreakerConfig, builtin string) error {
+		cfg.FailureThreshold = 1
+		breaker := plugins.NewCircuitBreaker(cfg, nil)
+		_, err := functions.CallWithBreaker(context.Background(), breaker, builtin, failWith(codes.Unavailable))
+		Expect(err).To(MatchError(ContainSubstring("oops")))
+		calls := 0
+		_, err = functions.CallWithBreaker(context.Background(), breaker, builtin, func() (int, error) {
+			calls++
+			return 0, nil
+		})
+		Expect(calls).To(BeZero())
+		return err
+	}
+
+	It("Counts only service errors", func() {
+		breaker := plugins.NewCircuitBreaker(&plugins.CircuitBreakerConfig{FailureThreshold: 2}, nil)
+		for range 3 {
+			_, err := functions.CallWithBreaker(context.Background(), breaker, "indy.is_authorized",
+				failWith(codes.InvalidArgument))
+			Expect(err).To(HaveOccurred())
+		}
+		Expect(breaker.State()).To(Equal(plugins.BreakerClosed))
+
+		for range 2 {
+			_, _ = functions.CallWithBreaker(context.Background(), breaker, "indy.is_authorized",
+				failWith(codes.Internal))
+		}
+		Expect(breaker.State()).To(Equal(plugins.BreakerOpen))
+	})
+
+	It("Does not count errors of calls canceled by the caller", func() {
+		breaker := plugins.NewCircuitBreaker(&plugins.CircuitBreakerConfig{FailureThreshold: 1}, nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		for _, code := range []codes.Code{codes.Canceled, codes.DeadlineExceeded, codes.Unavailable} {
+			_, err := functions.CallWithBreaker(ctx, breaker, "indy.is_authorized", failWith(code))
+			Expect(err).To(HaveOccurred())
+		}
+		Expect(breaker.State()).To(Equal(plugins.BreakerClosed))
+
+		_, _ = functions.CallWithBreaker(context.Background(), breaker, "indy.is_authorized",
+			failWith(codes.DeadlineExceeded))
+		Expect(breaker.State()).To(Equal(plugins.BreakerOpen))
+	})
+
+	It("Calls directly without breaker", func() {
+		resp, err := functions.CallWithBreaker(context.Background(), nil, "indy.is_authorized",
+			func() (int, error) { return 42, nil })
+		Expect(err).To(Succeed())
+		Expect(resp).To(Equal(42))
+	})
+
+	It("Returns error object by default", func() {
+		err := openBreaker(&plugins.CircuitBreakerConfig{}, "indy.is_authorized")
+		obj := functions.CircuitOpenIsAuthorized(err, isReq)
+		Expect(obj.Get(ast.StringTerm("error"))).To(Equal(ast.NewTerm(ast.NewObject(
+			ast.Item(ast.StringTerm("message"), ast.StringTerm("IndyKite circuit breaker is open")),
+			ast.Item(ast.StringTerm("grpc_errno"), ast.IntNumberTerm(int(codes.Unavailable))),
+			ast.Item(ast.StringTerm("grpc_error"), ast.StringTerm("Unavailable")),
+		))))
+		Expect(obj.Get(ast.StringTerm("decisions"))).To(BeNil())
+	})
+
+	It("Allows only configured resource types", func() {
+		err := openBreaker(&plugins.CircuitBreakerConfig{
+			IsAuthorized: &plugins.BreakerOutcome{Mode: "allow", AllowResourceTypes: []string{"Door"}},
+		}, "indy.is_authorized")
+		obj := functions.CircuitOpenIsAuthorized(err, isReq)
+		Expect(obj.Get(ast.StringTerm("error"))).To(Equal(ast.NullTerm()))
+		decisions := obj.Get(ast.StringTerm("decisions"))
+		Expect(asJSON(decisions)).To(Equal(asJSON(ast.MustParseTerm(`{
+			"Door": {"door1": {"OPEN": {"allow": true}}},
+			"Car": {"car1": {"DRIVE": {"allow": false}}}
+		}`))))
+	})
+
+	It("Denies all resources", func() {
+		err := openBreaker(&plugins.CircuitBreakerConfig{
+			IsAuthorized: &plugins.BreakerOutcome{Mode: "deny"},
+		}, "indy.is_authorized")
+		obj := functions.CircuitOpenIsAuthorized(err, isReq)
+		Expect(asJSON(obj.Get(ast.StringTerm("decisions")))).To(Equal(asJSON(ast.MustParseTerm(`{
+			"Door": {"door1": {"OPEN": {"allow": false}}},
+			"Car": {"car1": {"DRIVE": {"allow": false}}}
+		}`))))
+	})
+
+	It("Returns no resources for denied indy.what_authorized", func() {
+		err := openBreaker(&plugins.CircuitBreakerConfig{
+			IsAuthorized:   &plugins.BreakerOutcome{Mode: "allow"},
+			WhatAuthorized: &plugins.BreakerOutcome{Mode: "deny"},
+		}, "indy.what_authorized")
+		obj := functions.CircuitOpenWhatAuthorized(err, &authorizationpb.WhatAuthorizedRequest{
+			ResourceTypes: []*authorizationpb.WhatAuthorizedRequest_ResourceType{
+				{Type: "Door", Actions: []string{"OPEN", "CLOSE"}},
+			},
+		})
+		Expect(asJSON(obj.Get(ast.StringTerm("decisions")))).To(Equal(asJSON(ast.MustParseTerm(`{
+			"Door": {"OPEN": [], "CLOSE": []}
+		}`))))
+	})
+
+	It("Applies outcome of indy.what_authorized to indy.what_authorized_with_connection", func() {
+		mockClient := authorizationm.NewMockAuthorizationAPIClient(gomock.NewController(GinkgoT()))
+		mockClient.EXPECT().WhatAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(nil, status.Error(codes.Unavailable, "oops"))
+		client, _ := authorization.NewClientFromGRPCClient(mockClient)
+		plugin := plugins.NewEmbedded(client, &plugins.Config{CircuitBreaker: &plugins.CircuitBreakerConfig{
+			FailureThreshold: 1,
+			WhatAuthorized:   &plugins.BreakerOutcome{Mode: "deny"},
+		}}, nil, ast.NewTerm(ast.NewObject()))
+		DeferCleanup(plugin.Unregister)
+
+		query := rego.New(rego.Runtime(plugin.Runtime()), rego.StrictBuiltinErrors(true), rego.Query(
+			`x = indy.what_authorized_with_connection({"id": "`+testAccessToken+`"},
+				[{"type": "Door", "actions": ["OPEN"]}], {}, [], "default")`))
+		_, err := query.Eval(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("oops")))
+
+		rs, err := query.Eval(context.Background())
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings["x"]).To(HaveKeyWithValue("decisions", map[string]any{
+			"Door": map[string]any{"OPEN": []any{}},
+		}))
+	})
+
+	It("Applies outcome of indy.allowed to its variants", func() {
+		mockClient := authorizationm.NewMockAuthorizationAPIClient(gomock.NewController(GinkgoT()))
+		mockClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(nil, status.Error(codes.Unavailable, "oops"))
+		client, _ := authorization.NewClientFromGRPCClient(mockClient)
+		plugin := plugins.NewEmbedded(client, &plugins.Config{CircuitBreaker: &plugins.CircuitBreakerConfig{
+			FailureThreshold: 1,
+			Allowed:          &plugins.BreakerOutcome{Mode: "allow", AllowResourceTypes: []string{"Door"}},
+		}}, nil, ast.NewTerm(ast.NewObject()))
+		DeferCleanup(plugin.Unregister)
+		eval := func(query string) (rego.ResultSet, error) {
+			return rego.New(rego.Runtime(plugin.Runtime()), rego.StrictBuiltinErrors(true), rego.Query(query)).
+				Eval(context.Background())
+		}
+
+		_, err := eval(`x = indy.allowed({"id": "` + testAccessToken + `"},
+			{"externalId": "door1", "type": "Door"}, "OPEN")`)
+		Expect(err).To(MatchError(ContainSubstring("oops")))
+
+		for _, query := range []string{
+			`x = indy.allowed({"id": "` + testAccessToken + `"}, {"externalId": "door1", "type": "Door"}, "OPEN")`,
+			`x = indy.allowed_with_options({"id": "` + testAccessToken + `"},
+				{"externalId": "door1", "type": "Door"}, "OPEN", {"connection": "default"})`,
+		} {
+			rs, err := eval(query)
+			Expect(err).To(Succeed())
+			Expect(rs[0].Bindings["x"]).To(BeTrue())
+		}
+
+		// Outcome of indy.is_authorized is not configured, so it returns error object.
+		rs, err := eval(`x = indy.is_authorized({"id": "` + testAccessToken + `"},
+			[{"externalId": "door1", "type": "Door", "actions": ["OPEN"]}], {}, [])`)
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings["x"]).To(HaveKeyWithValue("error",
+			HaveKeyWithValue("message", "IndyKite circuit breaker is open")))
+	})
+})
@@ -0,0 +1,159 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions
+
+import (
+	"context"
+
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// maxRequestResources is the maximum number of resources IndyKite accepts in a single request.
+	maxRequestResources = 32
+	// maxChunkWorkers limits number of concurrent requests sent for a single builtin call.
+	maxChunkWorkers = 4
+)
+
+// callChunked splits resources into chunks accepted by IndyKite and calls send for each of them
+// with bounded concurrency. Responses are returned in order of chunks. The first error cancels
+// remaining calls and is returned.
+func callChunked[R, T any](
+	ctx context.Context,
+	resources []R,
+	send func(ctx context.Context, chunk []R) (T, error),
+) ([]T, error) {
+	if len(resources) <= maxRequestResources {
+		resp, err := send(ctx, resources)
+		if err != nil {
+			return nil, err
+		}
+		return []T{resp}, nil
+	}
+
+	chunks := make([][]R, 0, (len(resources)+maxRequestResources-1)/maxRequestResources)
+	for start := 0; start < len(resources); start += maxRequestResources {
+		chunks = append(chunks, resources[start:min(start+maxRequestResources, len(resources))])
+	}
+
+	responses := make([]T, len(chunks))
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(maxChunkWorkers)
+	for i, chunk := range chunks {
+		g.Go(func() error {
+			resp, err := send(gCtx, chunk)
+			if err != nil {
+				return err
+			}
+			responses[i] = resp
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return responses, nil
+}
+
+// earliestTime returns the earlier of the two timestamps, nil is ignored.
+func earliestTime(a, b *timestamppb.Timestamp) *timestamppb.Timestamp {
+	if a == nil || (b != nil && b.AsTime().Before(a.AsTime())) {
+		return b
+	}
+	return a
+}
+
+// mergeIsAuthorizedResponses merges responses of chunked request into one with the earliest decision time.
+// Responses are not modified, the same resource in multiple chunks gets actions of all of them.
+func mergeIsAuthorizedResponses(
+	responses []*authorizationpb.IsAuthorizedResponse,
+) *authorizationpb.IsAuthorizedResponse {
+	if len(responses) == 1 {
+		return responses[0]
+	}
+	out := &authorizationpb.IsAuthorizedResponse{
+		Decisions: make(map[string]*authorizationpb.IsAuthorizedResponse_ResourceType),
+	}
+	for _, resp := range responses {
+		out.DecisionTime = earliestTime(out.DecisionTime, resp.GetDecisionTime())
+		for resourceType, dec := range resp.GetDecisions() {
+			merged, ok := out.Decisions[resourceType]
+			if !ok {
+				merged = &authorizationpb.IsAuthorizedResponse_ResourceType{
+					Resources: make(map[string]*authorizationpb.IsAuthorizedResponse_Resource),
+				}
+				out.Decisions[resourceType] = merged
+			}
+			for resourceKey, resource := range dec.GetResources() {
+				mergedResource, found := merged.Resources[resourceKey]
+				if !found {
+					mergedResource = &authorizationpb.IsAuthorizedResponse_Resource{
+						Actions: make(map[string]*authorizationpb.IsAuthorizedResponse_Action),
+					}
+					merged.Resources[resourceKey] = mergedResource
+				}
+				for action, decision := range resource.GetActions() {
+					mergedResource.Actions[action] = decision
+				}
+			}
+		}
+	}
+	return out
+}
+
+// mergeWhoAuthorizedResponses merges responses of chunked request into one with the earliest decision time.
+// Responses are not modified, subjects of the same resource and action in multiple chunks are appended.
+func mergeWhoAuthorizedResponses(
+	responses []*authorizationpb.WhoAuthorizedResponse,
+) *authorizationpb.WhoAuthorizedResponse {
+	if len(responses) == 1 {
+		return responses[0]
+	}
+	out := &authorizationpb.WhoAuthorizedResponse{
+		Decisions: make(map[string]*authorizationpb.WhoAuthorizedResponse_ResourceType),
+	}
+	for _, resp := range responses {
+		out.DecisionTime = earliestTime(out.DecisionTime, resp.GetDecisionTime())
+		for resourceType, dec := range resp.GetDecisions() {
+			merged, ok := out.Decisions[resourceType]
+			if !ok {
+				merged = &authorizationpb.WhoAuthorizedResponse_ResourceType{
+					Resources: make(map[string]*authorizationpb.WhoAuthorizedResponse_Resource),
+				}
+				out.Decisions[resourceType] = merged
+			}
+			for resourceKey, resource := range dec.GetResources() {
+				mergedResource, found := merged.Resources[resourceKey]
+				if !found {
+					mergedResource = &authorizationpb.WhoAuthorizedResponse_Resource{
+						Actions: make(map[string]*authorizationpb.WhoAuthorizedResponse_Action),
+					}
+					merged.Resources[resourceKey] = mergedResource
+				}
+				for action, decision := range resource.GetActions() {
+					mergedAction, ok := mergedResource.Actions[action]
+					if !ok {
+						mergedAction = &authorizationpb.WhoAuthorizedResponse_Action{}
+						mergedResource.Actions[action] = mergedAction
+					}
+					mergedAction.Subjects = append(mergedAction.Subjects, decision.GetSubjects()...)
+				}
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions_test
+
+import (
+	"time"
+
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/indykite/opa-indykite-plugin/functions"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Chunk merging", func() {
+	decisionTime := timestamppb.New(time.Date(2022, 02, 22, 15, 18, 22, 0, time.UTC))
+
+	It("Merges actions of the same resource in multiple chunks", func() {
+		responses := []*authorizationpb.IsAuthorizedResponse{
+			{DecisionTime: decisionTime, Decisions: map[string]*authorizationpb.IsAuthorizedResponse_ResourceType{
+				"Type": {Resources: map[string]*authorizationpb.IsAuthorizedResponse_Resource{
+					"res1": {},
+				}},
+			}},
+			{DecisionTime: decisionTime, Decisions: map[string]*authorizationpb.IsAuthorizedResponse_ResourceType{
+				"Type": {Resources: map[string]*authorizationpb.IsAuthorizedResponse_Resource{
+					"res1": {Actions: map[string]*authorizationpb.IsAuthorizedResponse_Action{"READ": {Allow: true}}},
+				}},
+			}},
+			{DecisionTime: decisionTime, Decisions: map[string]*authorizationpb.IsAuthorizedResponse_ResourceType{
+				"Type": {Resources: map[string]*authorizationpb.IsAuthorizedResponse_Resource{
+					"res1": {Actions: map[string]*authorizationpb.IsAuthorizedResponse_Action{"WRITE": {}}},
+				}},
+			}},
+		}
+		original := make([]*authorizationpb.IsAuthorizedResponse, len(responses))
+		for i, resp := range responses {
+			original[i] = proto.Clone(resp).(*authorizationpb.IsAuthorizedResponse)
+		}
+
+		Expect(functions.MergeIsAuthorizedResponses(responses)).To(EqualProto(&authorizationpb.IsAuthorizedResponse{
+			DecisionTime: decisionTime,
+			Decisions: map[string]*authorizationpb.IsAuthorizedResponse_ResourceType{
+				"Type": {Resources: map[string]*authorizationpb.IsAuthorizedResponse_Resource{
+					"res1": {Actions: map[string]*authorizationpb.IsAuthorizedResponse_Action{
+						"READ": {Allow: true}, "WRITE": {},
+					}},
+				}},
+			},
+		}))
+		for i, resp := range responses {
+			Expect(resp).To(EqualProto(original[i]))
+		}
+	})
+
+	It("Appends subjects of the same resource and action in multiple chunks", func() {
+		subjects := func(ids ...string) map[string]*authorizationpb.WhoAuthorizedResponse_Action {
+			action := &authorizationpb.WhoAuthorizedResponse_Action{}
+			for _, id := range ids {
+				action.Subjects = append(action.Subjects,
+					&authorizationpb.WhoAuthorizedResponse_Subject{ExternalId: id})
+			}
+			return map[string]*authorizationpb.WhoAuthorizedResponse_Action{"READ": action}
+		}
+		responses := []*authorizationpb.WhoAuthorizedResponse{
+			{DecisionTime: decisionTime, Decisions: map[string]*authorizationpb.WhoAuthorizedResponse_ResourceType{
+				"Type": {Resources: map[string]*authorizationpb.WhoAuthorizedResponse_Resource{
+					"res1": {Actions: subjects("subA")},
+				}},
+			}},
+			{DecisionTime: decisionTime, Decisions: map[string]*authorizationpb.WhoAuthorizedResponse_ResourceType{
+				"Type": {Resources: map[string]*authorizationpb.WhoAuthorizedResponse_Resource{
+					"res1": {Actions: subjects("subB", "subC")},
+					"res2": {},
+				}},
+			}},
+		}
+		original := make([]*authorizationpb.WhoAuthorizedResponse, len(responses))
+		for i, resp := range responses {
+			original[i] = proto.Clone(resp).(*authorizationpb.WhoAuthorizedResponse)
+		}
+
+		Expect(functions.MergeWhoAuthorizedResponses(responses)).To(EqualProto(&authorizationpb.WhoAuthorizedResponse{
+			DecisionTime: decisionTime,
+			Decisions: map[string]*authorizationpb.WhoAuthorizedResponse_ResourceType{
+				"Type": {Resources: map[string]*authorizationpb.WhoAuthorizedResponse_Resource{
+					"res1": {Actions: subjects("subA", "subB", "subC")},
+					"res2": {},
+				}},
+			},
+		}))
+		for i, resp := range responses {
+			Expect(resp).To(EqualProto(original[i]))
+		}
+	})
+})
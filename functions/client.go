@@ -16,48 +16,150 @@ package functions
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 
 	"github.com/indykite/indykite-sdk-go/authorization"
 	api "github.com/indykite/indykite-sdk-go/grpc"
 	"github.com/indykite/indykite-sdk-go/grpc/config"
+	"github.com/open-policy-agent/opa/rego"
 	"github.com/sirupsen/logrus"
 
 	"github.com/indykite/opa-indykite-plugin/plugins"
 )
 
 var (
-	authorizationClient *authorization.Client
-	clientMtx           sync.Mutex
+	// envClient is created from environment variables on first use, when builtins run without plugin.
+	envClient    atomic.Pointer[authorization.Client]
+	envClientMtx sync.Mutex
+	// overrideClient is set by OverrideAuthorizationClient.
+	overrideClient atomic.Pointer[authorization.Client]
 )
 
-// OverrideAuthorizationClient set and override AuthorizationClient Connection for OPA and return previously
-// set connection.
+type clientContextKey struct{}
+
+// WithAuthorizationClient returns ctx, in which builtins call IndyKite with client
+// instead of the client of the plugin. Evaluations with different clients can run concurrently.
+func WithAuthorizationClient(ctx context.Context, client *authorization.Client) context.Context {
+	return context.WithValue(ctx, clientContextKey{}, client)
+}
+
+// OverrideAuthorizationClient sets client, which builtins use for all evaluations in the process
+// instead of the client of the plugin, and returns previously set client. Nil removes the override.
+// Client set by WithAuthorizationClient takes precedence.
+//
+// Deprecated: Use WithAuthorizationClient or Options, which do not affect other OPA instances in the process.
 func OverrideAuthorizationClient(conn *authorization.Client) *authorization.Client {
-	oldConn := authorizationClient
-	authorizationClient = conn
-	return oldConn
+	return overrideClient.Swap(conn)
 }
 
-// AuthorizationClient creates IndyKite Authorization client based on defined plugin or environment variables.
+// AuthorizationClient returns IndyKite Authorization client which builtins use with ctx.
+// It is the client set by WithAuthorizationClient, client of the default connection of the plugin
+// or client created from environment variables, when no plugin is registered. When plugins are registered,
+// but none of them serves ctx, error is returned.
+// Client of the plugin is not acquired, so it can be closed by credential rotation while in use.
+// Use AcquireAuthorizationClient for calls, which must not be interrupted.
 func AuthorizationClient(ctx context.Context) (*authorization.Client, error) {
-	if authorizationClient != nil {
-		return authorizationClient, nil
+	client, release, err := AcquireAuthorizationClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	release()
+	return client, nil
+}
+
+// AcquireAuthorizationClient returns the same client as AuthorizationClient and release function,
+// which must be called once the client is no longer used. While acquired, the plugin does not close
+// the connection on credential rotation.
+func AcquireAuthorizationClient(ctx context.Context) (*authorization.Client, func(), error) {
+	plugin, err := plugins.Resolve(ctx, nil)
+	if err != nil && clientFromContext(ctx) == nil {
+		return nil, nil, err
+	}
+	connection, err := resolveConnection(ctx, plugin, nil, nil, 0)
+	if err != nil {
+		return nil, nil, err
 	}
+	return acquireAuthorizationClient(ctx, plugin, connection)
+}
+
+// resolvePlugin returns plugin of the OPA instance evaluating the query, or nil when there is none.
+// Plugin which cannot be resolved is not needed, when ctx carries client set by WithAuthorizationClient.
+func resolvePlugin(bCtx rego.BuiltinContext) (*plugins.IndyKitePlugin, error) {
+	plugin, err := plugins.Resolve(bCtx.Context, bCtx.Runtime)
+	if err != nil && clientFromContext(bCtx.Context) != nil {
+		return nil, nil
+	}
+	return plugin, err
+}
+
+// clientFromContext returns client set by WithAuthorizationClient or OverrideAuthorizationClient, or nil.
+func clientFromContext(ctx context.Context) *authorization.Client {
+	if c, _ := ctx.Value(clientContextKey{}).(*authorization.Client); c != nil {
+		return c
+	}
+	return overrideClient.Load()
+}
 
-	clientMtx.Lock()
-	defer clientMtx.Unlock()
+// acquireAuthorizationClient returns IndyKite Authorization client of connection resolved by resolveConnection
+// and release function, which must be called once the call with the client is done. While acquired,
+// the plugin does not close the connection on credential rotation.
+func acquireAuthorizationClient(
+	ctx context.Context,
+	plugin *plugins.IndyKitePlugin,
+	connection string,
+) (*authorization.Client, func(), error) {
+	if c := clientFromContext(ctx); c != nil {
+		return c, func() {}, nil
+	}
 
-	if plugin := plugins.IndyKite(); plugin != nil {
-		authorizationClient = plugin.AuthorizationClient()
-	} else {
-		c, err := authorization.NewClient(ctx, api.WithCredentialsLoader(config.DefaultEnvironmentLoader))
-		if err != nil {
-			logrus.WithError(err).Info("failed to connect to IndyKite")
-			return nil, err
+	// Client owned by the plugin is not cached here, the plugin manages its lifecycle.
+	if plugin != nil {
+		if c, release := plugin.AcquireConnectionClient(connection); c != nil {
+			return c, release, nil
 		}
-		authorizationClient = c
+		return nil, nil, errNotConnected(connection)
+	}
+
+	if c := envClient.Load(); c != nil {
+		return c, func() {}, nil
+	}
+	envClientMtx.Lock()
+	defer envClientMtx.Unlock()
+	if c := envClient.Load(); c != nil {
+		return c, func() {}, nil
 	}
 
-	return authorizationClient, nil
+	c, err := authorization.NewClient(ctx, api.WithCredentialsLoader(config.DefaultEnvironmentLoader))
+	if err != nil {
+		logrus.WithError(err).Info("failed to connect to IndyKite")
+		return nil, nil, err
+	}
+	envClient.Store(c)
+
+	return c, func() {}, nil
+}
+
+// noClientError is returned by calls, which could not acquire client of their connection. It counts as
+// IndyKite being unavailable, but builtins return the original error.
+type noClientError struct {
+	err error
+}
+
+func (e *noClientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *noClientError) Unwrap() error {
+	return e.err
+}
+
+// asNoClient returns original error of noClientError, if err is one.
+func asNoClient(err error) (error, bool) {
+	var noClient *noClientError
+	if errors.As(err, &noClient) {
+		return noClient.err, true
+	}
+	return nil, false
 }
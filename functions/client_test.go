@@ -0,0 +1,124 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions_test
+
+import (
+	"context"
+	"sync"
+
+	"github.com/indykite/indykite-sdk-go/authorization"
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	authorizationm "github.com/indykite/indykite-sdk-go/test/authorization/v1beta1"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"go.uber.org/mock/gomock"
+
+	"github.com/indykite/opa-indykite-plugin/functions"
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Authorization client", func() {
+	It("Returns client from context", func() {
+		client, _ := authorization.NewClientFromGRPCClient(
+			authorizationm.NewMockAuthorizationAPIClient(gomock.NewController(GinkgoT())))
+
+		resolved, err := functions.AuthorizationClient(functions.WithAuthorizationClient(context.Background(), client))
+		Expect(err).To(Succeed())
+		Expect(resolved).To(BeIdenticalTo(client))
+	})
+
+	It("Returns client set by deprecated override", func() {
+		client, _ := authorization.NewClientFromGRPCClient(
+			authorizationm.NewMockAuthorizationAPIClient(gomock.NewController(GinkgoT())))
+		ctxClient, _ := authorization.NewClientFromGRPCClient(
+			authorizationm.NewMockAuthorizationAPIClient(gomock.NewController(GinkgoT())))
+
+		Expect(functions.OverrideAuthorizationClient(client)).To(BeNil())
+		DeferCleanup(func() { functions.OverrideAuthorizationClient(nil) })
+
+		resolved, release, err := functions.AcquireAuthorizationClient(context.Background())
+		Expect(err).To(Succeed())
+		release()
+		Expect(resolved).To(BeIdenticalTo(client))
+
+		ctx := functions.WithAuthorizationClient(context.Background(), ctxClient)
+		resolved, err = functions.AuthorizationClient(ctx)
+		Expect(err).To(Succeed())
+		Expect(resolved).To(BeIdenticalTo(ctxClient))
+
+		Expect(functions.OverrideAuthorizationClient(nil)).To(BeIdenticalTo(client))
+	})
+
+	It("Fails instead of using environment client, when plugin cannot be resolved", func() {
+		for range 2 {
+			plugin := plugins.NewEmbedded(nil, nil, nil, ast.NewTerm(ast.NewObject()))
+			DeferCleanup(plugin.Unregister)
+		}
+
+		_, err := rego.New(
+			rego.Runtime(ast.NewTerm(ast.NewObject())),
+			rego.Query(`x = indy.is_authorized({"id": "`+testAccessToken+`"}, [], {}, [])`),
+			rego.StrictBuiltinErrors(true),
+		).Eval(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("IndyKite plugin of the rego instance cannot be resolved")))
+	})
+
+	It("Calls IndyKite with client of each evaluation concurrently", func() {
+		query, err := rego.New(
+			rego.Query(`x = indy.is_authorized({"id": "`+testAccessToken+`"}, [
+				{"externalId": "res1", "type": "Type", "actions": ["READ"]}
+			], {}, [])`),
+			rego.StrictBuiltinErrors(true),
+		).PrepareForEval(context.Background())
+		Expect(err).To(Succeed())
+
+		// Each client allows the action only for own tenant, so mixed up clients change the decision.
+		newContext := func(allow bool) context.Context {
+			mockClient := authorizationm.NewMockAuthorizationAPIClient(gomock.NewController(GinkgoT()))
+			mockClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(&authorizationpb.IsAuthorizedResponse{
+					Decisions: map[string]*authorizationpb.IsAuthorizedResponse_ResourceType{
+						"Type": {Resources: map[string]*authorizationpb.IsAuthorizedResponse_Resource{
+							"res1": {Actions: map[string]*authorizationpb.IsAuthorizedResponse_Action{
+								"READ": {Allow: allow},
+							}},
+						}},
+					},
+				}, nil).AnyTimes()
+			client, _ := authorization.NewClientFromGRPCClient(mockClient)
+			return functions.WithAuthorizationClient(context.Background(), client)
+		}
+		contexts := map[bool]context.Context{true: newContext(true), false: newContext(false)}
+
+		var wg sync.WaitGroup
+		for i := range 20 {
+			allow := i%2 == 0
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer GinkgoRecover()
+				rs, err := query.Eval(contexts[allow])
+				Expect(err).To(Succeed())
+				Expect(rs[0].Bindings["x"]).To(HaveKeyWithValue("decisions",
+					HaveKeyWithValue("Type", HaveKeyWithValue("res1", HaveKeyWithValue("READ",
+						HaveKeyWithValue("allow", allow))))))
+			}()
+		}
+		wg.Wait()
+	})
+})
@@ -0,0 +1,112 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	sdkerrors "github.com/indykite/indykite-sdk-go/errors"
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown/builtins"
+	"github.com/open-policy-agent/opa/types"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+	"github.com/indykite/opa-indykite-plugin/utilities"
+)
+
+const connectionKey = "connection"
+
+// connectionArg is trailing argument of *_with_connection builtins.
+var connectionArg = types.Named(connectionKey, types.S)
+
+// withConnectionArg returns copy of args of builtin followed by connectionArg.
+func withConnectionArg(args []types.Type) []types.Type {
+	return append(args[:len(args):len(args)], connectionArg)
+}
+
+var errNoDefaultConnection = errors.New("no default IndyKite connection, set default_connection " +
+	"in plugin configuration or pass connection name")
+
+// errNotConnected is returned when the connection selected by builtin is not established.
+func errNotConnected(connection string) error {
+	return fmt.Errorf("IndyKite connection %q is not connected, check plugin status", connection)
+}
+
+// resolveConnection returns name of the connection used by builtin. Connection operand at pos is optional,
+// without it the connection is routed by access token in subject, when routing is configured,
+// or the default connection of the plugin is used. Subject is nil for builtins without subject.
+// Without plugin only the unnamed connection is available. When ctx carries client set
+// by WithAuthorizationClient, the name is not checked.
+// Access token without route is rejected with error, for which rejectedObject returns result of builtin.
+func resolveConnection(
+	ctx context.Context,
+	plugin *plugins.IndyKitePlugin,
+	connection *ast.Term,
+	subject *authorizationpb.Subject,
+	pos int,
+) (string, error) {
+	var name string
+	if connection != nil {
+		s, err := builtins.StringOperand(connection.Value, pos)
+		if err != nil {
+			return "", err
+		}
+		if name = string(s); name == "" {
+			return "", builtins.NewOperandErr(pos, "connection name must not be empty")
+		}
+	}
+
+	switch {
+	case clientFromContext(ctx) != nil:
+		return name, nil
+	case plugin == nil:
+		if name != "" {
+			return "", builtins.NewOperandErr(pos, "unknown connection %q", name)
+		}
+		return "", nil
+	case name == "":
+		if token := subject.GetAccessToken(); token != "" {
+			routed, err := plugin.RouteToken(token)
+			if err != nil {
+				return "", sdkerrors.NewInvalidArgumentError(err.Error())
+			}
+			if routed != "" {
+				return routed, nil
+			}
+		}
+		if name = plugin.DefaultConnection(); name == "" {
+			return "", errNoDefaultConnection
+		}
+		return name, nil
+	case !plugin.HasConnection(name):
+		return "", builtins.NewOperandErr(pos, "unknown connection %q", name)
+	}
+	return name, nil
+}
+
+// rejectedObject returns result object of builtin with user error, when err rejected the call
+// before calling IndyKite, see resolveConnection and validateSubject. The error object has the same shape
+// as for errors returned by IndyKite.
+func rejectedObject(err error) (ast.Object, bool) {
+	var clientErr *sdkerrors.ClientError
+	if !errors.As(err, &clientErr) {
+		return nil, false
+	}
+	statusErr := sdkerrors.FromError(clientErr)
+	return ast.NewObject(ast.Item(ast.StringTerm("error"), utilities.BuildUserError(statusErr))), true
+}
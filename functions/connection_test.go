@@ -0,0 +1,110 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions_test
+
+import (
+	"context"
+
+	"github.com/indykite/indykite-sdk-go/authorization"
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	authorizationm "github.com/indykite/indykite-sdk-go/test/authorization/v1beta1"
+	"github.com/open-policy-agent/opa/rego"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/indykite/opa-indykite-plugin/functions"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Connections", func() {
+	var (
+		mockClient *authorizationm.MockAuthorizationAPIClient
+		client     *authorization.Client
+	)
+
+	BeforeEach(func() {
+		mockClient = authorizationm.NewMockAuthorizationAPIClient(gomock.NewController(GinkgoT()))
+		client, _ = authorization.NewClientFromGRPCClient(mockClient)
+	})
+
+	eval := func(ctx context.Context, query string, opts ...func(*rego.Rego)) (rego.ResultSet, error) {
+		return rego.New(append(opts, rego.Query(query), rego.StrictBuiltinErrors(true))...).Eval(ctx)
+	}
+
+	subject := `{"id": "` + testAccessToken + `"}`
+	resources := `[{"externalId": "res1", "type": "Type", "actions": ["READ"]}]`
+
+	DescribeTable("Calls IndyKite with the named connection",
+		func(query string) {
+			mockClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(&authorizationpb.IsAuthorizedResponse{DecisionTime: timestamppb.Now()}, nil).AnyTimes()
+			mockClient.EXPECT().WhatAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(&authorizationpb.WhatAuthorizedResponse{DecisionTime: timestamppb.Now()}, nil).AnyTimes()
+			mockClient.EXPECT().WhoAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(&authorizationpb.WhoAuthorizedResponse{DecisionTime: timestamppb.Now()}, nil).AnyTimes()
+
+			option, release := functions.Options(client)
+			defer release()
+			rs, err := eval(context.Background(), query, option)
+			Expect(err).To(Succeed())
+			Expect(rs).To(HaveLen(1))
+		},
+		Entry("indy.is_authorized_with_connection",
+			`x = indy.is_authorized_with_connection(`+subject+`, `+resources+`, {}, [], "default")`),
+		Entry("indy.what_authorized_with_connection",
+			`x = indy.what_authorized_with_connection(`+subject+`, [{"type": "Type"}], {}, [], "default")`),
+		Entry("indy.who_authorized_with_connection",
+			`x = indy.who_authorized_with_connection(`+resources+`, {}, [], "default")`),
+		Entry("indy.allowed_with_options",
+			`x = indy.allowed_with_options(`+subject+`, {"externalId": "res1", "type": "Type"}, "READ",
+				{"connection": "default"})`),
+	)
+
+	DescribeTable("Rejects unknown connection",
+		func(query, message string) {
+			option, release := functions.Options(client)
+			defer release()
+			_, err := eval(context.Background(), query, option)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("indy.is_authorized_with_connection",
+			`x = indy.is_authorized_with_connection(`+subject+`, `+resources+`, {}, [], "eu")`,
+			`operand 5 unknown connection "eu"`),
+		Entry("indy.what_authorized_with_connection",
+			`x = indy.what_authorized_with_connection(`+subject+`, [{"type": "Type"}], {}, [], "eu")`,
+			`operand 5 unknown connection "eu"`),
+		Entry("indy.who_authorized_with_connection",
+			`x = indy.who_authorized_with_connection(`+resources+`, {}, [], "eu")`,
+			`operand 4 unknown connection "eu"`),
+		Entry("indy.allowed_with_options",
+			`x = indy.allowed_with_options(`+subject+`, {"externalId": "res1", "type": "Type"}, "READ",
+				{"connection": "eu"})`,
+			`operand 4 unknown connection "eu"`),
+		Entry("Empty connection name",
+			`x = indy.who_authorized_with_connection(`+resources+`, {}, [], "")`,
+			`operand 4 connection name must not be empty`),
+	)
+
+	It("Uses client from context regardless of connection name", func() {
+		mockClient.EXPECT().WhoAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(&authorizationpb.WhoAuthorizedResponse{DecisionTime: timestamppb.Now()}, nil)
+
+		ctx := functions.WithAuthorizationClient(context.Background(), client)
+		_, err := eval(ctx, `x = indy.who_authorized_with_connection(`+resources+`, {}, [], "eu")`)
+		Expect(err).To(Succeed())
+	})
+})
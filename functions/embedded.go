@@ -0,0 +1,119 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions
+
+import (
+	"github.com/indykite/indykite-sdk-go/authorization"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/rego"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+)
+
+type (
+	// Option configures builtins of rego instances created with Options.
+	Option func(*embeddedOptions)
+
+	embeddedOptions struct {
+		config  plugins.Config
+		logger  logging.Logger
+		runtime *ast.Term
+	}
+)
+
+// WithDecisionCache enables caching of indy.is_authorized decisions.
+// Invalid configuration is logged and caching stays disabled.
+func WithDecisionCache(cfg *plugins.DecisionCacheConfig) Option {
+	return func(o *embeddedOptions) {
+		o.config.DecisionCache = cfg
+	}
+}
+
+// WithRetry enables retries of IndyKite calls failing with transient errors.
+// Invalid configuration is logged and retries stay disabled.
+func WithRetry(cfg *plugins.RetryConfig) Option {
+	return func(o *embeddedOptions) {
+		o.config.Retry = cfg
+	}
+}
+
+// WithTokenValidation enables local validation of access tokens in subject before calling IndyKite.
+// Invalid configuration is logged and validation stays disabled.
+func WithTokenValidation(cfg *plugins.TokenValidationConfig) Option {
+	return func(o *embeddedOptions) {
+		o.config.TokenValidation = cfg
+	}
+}
+
+// WithLogger sets logger of builtins. Nothing is logged by default.
+func WithLogger(logger logging.Logger) Option {
+	return func(o *embeddedOptions) {
+		o.logger = logger
+	}
+}
+
+// WithRuntime sets runtime information returned by opa.runtime().
+// Use it instead of rego.Runtime, which would detach builtins from the client.
+func WithRuntime(runtime *ast.Term) Option {
+	return func(o *embeddedOptions) {
+		o.runtime = runtime
+	}
+}
+
+// Options returns rego option, which makes indy.* builtins call IndyKite with client,
+// instead of the client of OPA plugin or from environment variables, and release function.
+// Each call creates builtins settings with own decision cache, which are kept until release is called.
+// Release must be called when rego instances created with the option are no longer used, otherwise the settings
+// are never freed. Returned option should be created once per client and reused for all rego instances.
+// Client is owned by the caller, who must close it when no longer used.
+//
+// Builtins are registered globally by this package and OPA prefers them over functions passed
+// by rego.Function, so instance settings are bound through runtime information of the rego instance.
+// The option sets runtime information, which is matched by identity and has the value given by WithRuntime,
+// so opa.runtime() returns the same as without the option. Do not combine the option with rego.Runtime,
+// use WithRuntime instead. Builtins evaluated with other runtime information fail with error instead of calling
+// IndyKite with other client, as well as builtins evaluated after release. Rego instances created without any
+// runtime information are not affected and keep using the client of OPA plugin or from environment variables.
+func Options(client *authorization.Client, opts ...Option) (func(*rego.Rego), func()) {
+	o := &embeddedOptions{logger: logging.NewNoOpLogger()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.config.DecisionCache != nil {
+		if err := o.config.DecisionCache.Validate(); err != nil {
+			o.logger.Error("Invalid IndyKite decision cache configuration, cache is disabled: %v", err)
+			o.config.DecisionCache = nil
+		}
+	}
+	if o.config.Retry != nil {
+		if err := o.config.Retry.Validate(); err != nil {
+			o.logger.Error("Invalid IndyKite retry configuration, retries are disabled: %v", err)
+			o.config.Retry = nil
+		}
+	}
+	if o.config.TokenValidation != nil {
+		if err := o.config.TokenValidation.Validate(); err != nil {
+			o.logger.Error("Invalid IndyKite token validation configuration, validation is disabled: %v", err)
+			o.config.TokenValidation = nil
+		}
+	}
+	if o.runtime == nil {
+		o.runtime = ast.NewTerm(ast.NewObject())
+	}
+
+	plugin := plugins.NewEmbedded(client, &o.config, o.logger, o.runtime)
+	return rego.Runtime(plugin.Runtime()), plugin.Unregister
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions_test
+
+import (
+	"context"
+	"sync"
+
+	"github.com/indykite/indykite-sdk-go/authorization"
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	authorizationm "github.com/indykite/indykite-sdk-go/test/authorization/v1beta1"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/logging"
+	loggingtest "github.com/open-policy-agent/opa/logging/test"
+	"github.com/open-policy-agent/opa/rego"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/indykite/opa-indykite-plugin/functions"
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Options", func() {
+	query := `x = indy.allowed({"id": "` + testAccessToken + `"}, {"externalId": "res1", "type": "Type"}, "READ")`
+
+	allowResponse := func(allow bool) *authorizationpb.IsAuthorizedResponse {
+		return &authorizationpb.IsAuthorizedResponse{
+			Decisions: map[string]*authorizationpb.IsAuthorizedResponse_ResourceType{
+				"Type": {Resources: map[string]*authorizationpb.IsAuthorizedResponse_Resource{
+					"res1": {Actions: map[string]*authorizationpb.IsAuthorizedResponse_Action{
+						"READ": {Allow: allow},
+					}},
+				}},
+			},
+		}
+	}
+
+	newClient := func() (*authorizationm.MockAuthorizationAPIClient, *authorization.Client) {
+		mockClient := authorizationm.NewMockAuthorizationAPIClient(gomock.NewController(GinkgoT()))
+		client, _ := authorization.NewClientFromGRPCClient(mockClient)
+		return mockClient, client
+	}
+
+	prepare := func(client *authorization.Client, opts ...functions.Option) rego.PreparedEvalQuery {
+		option, release := functions.Options(client, opts...)
+		DeferCleanup(release)
+		prepared, err := rego.New(
+			option,
+			rego.Query(query),
+			rego.StrictBuiltinErrors(true),
+		).PrepareForEval(context.Background())
+		Expect(err).To(Succeed())
+		return prepared
+	}
+
+	evalAllowed := func(prepared rego.PreparedEvalQuery) bool {
+		rs, err := prepared.Eval(context.Background())
+		Expect(err).To(Succeed())
+		return rs[0].Bindings["x"].(bool)
+	}
+
+	It("Calls IndyKite with client of each rego instance", func() {
+		allowClient, allowConn := newClient()
+		allowClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(allowResponse(true), nil).AnyTimes()
+		denyClient, denyConn := newClient()
+		denyClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(allowResponse(false), nil).AnyTimes()
+		instances := map[bool]rego.PreparedEvalQuery{true: prepare(allowConn), false: prepare(denyConn)}
+
+		var wg sync.WaitGroup
+		for i := range 20 {
+			allow := i%2 == 0
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer GinkgoRecover()
+				Expect(evalAllowed(instances[allow])).To(Equal(allow))
+			}()
+		}
+		wg.Wait()
+	})
+
+	It("Keeps runtime information", func() {
+		mockClient, client := newClient()
+		mockClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).Return(allowResponse(true), nil)
+		runtime := ast.MustParseTerm(`{"env": {"TENANT": "first"}}`)
+
+		option, release := functions.Options(client, functions.WithRuntime(runtime))
+		DeferCleanup(release)
+		prepared, err := rego.New(
+			option,
+			rego.Query(`x = opa.runtime(); `+query[len("x = "):]),
+		).PrepareForEval(context.Background())
+		Expect(err).To(Succeed())
+		rs, err := prepared.Eval(context.Background())
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings).To(HaveKeyWithValue("x", map[string]interface{}{
+			"env": map[string]interface{}{"TENANT": "first"},
+		}))
+	})
+
+	It("Does not expose binding in runtime information", func() {
+		_, client := newClient()
+		option, release := functions.Options(client)
+		DeferCleanup(release)
+
+		rs, err := rego.New(option, rego.Query(`x = opa.runtime()`)).Eval(context.Background())
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings).To(HaveKeyWithValue("x", BeEmpty()))
+	})
+
+	It("Releases settings of rego instances", func() {
+		mockClient, client := newClient()
+		mockClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).Return(allowResponse(true), nil)
+
+		option, release := functions.Options(client)
+		prepared, err := rego.New(
+			option,
+			rego.Query(query),
+			rego.StrictBuiltinErrors(true),
+		).PrepareForEval(context.Background())
+		Expect(err).To(Succeed())
+		Expect(evalAllowed(prepared)).To(BeTrue())
+
+		release()
+		_, err = prepared.Eval(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("IndyKite settings of the rego instance were released")))
+	})
+
+	It("Fails instead of using other client, when runtime information is replaced", func() {
+		_, client := newClient()
+		option, release := functions.Options(client)
+		DeferCleanup(release)
+
+		_, err := rego.New(
+			option,
+			rego.Runtime(ast.MustParseTerm(`{"env": {}}`)),
+			rego.Query(query),
+			rego.StrictBuiltinErrors(true),
+		).Eval(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("IndyKite plugin of the rego instance cannot be resolved")))
+	})
+
+	It("Keeps plain rego instances working next to instances with options", func() {
+		mockClient, client := newClient()
+		mockClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).Return(allowResponse(true), nil)
+		Expect(evalAllowed(prepare(client))).To(BeTrue())
+
+		// Without runtime information builtins use client from environment variables, which are not set.
+		_, err := rego.New(
+			rego.Query(query),
+			rego.StrictBuiltinErrors(true),
+		).Eval(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("indy.allowed: missing endpoint")))
+	})
+
+	It("Caches decisions per instance", func() {
+		mockClient, client := newClient()
+		mockClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(allowResponse(true), nil).Times(2)
+
+		cache := &plugins.DecisionCacheConfig{MaxEntries: 10}
+		first := prepare(client, functions.WithDecisionCache(cache))
+		second := prepare(client, functions.WithDecisionCache(cache))
+		for range 3 {
+			Expect(evalAllowed(first)).To(BeTrue())
+			Expect(evalAllowed(second)).To(BeTrue())
+		}
+	})
+
+	It("Retries transient errors and logs with given logger", func() {
+		mockClient, client := newClient()
+		gomock.InOrder(
+			mockClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(nil, status.Error(codes.Unavailable, "unavailable")),
+			mockClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(allowResponse(true), nil),
+		)
+		logger := loggingtest.New()
+
+		Expect(evalAllowed(prepare(client,
+			functions.WithRetry(&plugins.RetryConfig{BaseBackoffMillis: 1}),
+			functions.WithLogger(logger),
+		))).To(BeTrue())
+		Expect(logger.Entries()).To(ConsistOf(And(
+			HaveField("Level", logging.Info),
+			HaveField("Message", "IndyKite call failed, retrying"),
+			HaveField("Fields", And(HaveKeyWithValue("attempt", 1), HaveKeyWithValue("grpc_code", "Unavailable"))),
+		)))
+	})
+
+	It("Disables invalid retry configuration", func() {
+		mockClient, client := newClient()
+		mockClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(nil, status.Error(codes.Unavailable, "unavailable"))
+		logger := loggingtest.New()
+
+		_, err := prepare(client,
+			functions.WithRetry(&plugins.RetryConfig{MaxAttempts: -1}),
+			functions.WithLogger(logger),
+		).Eval(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("unavailable")))
+		Expect(logger.Entries()).To(ConsistOf(HaveField("Message",
+			ContainSubstring("Invalid IndyKite retry configuration"))))
+	})
+})
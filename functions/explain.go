@@ -0,0 +1,123 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions
+
+import (
+	"fmt"
+
+	json "github.com/json-iterator/go"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/open-policy-agent/opa/topdown/print"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+)
+
+// explainCall emits IndyKite request and response of builtin as trace notes, which are visible
+// in explain output of opa eval and REPL. With debug enabled in plugin config, the same messages are printed
+// like with print(). Tokens and configured inputParams are redacted.
+func explainCall(
+	bCtx rego.BuiltinContext,
+	plugin *plugins.IndyKitePlugin,
+	builtin string,
+	req, resp proto.Message,
+	callErr error,
+) {
+	if !(bCtx.TraceEnabled && len(bCtx.QueryTracers) > 0) && bCtx.PrintHook == nil {
+		return
+	}
+	explain(bCtx, debugEnabled(plugin), currentRedactor(plugin), builtin, req, resp, callErr)
+}
+
+func explain(
+	bCtx rego.BuiltinContext,
+	debug bool,
+	redactor *plugins.Redactor,
+	builtin string,
+	req, resp proto.Message,
+	callErr error,
+) {
+	traceEnabled := bCtx.TraceEnabled && len(bCtx.QueryTracers) > 0
+	printEnabled := bCtx.PrintHook != nil && debug
+	if !traceEnabled && !printEnabled {
+		return
+	}
+
+	messages := []string{builtin + " request: " + explainMessage(redactor, req)}
+	if callErr != nil {
+		messages = append(messages, builtin+" error: "+redactor.RedactString(callErr.Error()))
+	} else {
+		messages = append(messages, builtin+" response: "+explainMessage(redactor, resp))
+	}
+
+	for _, msg := range messages {
+		if traceEnabled {
+			event := topdown.Event{
+				Op:       topdown.NoteOp,
+				Location: bCtx.Location,
+				QueryID:  bCtx.QueryID,
+				ParentID: bCtx.ParentID,
+				Message:  msg,
+			}
+			for _, tracer := range bCtx.QueryTracers {
+				tracer.TraceEvent(event)
+			}
+		}
+		if printEnabled {
+			// Printing is best effort, failure must not change the decision.
+			_ = bCtx.PrintHook.Print(print.Context{Context: bCtx.Context, Location: bCtx.Location}, msg)
+		}
+	}
+}
+
+// explainMessage returns redacted JSON of msg with stable formatting.
+// Access token of subject is always masked, even when it is not JWT-shaped or tokens are kept.
+func explainMessage(redactor *plugins.Redactor, msg proto.Message) string {
+	data, err := protojson.Marshal(msg)
+	if err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	var value map[string]interface{}
+	if err = json.Unmarshal(data, &value); err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	if subject, ok := value["subject"].(map[string]interface{}); ok {
+		if token, ok := subject["accessToken"]; ok {
+			subject["accessToken"] = redactor.Mask(token)
+		}
+	}
+	// Redacted value consists of JSON decoded values and strings, so it can always be encoded back.
+	// Configuration compatible with the standard library sorts object keys.
+	data, _ = json.ConfigCompatibleWithStandardLibrary.Marshal(redactor.Redact(value))
+	return string(data)
+}
+
+// debugEnabled reports if debug output is enabled in plugin configuration.
+func debugEnabled(plugin *plugins.IndyKitePlugin) bool {
+	return plugin != nil && plugin.Config().Debug
+}
+
+// currentRedactor returns redactor of decision logs configuration, so debug output does not reveal
+// more than decision logs. Without plugin only tokens are redacted.
+func currentRedactor(plugin *plugins.IndyKitePlugin) *plugins.Redactor {
+	if plugin != nil {
+		if cfg := plugin.Config().DecisionLogs; cfg != nil {
+			return plugins.NewRedactor(cfg.Redaction)
+		}
+	}
+	return plugins.NewRedactor(nil)
+}
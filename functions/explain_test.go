@@ -0,0 +1,144 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/indykite/indykite-sdk-go/authorization"
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	authorizationm "github.com/indykite/indykite-sdk-go/test/authorization/v1beta1"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/open-policy-agent/opa/topdown/print"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/indykite/opa-indykite-plugin/functions"
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type printHook []string
+
+func (h *printHook) Print(_ print.Context, msg string) error {
+	*h = append(*h, msg)
+	return nil
+}
+
+var _ = Describe("Explain", func() {
+	var (
+		mockAuthorizationClient *authorizationm.MockAuthorizationAPIClient
+		ctx                     context.Context
+	)
+
+	BeforeEach(func() {
+		mockCtrl := gomock.NewController(GinkgoT())
+		mockAuthorizationClient = authorizationm.NewMockAuthorizationAPIClient(mockCtrl)
+		client, _ := authorization.NewClientFromGRPCClient(mockAuthorizationClient)
+		ctx = functions.WithAuthorizationClient(context.Background(), client)
+	})
+
+	notes := func(tracer *topdown.BufferTracer) []string {
+		var messages []string
+		for _, event := range *tracer {
+			if event.Op == topdown.NoteOp {
+				messages = append(messages, event.Message)
+			}
+		}
+		return messages
+	}
+
+	It("Emits redacted request and response as trace notes", func() {
+		mockAuthorizationClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(&authorizationpb.IsAuthorizedResponse{
+				Decisions: map[string]*authorizationpb.IsAuthorizedResponse_ResourceType{
+					"Doc": {Resources: map[string]*authorizationpb.IsAuthorizedResponse_Resource{
+						"res1": {Actions: map[string]*authorizationpb.IsAuthorizedResponse_Action{
+							"READ": {Allow: true},
+						}},
+					}},
+				},
+			}, nil)
+
+		tracer := topdown.NewBufferTracer()
+		query, err := rego.New(
+			rego.Query(`x = indy.is_authorized({"id": "`+testAccessToken+`"}, [
+				{"externalId": "res1", "type": "Doc", "actions": ["READ"]}
+			], {}, [])`),
+			rego.QueryTracer(tracer),
+		).PrepareForEval(ctx)
+		Expect(err).To(Succeed())
+		_, err = query.Eval(ctx, rego.EvalQueryTracer(tracer))
+		Expect(err).To(Succeed())
+
+		Expect(notes(tracer)).To(Equal([]string{
+			`indy.is_authorized request: {"resources":[{"actions":["READ"],"externalId":"res1","type":"Doc"}],` +
+				`"subject":{"accessToken":"[REDACTED]"}}`,
+			`indy.is_authorized response: {"decisions":{"Doc":{"resources":{"res1":{"actions":{"READ":` +
+				`{"allow":true}}}}}}}`,
+		}))
+	})
+
+	It("Prints call only in debug mode", func() {
+		req := &authorizationpb.WhatAuthorizedRequest{
+			Subject: &authorizationpb.Subject{Subject: &authorizationpb.Subject_AccessToken{
+				AccessToken: testAccessToken,
+			}},
+			InputParams: map[string]*authorizationpb.InputParam{
+				"secret": {Value: &authorizationpb.InputParam_StringValue{StringValue: "x"}},
+			},
+		}
+		redactor := plugins.NewRedactor(&plugins.RedactionConfig{InputParams: []string{"secret"}})
+		callErr := status.Error(codes.InvalidArgument, "bad request")
+
+		hook := &printHook{}
+		bCtx := rego.BuiltinContext{Context: context.Background(), PrintHook: hook}
+		functions.Explain(bCtx, false, redactor, "indy.what_authorized", req, nil, callErr)
+		Expect(*hook).To(BeEmpty())
+
+		functions.Explain(bCtx, true, redactor, "indy.what_authorized", req, nil, callErr)
+		Expect(*hook).To(Equal(printHook{
+			`indy.what_authorized request: {"inputParams":{"secret":"[REDACTED]"},` +
+				`"subject":{"accessToken":"[REDACTED]"}}`,
+			`indy.what_authorized error: rpc error: code = InvalidArgument desc = bad request`,
+		}))
+	})
+
+	DescribeTable("Masks access token of subject regardless of redaction configuration",
+		func(token string, cfg *plugins.RedactionConfig, masked string) {
+			req := &authorizationpb.WhatAuthorizedRequest{
+				Subject: &authorizationpb.Subject{Subject: &authorizationpb.Subject_AccessToken{AccessToken: token}},
+			}
+			hook := &printHook{}
+			bCtx := rego.BuiltinContext{Context: context.Background(), PrintHook: hook}
+			functions.Explain(bCtx, true, plugins.NewRedactor(cfg), "indy.what_authorized", req,
+				&authorizationpb.WhatAuthorizedResponse{}, nil)
+			Expect(*hook).To(HaveExactElements(
+				`indy.what_authorized request: {"subject":{"accessToken":"`+masked+`"}}`,
+				`indy.what_authorized response: {}`,
+			))
+		},
+		Entry("Opaque token", "opaque-access-token-value", nil, "[REDACTED]"),
+		Entry("Kept JWT", testAccessToken, &plugins.RedactionConfig{KeepTokens: true}, "[REDACTED]"),
+		Entry("Hash mode", "opaque-access-token-value", &plugins.RedactionConfig{Mode: plugins.RedactionModeHash},
+			"sha256:"+fmt.Sprintf("%x", sha256.Sum256([]byte("opaque-access-token-value")))),
+	)
+})
@@ -0,0 +1,122 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions
+
+import (
+	"context"
+	"time"
+
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	"github.com/open-policy-agent/opa/ast"
+
+	"github.com/indykite/opa-indykite-plugin/internal/clock"
+	"github.com/indykite/opa-indykite-plugin/plugins"
+)
+
+// Batcher exposes batcher for tests.
+type Batcher = batcher
+
+// NewBatcher creates batcher which sends merged requests with send.
+func NewBatcher(
+	cfg *plugins.BatchingConfig,
+	send func(context.Context, *authorizationpb.IsAuthorizedRequest) (*authorizationpb.IsAuthorizedResponse, error),
+) *Batcher {
+	return newBatcher(cfg, send)
+}
+
+// IsAuthorized exposes batcher.isAuthorized for tests.
+func (b *batcher) IsAuthorized(
+	ctx context.Context,
+	req *authorizationpb.IsAuthorizedRequest,
+) (*authorizationpb.IsAuthorizedResponse, error) {
+	return b.isAuthorized(ctx, req)
+}
+
+// Stop exposes batcher.stop for tests.
+func (b *batcher) Stop() {
+	b.stop()
+}
+
+// CurrentBatcher exposes currentBatcher for tests.
+func CurrentBatcher(plugin *plugins.IndyKitePlugin, connection string) *Batcher {
+	return currentBatcher(plugin, connection)
+}
+
+// HasBatcher reports if batcher of the plugin connection is kept.
+func HasBatcher(plugin *plugins.IndyKitePlugin, connection string) bool {
+	batchersMtx.Lock()
+	defer batchersMtx.Unlock()
+	_, ok := batchers[batcherKey{plugin: plugin, connection: connection}]
+	return ok
+}
+
+// CallWithRetry exposes callWithRetry with policy created from cfg for tests.
+func CallWithRetry(ctx context.Context, cfg *plugins.RetryConfig, call func(ctx context.Context) (int, error),
+) (int, error) {
+	return callWithRetry(ctx, "test", newRetryPolicy(cfg), call)
+}
+
+// CallWithBreaker exposes callWithBreaker for tests.
+func CallWithBreaker(
+	ctx context.Context,
+	breaker *plugins.CircuitBreaker,
+	builtin string,
+	call func() (int, error),
+) (int, error) {
+	return callWithBreaker(ctx, breaker, builtin, call)
+}
+
+// CircuitOpenIsAuthorized returns result of indy.is_authorized for err, which must be returned
+// by CallWithBreaker while the breaker is open.
+func CircuitOpenIsAuthorized(err error, req *authorizationpb.IsAuthorizedRequest) ast.Object {
+	openErr, _ := asCircuitOpen(err)
+	return circuitOpenIsAuthorized(openErr, req)
+}
+
+// CircuitOpenWhatAuthorized returns result of indy.what_authorized for err, which must be returned
+// by CallWithBreaker while the breaker is open.
+func CircuitOpenWhatAuthorized(err error, req *authorizationpb.WhatAuthorizedRequest) ast.Object {
+	openErr, _ := asCircuitOpen(err)
+	return circuitOpenWhatAuthorized(openErr, req)
+}
+
+// MergeIsAuthorizedResponses exposes mergeIsAuthorizedResponses for tests.
+var MergeIsAuthorizedResponses = mergeIsAuthorizedResponses
+
+// MergeWhoAuthorizedResponses exposes mergeWhoAuthorizedResponses for tests.
+var MergeWhoAuthorizedResponses = mergeWhoAuthorizedResponses
+
+// Explain exposes explain with explicit debug flag, which otherwise comes from plugin config.
+var Explain = explain
+
+// ParseIsResources exposes parseIsResources for tests.
+var ParseIsResources = parseIsResources
+
+// ParseWhoResources exposes parseWhoResources for tests.
+var ParseWhoResources = parseWhoResources
+
+// ParseResourceTypes exposes parseResourceTypes for tests.
+var ParseResourceTypes = parseResourceTypes
+
+// ExtractSubject exposes extractSubject for tests.
+var ExtractSubject = extractSubject
+
+// ParsePolicyTags exposes parsePolicyTags for tests.
+var ParsePolicyTags = parsePolicyTags
+
+// SetCacheClock overrides time source of all decision caches and returns function restoring the previous one.
+func SetCacheClock(now func() time.Time) func() {
+	return clock.Set(now)
+}
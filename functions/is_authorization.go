@@ -15,117 +15,272 @@
 package functions
 
 import (
-	"bytes"
+	"context"
 
 	"github.com/indykite/indykite-sdk-go/errors"
 	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/rego"
-	"github.com/open-policy-agent/opa/topdown/builtins"
 	"github.com/open-policy-agent/opa/types"
-	"google.golang.org/protobuf/encoding/protojson"
 
+	"github.com/indykite/opa-indykite-plugin/plugins"
 	"github.com/indykite/opa-indykite-plugin/utilities"
 )
 
+var (
+	isAuthorizedArgs = []types.Type{
+		types.Named("subject", types.NewAny(
+			types.NewObject([]*types.StaticProperty{
+				types.NewStaticProperty("id", types.S),
+			}, nil),
+			types.NewObject([]*types.StaticProperty{
+				types.NewStaticProperty("id", types.S),
+				types.NewStaticProperty("subjectType", types.S),
+			}, nil),
+			types.NewObject([]*types.StaticProperty{
+				types.NewStaticProperty("id", types.S),
+				types.NewStaticProperty("subjectType", types.S),
+				types.NewStaticProperty("property", types.S),
+			}, nil),
+			types.NewObject([]*types.StaticProperty{
+				types.NewStaticProperty("id", types.S),
+				types.NewStaticProperty("subjectType", types.S),
+				types.NewStaticProperty("type", types.S),
+			}, nil),
+		)),
+		types.Named("resources", types.NewArray(nil, types.NewObject([]*types.StaticProperty{
+			types.NewStaticProperty("externalId", types.S),
+			types.NewStaticProperty("type", types.S),
+			types.NewStaticProperty("actions", types.NewArray(nil, types.S)),
+		}, nil))),
+		types.Named(inputParamsKey, types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
+		types.Named(policyTagsKey, types.NewArray(nil, types.S)),
+	}
+	isAuthorizedResult = types.Named("authorizationResponse", types.NewObject([]*types.StaticProperty{
+		types.NewStaticProperty("decisionTime", types.N),
+		types.NewStaticProperty("stale", types.B),
+		types.NewStaticProperty("decisions", types.NewObject(nil, types.NewDynamicProperty(
+			types.S,
+			types.NewObject(nil, types.NewDynamicProperty(
+				types.S,
+				types.NewObject(nil, types.NewDynamicProperty(
+					types.S,
+					types.NewObject(nil, types.NewDynamicProperty(
+						types.S,
+						types.NewObject([]*types.StaticProperty{
+							types.NewStaticProperty("allow", types.B),
+						}, nil),
+					)),
+				)),
+			)),
+		))),
+	}, nil))
+)
+
 func init() {
 	rego.RegisterBuiltin4(
 		&rego.Function{
 			Name: "indy.is_authorized",
-			Decl: types.NewFunction(
-				types.Args(
-					types.Named("subject", types.NewAny(
-						types.NewObject([]*types.StaticProperty{
-							types.NewStaticProperty("id", types.S),
-						}, nil),
-						types.NewObject([]*types.StaticProperty{
-							types.NewStaticProperty("id", types.S),
-							types.NewStaticProperty("subjectType", types.S),
-						}, nil),
-						types.NewObject([]*types.StaticProperty{
-							types.NewStaticProperty("id", types.S),
-							types.NewStaticProperty("subjectType", types.S),
-							types.NewStaticProperty("property", types.S),
-						}, nil),
-						types.NewObject([]*types.StaticProperty{
-							types.NewStaticProperty("id", types.S),
-							types.NewStaticProperty("subjectType", types.S),
-							types.NewStaticProperty("type", types.S),
-						}, nil),
-					)),
-					types.Named("resources", types.NewArray(nil, types.NewObject([]*types.StaticProperty{
-						types.NewStaticProperty("externalId", types.S),
-						types.NewStaticProperty("type", types.S),
-						types.NewStaticProperty("actions", types.NewArray(nil, types.S)),
-					}, nil))),
-					types.Named(inputParamsKey, types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
-					types.Named(policyTagsKey, types.NewArray(nil, types.S)),
-				),
-				types.Named("authorizationResponse", types.NewObject([]*types.StaticProperty{
-					types.NewStaticProperty("decisionTime", types.N),
-					types.NewStaticProperty("decisions", types.NewObject(nil, types.NewDynamicProperty(
-						types.S,
-						types.NewObject(nil, types.NewDynamicProperty(
-							types.S,
-							types.NewObject(nil, types.NewDynamicProperty(
-								types.S,
-								types.NewObject(nil, types.NewDynamicProperty(
-									types.S,
-									types.NewObject([]*types.StaticProperty{
-										types.NewStaticProperty("allow", types.B),
-									}, nil),
-								)),
-							)),
-						)),
-					))),
-				}, nil)),
-			),
+			Decl: types.NewFunction(types.Args(isAuthorizedArgs...), isAuthorizedResult),
 		},
 		func(bCtx rego.BuiltinContext, subject, resources, inputParams, policyTags *ast.Term) (*ast.Term, error) {
-			var (
-				err error
-				req = &authorizationpb.IsAuthorizedRequest{}
-			)
-
-			req.Subject, err = extractSubject(subject.Value, 1)
-			if err != nil {
-				return nil, err
-			}
+			return isAuthorizedBuiltin(bCtx, "indy.is_authorized", subject, resources, inputParams, policyTags, nil)
+		},
+	)
 
-			req.Resources, err = parseIsResources(resources, 1)
-			if err != nil {
-				return nil, err
-			}
+	rego.RegisterBuiltinDyn(
+		&rego.Function{
+			Name: "indy.is_authorized_with_connection",
+			Decl: types.NewFunction(withConnectionArg(isAuthorizedArgs), isAuthorizedResult),
+		},
+		func(bCtx rego.BuiltinContext, terms []*ast.Term) (*ast.Term, error) {
+			return isAuthorizedBuiltin(bCtx, "indy.is_authorized_with_connection",
+				terms[0], terms[1], terms[2], terms[3], terms[4])
+		},
+	)
+}
 
-			req.InputParams, err = utilities.ParseInputParams(inputParams, 3)
-			if err != nil {
-				return nil, err
-			}
+// isAuthorizedBuiltin implements indy.is_authorized and its variant with connection name,
+// which is nil when the default connection is used.
+func isAuthorizedBuiltin(
+	bCtx rego.BuiltinContext,
+	builtin string,
+	subject, resources, inputParams, policyTags, connection *ast.Term,
+) (*ast.Term, error) {
+	req := &authorizationpb.IsAuthorizedRequest{}
+	plugin, err := resolvePlugin(bCtx)
+	if err != nil {
+		return nil, err
+	}
 
-			req.PolicyTags = parsePolicyTags(policyTags)
+	req.Subject, err = extractSubject(subject.Value, 1)
+	if err != nil {
+		return nil, err
+	}
 
-			client, err := AuthorizationClient(bCtx.Context)
-			if err != nil {
-				return nil, err
-			}
+	req.Resources, err = parseIsResources(resources, 2)
+	if err != nil {
+		return nil, err
+	}
 
-			var (
-				resp *authorizationpb.IsAuthorizedResponse
-				obj  ast.Object
-			)
-			resp, err = client.IsAuthorizedWithRawRequest(bCtx.Context, req)
-			if statusErr := errors.FromError(err); statusErr != nil {
-				if errors.IsServiceError(statusErr) {
-					return nil, statusErr
-				}
-				obj = ast.NewObject(ast.Item(ast.StringTerm("error"), utilities.BuildUserError(statusErr)))
-			} else {
-				obj = buildIsAuthorizedObjectFromResponse(resp)
-			}
+	req.InputParams, err = parseInputParams(plugin, inputParams, 3)
+	if err != nil {
+		return nil, err
+	}
 
-			return &ast.Term{Value: obj}, nil
-		},
+	req.PolicyTags, err = parsePolicyTags(policyTags, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn string
+	if err = validateSubject(bCtx.Context, plugin, req.GetSubject()); err == nil {
+		conn, err = resolveConnection(bCtx.Context, plugin, connection, req.GetSubject(), 5)
+	}
+	if obj, ok := rejectedObject(err); ok {
+		return &ast.Term{Value: obj}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	obj, err := evalIsAuthorized(bCtx, plugin, conn, builtin, req)
+	if err != nil {
+		return nil, err
+	}
+	return &ast.Term{Value: obj}, nil
+}
+
+// evalIsAuthorized calls IndyKite with req on behalf of builtin and returns result object of indy.is_authorized.
+// IndyKite user errors are returned in the error field of the object, service errors are returned as error.
+// Plugin is resolved by the builtin and may be nil, connection is resolved by resolveConnection.
+func evalIsAuthorized(
+	bCtx rego.BuiltinContext,
+	plugin *plugins.IndyKitePlugin,
+	connection string,
+	builtin string,
+	req *authorizationpb.IsAuthorizedRequest,
+) (ast.Object, error) {
+	var (
+		resp *authorizationpb.IsAuthorizedResponse
+		obj  ast.Object
+	)
+	attrs := append(resourceAttributes(req.GetResources()),
+		attrSubjectType.String(subjectType(req.GetSubject())))
+	call := startBuiltinCall(bCtx.Context, plugin, builtin, len(req.GetResources()), attrs...)
+	resp, err := isAuthorized(call.ctx, plugin, connection, builtin, req, call)
+	call.finish(resp.GetDecisionTime(), err)
+	explainCall(bCtx, plugin, builtin, req, resp, err)
+	if noClientErr, ok := asNoClient(err); ok {
+		return nil, noClientErr
+	} else if openErr, ok := asCircuitOpen(err); ok {
+		obj = circuitOpenIsAuthorized(openErr, req)
+	} else if statusErr := errors.FromError(err); statusErr != nil {
+		if errors.IsServiceError(statusErr) {
+			return nil, statusErr
+		}
+		obj = ast.NewObject(ast.Item(ast.StringTerm("error"), utilities.BuildUserError(statusErr)))
+	} else {
+		obj = buildIsAuthorizedObjectFromResponse(resp)
+		if call.record.Stale {
+			obj.Insert(ast.StringTerm("stale"), ast.BooleanTerm(true))
+		}
+	}
+
+	return obj, nil
+}
+
+// isAuthorized returns decision from plugin decision cache, if enabled, or calls IndyKite otherwise.
+// Resources above the service limit are sent in multiple requests and decisions are merged.
+// Transient errors are retried according to plugin configuration.
+// When batching is enabled, the call is merged with concurrent calls for the same subject,
+// unless ctx carries client set by WithAuthorizationClient.
+// While the circuit breaker is open, IndyKite is not called and circuitOpenError with outcome of builtin is returned.
+// When IndyKite is unavailable, including when the connection is not established, and stale-if-error
+// is enabled, the last known decision is returned and marked as stale. Cache usage is recorded in call. Decisions of different connections are cached apart,
+// decisions of client set by WithAuthorizationClient or OverrideAuthorizationClient are not cached,
+// as the cache cannot tell such clients apart.
+func isAuthorized(
+	ctx context.Context,
+	plugin *plugins.IndyKitePlugin,
+	connection string,
+	builtin string,
+	req *authorizationpb.IsAuthorizedRequest,
+	call *builtinCall,
+) (*authorizationpb.IsAuthorizedResponse, error) {
+	var (
+		cache    *plugins.DecisionCache
+		cacheKey string
 	)
+	if plugin != nil && clientFromContext(ctx) == nil {
+		cache = plugin.DecisionCache()
+	}
+	if cache != nil {
+		var err error
+		if cacheKey, err = plugins.DecisionCacheKey(req); err != nil {
+			return nil, err
+		}
+		cacheKey = connection + "/" + cacheKey
+		if resp, ok := cache.Get(cacheKey); ok {
+			call.record.Cache = plugins.CacheHit
+			return resp, nil
+		}
+		call.record.Cache = plugins.CacheMiss
+	}
+	staleOnUnavailable := func(err error) (*authorizationpb.IsAuthorizedResponse, error) {
+		if cache != nil && isUnavailable(err) {
+			if resp, ok := cache.GetStale(cacheKey); ok {
+				call.record.Stale = true
+				return resp, nil
+			}
+		}
+		return nil, err
+	}
+
+	client, release, err := acquireAuthorizationClient(ctx, plugin, connection)
+	if err != nil {
+		return staleOnUnavailable(&noClientError{err: err})
+	}
+	defer release()
+
+	var b *batcher
+	if clientFromContext(ctx) == nil {
+		b = currentBatcher(plugin, connection)
+	}
+	policy := currentRetryPolicy(plugin)
+	send := func(
+		ctx context.Context,
+		resources []*authorizationpb.IsAuthorizedRequest_Resource,
+	) (*authorizationpb.IsAuthorizedResponse, error) {
+		chunkReq := req
+		if len(resources) != len(req.GetResources()) {
+			chunkReq = &authorizationpb.IsAuthorizedRequest{
+				Subject:     req.GetSubject(),
+				Resources:   resources,
+				InputParams: req.GetInputParams(),
+				PolicyTags:  req.GetPolicyTags(),
+			}
+		}
+		return callWithRetry(ctx, builtin, policy, func(
+			ctx context.Context,
+		) (*authorizationpb.IsAuthorizedResponse, error) {
+			if b != nil {
+				return b.isAuthorized(ctx, chunkReq)
+			}
+			return client.IsAuthorizedWithRawRequest(ctx, chunkReq)
+		})
+	}
+	responses, err := callWithBreaker(ctx, currentCircuitBreaker(plugin, connection), builtin,
+		func() ([]*authorizationpb.IsAuthorizedResponse, error) {
+			return callChunked(ctx, req.GetResources(), send)
+		})
+	if err != nil {
+		return staleOnUnavailable(err)
+	}
+	resp := mergeIsAuthorizedResponses(responses)
+	if cache != nil {
+		cache.Set(cacheKey, resp)
+	}
+	return resp, nil
 }
 
 func buildIsAuthorizedObjectFromResponse(resp *authorizationpb.IsAuthorizedResponse) ast.Object {
@@ -155,20 +310,11 @@ func buildIsAuthorizedObjectFromResponse(resp *authorizationpb.IsAuthorizedRespo
 }
 
 func parseIsResources(term *ast.Term, pos int) ([]*authorizationpb.IsAuthorizedRequest_Resource, error) {
-	resources, err := builtins.ArrayOperand(term.Value, pos)
-	if err != nil {
-		return nil, err
-	}
-	resp := make([]*authorizationpb.IsAuthorizedRequest_Resource, resources.Len())
-	for i := 0; i < resources.Len(); i++ {
-		e := resources.Elem(i)
-		if v, ok := e.Value.(ast.Object); ok {
-			var res = &authorizationpb.IsAuthorizedRequest_Resource{}
-			if err = protojson.Unmarshal(bytes.NewBufferString(v.String()).Bytes(), res); err != nil {
-				return nil, err
-			}
-			resp[i] = res
+	return parseResources(term, pos, func(f resourceFields) *authorizationpb.IsAuthorizedRequest_Resource {
+		return &authorizationpb.IsAuthorizedRequest_Resource{
+			ExternalId: f.externalID,
+			Type:       f.resourceType,
+			Actions:    f.actions,
 		}
-	}
-	return resp, nil
+	})
 }
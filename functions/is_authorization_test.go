@@ -16,6 +16,8 @@ package functions_test
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/indykite/indykite-sdk-go/authorization"
@@ -24,14 +26,17 @@ import (
 	objectsV2 "github.com/indykite/indykite-sdk-go/gen/indykite/objects/v1beta2"
 	"github.com/indykite/indykite-sdk-go/test"
 	authorizationm "github.com/indykite/indykite-sdk-go/test/authorization/v1beta1"
+	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/rego"
 	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/indykite/opa-indykite-plugin/functions"
+	"github.com/indykite/opa-indykite-plugin/plugins"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -42,17 +47,14 @@ var _ = Describe("indy.is_authorized", func() {
 	var (
 		mockCtrl                *gomock.Controller
 		mockAuthorizationClient *authorizationm.MockAuthorizationAPIClient
-		oldConnection           *authorization.Client
+		ctx                     context.Context
 	)
 
 	BeforeEach(func() {
 		mockCtrl = gomock.NewController(GinkgoT())
 		mockAuthorizationClient = authorizationm.NewMockAuthorizationAPIClient(mockCtrl)
 		client, _ := authorization.NewClientFromGRPCClient(mockAuthorizationClient)
-		oldConnection = functions.OverrideAuthorizationClient(client)
-	})
-	AfterEach(func() {
-		functions.OverrideAuthorizationClient(oldConnection)
+		ctx = functions.WithAuthorizationClient(context.Background(), client)
 	})
 
 	type dtIDCase struct {
@@ -104,7 +106,6 @@ var _ = Describe("indy.is_authorized", func() {
 			r := rego.New(rego.Query(
 				`x = indy.is_authorized(` + c.regoParam1 + `,[{"externalId": "res1", "type": "Type", "actions": ["READ"]},{"externalId": "res2", "type": "Type", "actions": ["READ"]}], {"string": {"string_value":"42"}, "integer": {"integer_value":42}, "double": {"double_value":4.2}, "boolean": {"bool_value":true}}, ["42"])`)) //nolint:lll
 
-			ctx := context.Background()
 			query, err := r.PrepareForEval(ctx)
 			Expect(err).To(Succeed())
 
@@ -203,7 +204,6 @@ var _ = Describe("indy.is_authorized", func() {
 	DescribeTable("Invalid input arguments - gRPC error",
 		func(regoParams string, errorMessage string, originMessage string) {
 			q := `x = indy.is_authorized(` + regoParams + `)`
-			ctx := context.Background()
 
 			r := rego.New(rego.Query(q))
 
@@ -243,7 +243,6 @@ var _ = Describe("indy.is_authorized", func() {
 	)
 
 	It("Service backend error", func() {
-		ctx := context.Background()
 		mockAuthorizationClient.EXPECT().
 			IsAuthorized(gomock.Any(), gomock.Any()).
 			Times(2).
@@ -273,11 +272,223 @@ var _ = Describe("indy.is_authorized", func() {
 		Expect(err).To(Succeed())
 	})
 
+	It("Splits resources above service limit into multiple requests", func() {
+		var resources []string
+		for i := 0; i < 40; i++ {
+			resources = append(resources,
+				fmt.Sprintf(`{"externalId": "res%d", "type": "Type", "actions": ["READ"]}`, i))
+		}
+
+		respond := func(
+			_ context.Context,
+			req *authorizationpb.IsAuthorizedRequest,
+			_ ...grpc.CallOption,
+		) (*authorizationpb.IsAuthorizedResponse, error) {
+			decisionTime := time.Date(2022, 02, 22, 15, 18, 22, 0, time.UTC)
+			if len(req.GetResources()) == 32 {
+				decisionTime = decisionTime.Add(time.Second)
+			}
+			resp := &authorizationpb.IsAuthorizedResponse{
+				DecisionTime: timestamppb.New(decisionTime),
+				Decisions: map[string]*authorizationpb.IsAuthorizedResponse_ResourceType{
+					"Type": {Resources: map[string]*authorizationpb.IsAuthorizedResponse_Resource{}},
+				},
+			}
+			for _, r := range req.GetResources() {
+				resp.Decisions["Type"].Resources[r.GetExternalId()] = &authorizationpb.IsAuthorizedResponse_Resource{
+					Actions: map[string]*authorizationpb.IsAuthorizedResponse_Action{"READ": {Allow: true}},
+				}
+			}
+			return resp, nil
+		}
+		mockAuthorizationClient.EXPECT().IsAuthorized(gomock.Any(), WrapMatcher(
+			HaveField("Resources", HaveLen(32)),
+		)).DoAndReturn(respond)
+		mockAuthorizationClient.EXPECT().IsAuthorized(gomock.Any(), WrapMatcher(
+			HaveField("Resources", HaveLen(8)),
+		)).DoAndReturn(respond)
+
+		r := rego.New(rego.Query(`x = indy.is_authorized({"id": "` + testAccessToken + `"}, [` +
+			strings.Join(resources, ",") + `], {}, [])`))
+
+		query, err := r.PrepareForEval(ctx)
+		Expect(err).To(Succeed())
+
+		rs, err := query.Eval(ctx)
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings["x"]).To(MatchAllKeys(Keys{
+			"error":        BeNil(),
+			"decisionTime": BeEquivalentTo("1645543102"), // Earliest of both responses
+			"decisions": MatchAllKeys(Keys{
+				"Type": HaveLen(40),
+			}),
+		}))
+	})
+
+	It("Returns stale decision when IndyKite is unavailable or circuit breaker is open", func() {
+		now := time.Now()
+		DeferCleanup(functions.SetCacheClock(func() time.Time { return now }))
+		client, _ := authorization.NewClientFromGRPCClient(mockAuthorizationClient)
+		plugin := plugins.NewEmbedded(client, &plugins.Config{
+			DecisionCache: &plugins.DecisionCacheConfig{
+				MaxEntries: 10, MaxTTLSeconds: 1, StaleIfErrorSeconds: 300,
+			},
+			CircuitBreaker: &plugins.CircuitBreakerConfig{FailureThreshold: 1},
+		}, nil, ast.NewTerm(ast.NewObject()))
+		DeferCleanup(plugin.Unregister)
+
+		gomock.InOrder(
+			mockAuthorizationClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(&authorizationpb.IsAuthorizedResponse{
+					DecisionTime: timestamppb.New(time.Date(2022, 02, 22, 15, 18, 22, 0, time.UTC)),
+					Decisions: map[string]*authorizationpb.IsAuthorizedResponse_ResourceType{
+						"Type": {Resources: map[string]*authorizationpb.IsAuthorizedResponse_Resource{
+							"res1": {Actions: map[string]*authorizationpb.IsAuthorizedResponse_Action{
+								"READ": {Allow: true},
+							}},
+						}},
+					},
+				}, nil),
+			mockAuthorizationClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(nil, status.Error(codes.Unavailable, "unavailable")),
+		)
+
+		query, err := rego.New(
+			rego.Runtime(plugin.Runtime()),
+			rego.StrictBuiltinErrors(true),
+			rego.Query(`x = indy.is_authorized({"id": "`+testAccessToken+`"}, [
+				{"externalId": "res1", "type": "Type", "actions": ["READ"]}
+			], {}, [])`),
+		).PrepareForEval(context.Background())
+		Expect(err).To(Succeed())
+		allowed := HaveKeyWithValue("decisions", HaveKeyWithValue("Type",
+			HaveKeyWithValue("res1", HaveKeyWithValue("READ", HaveKeyWithValue("allow", true)))))
+
+		rs, err := query.Eval(context.Background())
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings["x"]).To(And(allowed, Not(HaveKey("stale"))))
+
+		// Let the cached decision expire.
+		now = now.Add(time.Second)
+		rs, err = query.Eval(context.Background())
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings["x"]).To(And(allowed, HaveKeyWithValue("stale", true)))
+		Expect(plugin.CircuitBreaker().State()).To(Equal(plugins.BreakerOpen))
+
+		// IndyKite is not called while the breaker is open.
+		rs, err = query.Eval(context.Background())
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings["x"]).To(And(allowed, HaveKeyWithValue("stale", true)))
+	})
+
+	It("Returns stale decision when connection is not established", func() {
+		now := time.Now()
+		DeferCleanup(functions.SetCacheClock(func() time.Time { return now }))
+		// Embedded plugin without client has the default connection, which is not connected.
+		plugin := plugins.NewEmbedded(nil, &plugins.Config{
+			DecisionCache: &plugins.DecisionCacheConfig{
+				MaxEntries: 10, MaxTTLSeconds: 1, StaleIfErrorSeconds: 300,
+			},
+		}, nil, ast.NewTerm(ast.NewObject()))
+		DeferCleanup(plugin.Unregister)
+
+		subject, err := functions.ExtractSubject(ast.MustParseTerm(`{"id": "`+testAccessToken+`"}`).Value, 1)
+		Expect(err).To(Succeed())
+		key, err := plugins.DecisionCacheKey(&authorizationpb.IsAuthorizedRequest{
+			Subject: subject,
+			Resources: []*authorizationpb.IsAuthorizedRequest_Resource{
+				{ExternalId: "res1", Type: "Type", Actions: []string{"READ"}},
+			},
+		})
+		Expect(err).To(Succeed())
+
+		query, err := rego.New(
+			rego.Runtime(plugin.Runtime()),
+			rego.StrictBuiltinErrors(true),
+			rego.Query(`x = indy.is_authorized({"id": "`+testAccessToken+`"}, [
+				{"externalId": "res1", "type": "Type", "actions": ["READ"]}
+			], {}, [])`),
+		).PrepareForEval(context.Background())
+		Expect(err).To(Succeed())
+
+		_, err = query.Eval(context.Background())
+		Expect(err).To(MatchError(ContainSubstring(`IndyKite connection "default" is not connected`)))
+
+		plugin.DecisionCache().Set(plugins.DefaultConnectionName+"/"+key, &authorizationpb.IsAuthorizedResponse{
+			DecisionTime: timestamppb.New(time.Date(2022, 02, 22, 15, 18, 22, 0, time.UTC)),
+			Decisions: map[string]*authorizationpb.IsAuthorizedResponse_ResourceType{
+				"Type": {Resources: map[string]*authorizationpb.IsAuthorizedResponse_Resource{
+					"res1": {Actions: map[string]*authorizationpb.IsAuthorizedResponse_Action{
+						"READ": {Allow: true},
+					}},
+				}},
+			},
+		})
+		now = now.Add(time.Minute)
+
+		rs, err := query.Eval(context.Background())
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings["x"]).To(And(
+			HaveKeyWithValue("decisions", HaveKeyWithValue("Type",
+				HaveKeyWithValue("res1", HaveKeyWithValue("READ", HaveKeyWithValue("allow", true))))),
+			HaveKeyWithValue("stale", true),
+		))
+	})
+
+	It("Does not share cached decisions between clients set by WithAuthorizationClient", func() {
+		plugin := plugins.NewEmbedded(nil, &plugins.Config{
+			DecisionCache: &plugins.DecisionCacheConfig{
+				MaxEntries: 10, MaxTTLSeconds: 60, StaleIfErrorSeconds: 300,
+			},
+		}, nil, ast.NewTerm(ast.NewObject()))
+		DeferCleanup(plugin.Unregister)
+
+		respond := func(allow bool) *authorizationpb.IsAuthorizedResponse {
+			return &authorizationpb.IsAuthorizedResponse{
+				DecisionTime: timestamppb.New(time.Date(2022, 02, 22, 15, 18, 22, 0, time.UTC)),
+				Decisions: map[string]*authorizationpb.IsAuthorizedResponse_ResourceType{
+					"Type": {Resources: map[string]*authorizationpb.IsAuthorizedResponse_Resource{
+						"res1": {Actions: map[string]*authorizationpb.IsAuthorizedResponse_Action{
+							"READ": {Allow: allow},
+						}},
+					}},
+				},
+			}
+		}
+		mockAuthorizationClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(respond(true), nil)
+		mockClientB := authorizationm.NewMockAuthorizationAPIClient(mockCtrl)
+		mockClientB.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(respond(false), nil)
+		clientB, _ := authorization.NewClientFromGRPCClient(mockClientB)
+
+		query, err := rego.New(
+			rego.Runtime(plugin.Runtime()),
+			rego.StrictBuiltinErrors(true),
+			rego.Query(`x = indy.is_authorized({"id": "`+testAccessToken+`"}, [
+				{"externalId": "res1", "type": "Type", "actions": ["READ"]}
+			], {}, [])`),
+		).PrepareForEval(context.Background())
+		Expect(err).To(Succeed())
+		allowed := func(allow bool) OmegaMatcher {
+			return HaveKeyWithValue("decisions", HaveKeyWithValue("Type",
+				HaveKeyWithValue("res1", HaveKeyWithValue("READ", HaveKeyWithValue("allow", allow)))))
+		}
+
+		rs, err := query.Eval(ctx)
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings["x"]).To(allowed(true))
+
+		rs, err = query.Eval(functions.WithAuthorizationClient(context.Background(), clientB))
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings["x"]).To(allowed(false))
+		Expect(plugin.DecisionCache().Len()).To(BeZero())
+	})
+
 	It("Fail to create client", func() {
+		// Without plugin and client in context, client is created from environment variables.
 		ctx := context.Background()
 
-		functions.OverrideAuthorizationClient(nil)
-
 		// With StrictBuiltinErrors
 		r := rego.New(
 			rego.Query(`x = indy.is_authorized({"id": "`+testAccessToken+`"}, [{"externalId": "res1", "type": "Type", "actions": ["READ"]}], {},[])`), //nolint:lll
@@ -337,7 +548,6 @@ var _ = Describe("indy.is_authorized", func() {
 			q := `x = indy.is_authorized({"id": "` + testAccessToken + `"},[{"externalId": "res1", "type": "Type", "actions": ["READ"]}],` + regoOptions + `)` //nolint:lll
 			r := rego.New(rego.Query(q))
 
-			ctx := context.Background()
 			query, err := r.PrepareForEval(ctx)
 			Expect(err).To(Succeed())
 
@@ -0,0 +1,152 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+
+	"github.com/indykite/opa-indykite-plugin/functions"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Operands", func() {
+	DescribeTable("Rejects malformed subject",
+		func(subject, errMsg string) {
+			res, err := functions.ExtractSubject(ast.MustParseTerm(subject).Value, 1)
+			Expect(res).To(BeNil())
+			Expect(err).To(MatchError(errMsg))
+		},
+		Entry("Not an object", `"token"`, "operand 1 must be object but got string"),
+		Entry("Missing id", `{"subjectType": "id"}`, "operand 1 missing id"),
+		Entry("Id is not string", `{"id": 1}`, "operand 1 id must be string but got number"),
+		Entry("SubjectType is not string", `{"id": "a", "subjectType": true}`,
+			"operand 1 subjectType must be string but got boolean"),
+		Entry("Unknown subjectType", `{"id": "a", "subjectType": "email"}`,
+			"operand 1 subjectType must be one of token, id, property or external_id but got email"),
+		Entry("Missing property", `{"id": "a", "subjectType": "property"}`, "operand 1 missing property"),
+		Entry("Property is not string", `{"id": "a", "subjectType": "property", "property": ["email"]}`,
+			"operand 1 property must be string but got array"),
+		Entry("Type is not string", `{"id": "a", "subjectType": "external_id", "type": null}`,
+			"operand 1 type must be string but got null"),
+	)
+
+	DescribeTable("Rejects malformed policyTags",
+		func(policyTags, errMsg string) {
+			res, err := functions.ParsePolicyTags(ast.MustParseTerm(policyTags), 4)
+			Expect(res).To(BeNil())
+			Expect(err).To(MatchError(errMsg))
+		},
+		Entry("Not an array", `"tag"`, "operand 4 must be array but got string"),
+		Entry("Not a string", `["tag", 1]`, "operand 4 element 1 must be string but got number"),
+	)
+
+	It("Returns error instead of panic for dynamic input", func() {
+		ctx := context.Background()
+		query, err := rego.New(
+			rego.Query(`x = indy.is_authorized(input.subject, [], {}, input.tags)`),
+			rego.StrictBuiltinErrors(true),
+		).PrepareForEval(ctx)
+		Expect(err).To(Succeed())
+
+		_, err = query.Eval(ctx, rego.EvalInput(map[string]interface{}{
+			"subject": map[string]interface{}{"id": 42},
+			"tags":    []interface{}{},
+		}))
+		Expect(err).To(MatchError(ContainSubstring("indy.is_authorized: operand 1 id must be string but got number")))
+	})
+})
+
+func fuzzTerm(t *testing.T, data string) *ast.Term {
+	term, err := ast.ParseTerm(data)
+	if err != nil || !term.IsGround() {
+		t.Skip()
+	}
+	return term
+}
+
+func FuzzExtractSubject(f *testing.F) {
+	for _, seed := range []string{
+		`{"id": "token"}`,
+		`{"id": "dt", "subjectType": "id"}`,
+		`{"id": "a@b.c", "subjectType": "property", "property": "email"}`,
+		`{"id": "ext", "subjectType": "external_id", "type": "Person"}`,
+		`{"id": 1, "subjectType": ["id"]}`,
+		`[{"id": "token"}]`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		res, err := functions.ExtractSubject(fuzzTerm(t, data).Value, 1)
+		if (err == nil) == (res == nil) {
+			t.Fatalf("expected either subject or error, got %v and %v", res, err)
+		}
+	})
+}
+
+func FuzzParseResources(f *testing.F) {
+	for _, seed := range []string{
+		`[{"externalId": "res1", "type": "Type", "actions": ["READ"]}]`,
+		`[{"external_id": "res1", "type": null, "actions": [1]}]`,
+		`[{"id": "res1"}, "res2", 3]`,
+		`{"externalId": "res1"}`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		term := fuzzTerm(t, data)
+		if _, err := functions.ParseIsResources(term, 2); err != nil {
+			return
+		}
+		if _, err := functions.ParseWhoResources(term, 1); err != nil {
+			t.Fatalf("resources accepted by indy.is_authorized must be accepted by indy.who_authorized: %v", err)
+		}
+	})
+}
+
+func FuzzParseResourceTypes(f *testing.F) {
+	for _, seed := range []string{
+		`[{"type": "Type", "actions": ["READ"]}]`,
+		`[{"type": null, "actions": null}]`,
+		`[{"externalId": "res1", "type": "Type"}]`,
+		`[{"type": 1}, "Type"]`,
+		`{"type": "Type"}`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		res, err := functions.ParseResourceTypes(fuzzTerm(t, data), 2)
+		if (err == nil) == (res == nil) {
+			t.Fatalf("expected either resource types or error, got %v and %v", res, err)
+		}
+	})
+}
+
+func FuzzParsePolicyTags(f *testing.F) {
+	for _, seed := range []string{`["a", "b"]`, `[]`, `["a", 1]`, `"a"`, `{"a"}`} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		tags, err := functions.ParsePolicyTags(fuzzTerm(t, data), 4)
+		if err == nil && tags == nil {
+			t.Fatal("expected tags or error")
+		}
+	})
+}
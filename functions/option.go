@@ -19,6 +19,9 @@ import (
 	objects "github.com/indykite/indykite-sdk-go/gen/indykite/objects/v1beta1"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/topdown/builtins"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+	"github.com/indykite/opa-indykite-plugin/utilities"
 )
 
 const inputParamsKey = "inputParams"
@@ -31,6 +34,7 @@ const subjectTypeExternalID = "external_id"
 var allowedKeyNames = [...]string{
 	inputParamsKey,
 	policyTagsKey,
+	connectionKey,
 }
 
 var allowedKeys = ast.NewSet()
@@ -45,83 +49,90 @@ func createAllowedKeys() {
 	}
 }
 
-func parsePolicyTags(options *ast.Term) []string {
-	if options == nil {
-		return nil
-	}
-
-	policyTagsArray, ok := options.Value.(*ast.Array)
-	if !ok {
-		return nil
+// parseInputParams parses inputParams operand with plain Rego values, when native mode is enabled
+// in plugin config, or with values wrapped by type otherwise.
+func parseInputParams(
+	plugin *plugins.IndyKitePlugin,
+	inputParams *ast.Term,
+	pos int,
+) (map[string]*authorizationpb.InputParam, error) {
+	if plugin != nil {
+		if cfg := plugin.Config().InputParams; cfg != nil && cfg.Native {
+			return utilities.ParseNativeInputParams(inputParams, pos, cfg.ParseTime)
+		}
 	}
+	return utilities.ParseInputParams(inputParams, pos)
+}
 
-	result := make([]string, 0, policyTagsArray.Len())
-	policyTagsArray.Foreach(func(value *ast.Term) {
-		result = append(result, string(value.Value.(ast.String)))
-	})
-
-	return result
+// parsePolicyTags converts policyTags operand at pos, which must be array of strings.
+func parsePolicyTags(policyTags *ast.Term, pos int) ([]string, error) {
+	return utilities.StringArrayOperand(policyTags, pos)
 }
 
+// extractSubject converts subject operand at pos. Subject type defaults to token.
 func extractSubject(subjectValue ast.Value, pos int) (*authorizationpb.Subject, error) {
 	subject, ok := subjectValue.(ast.Object)
 	if !ok {
 		return nil, builtins.NewOperandTypeErr(pos, subjectValue, "object")
 	}
-	idObject := subject.Get(ast.StringTerm("id"))
-	if idObject == nil {
-		return nil, builtins.NewOperandTypeErr(pos, subjectValue, "id")
+	id, err := utilities.RequiredStringField(subject, "id", pos)
+	if err != nil {
+		return nil, err
+	}
+	subjectType, err := getSubjectType(subject, pos)
+	if err != nil {
+		return nil, err
 	}
-	idValue := idObject.Value.(ast.String)
 
-	switch getSubjectType(subject) {
+	switch subjectType {
 	case subjectTypeToken:
 		return &authorizationpb.Subject{Subject: &authorizationpb.Subject_AccessToken{
-			AccessToken: string(idValue),
+			AccessToken: id,
 		}}, nil
 	case subjectTypeID:
 		return &authorizationpb.Subject{Subject: &authorizationpb.Subject_DigitalTwinId{
-			DigitalTwinId: &authorizationpb.DigitalTwin{Id: string(idValue)},
+			DigitalTwinId: &authorizationpb.DigitalTwin{Id: id},
 		}}, nil
 	case subjectTypeProperty:
-		propertyObject := subject.Get(ast.StringTerm("property"))
-		if propertyObject == nil {
-			return nil, builtins.NewOperandTypeErr(pos, subjectValue, "property")
+		property, err := utilities.RequiredStringField(subject, "property", pos)
+		if err != nil {
+			return nil, err
 		}
-		propertyValue := propertyObject.Value.(ast.String)
 		return &authorizationpb.Subject{
 			Subject: &authorizationpb.Subject_DigitalTwinProperty{
 				DigitalTwinProperty: &authorizationpb.Property{
-					Type:  string(propertyValue),
-					Value: objects.String(string(idValue)),
+					Type:  property,
+					Value: objects.String(id),
 				},
 			},
 		}, nil
-	case subjectTypeExternalID:
-		nodeTypeObject := subject.Get(ast.StringTerm("type"))
-		if nodeTypeObject == nil {
-			return nil, builtins.NewOperandTypeErr(pos, subjectValue, "type")
+	default:
+		nodeType, err := utilities.RequiredStringField(subject, "type", pos)
+		if err != nil {
+			return nil, err
 		}
-		nodeType := nodeTypeObject.Value.(ast.String)
 		return &authorizationpb.Subject{
 			Subject: &authorizationpb.Subject_ExternalId{
 				ExternalId: &authorizationpb.ExternalID{
-					Type:       string(nodeType),
-					ExternalId: string(idValue),
+					Type:       nodeType,
+					ExternalId: id,
 				},
 			},
 		}, nil
 	}
-
-	// Next line is unreachable. OPA will complain based on declaration of function, when types do not match.
-	return nil, builtins.NewOperandTypeErr(pos, subjectValue, "object")
 }
 
-func getSubjectType(subject ast.Object) string {
-	typeObject := subject.Get(ast.StringTerm("subjectType"))
-	if typeObject == nil {
-		return subjectTypeToken
+// getSubjectType returns subjectType of subject operand at pos, or token when not set.
+func getSubjectType(subject ast.Object, pos int) (string, error) {
+	subjectType, found, err := utilities.StringField(subject, "subjectType", pos)
+	if err != nil || !found {
+		return subjectTypeToken, err
+	}
+	switch subjectType {
+	case subjectTypeToken, subjectTypeID, subjectTypeProperty, subjectTypeExternalID:
+		return subjectType, nil
+	default:
+		return "", builtins.NewOperandErr(pos, "subjectType must be one of %s, %s, %s or %s but got %s",
+			subjectTypeToken, subjectTypeID, subjectTypeProperty, subjectTypeExternalID, subjectType)
 	}
-	typeValue := typeObject.Value.(ast.String)
-	return string(typeValue)
 }
@@ -0,0 +1,127 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions
+
+import (
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown/builtins"
+)
+
+type (
+	// resourceFields are fields of resource object, which is common for indy.is_authorized and indy.who_authorized.
+	// Resource types of indy.what_authorized have the same fields except externalId.
+	resourceFields struct {
+		externalID   string
+		resourceType string
+		actions      []string
+	}
+
+	// resourceList describes operand at pos, which is array of resource objects named name in errors.
+	resourceList struct {
+		name       string
+		pos        int
+		externalID bool
+	}
+)
+
+// parseResources converts array of resource objects to requested resources with build.
+// Keys are accepted in JSON and proto naming, like externalId and external_id, and null values are ignored.
+// Errors name index and field of invalid resource.
+func parseResources[R any](term *ast.Term, pos int, build func(resourceFields) R) ([]R, error) {
+	return parseResourceList(term, resourceList{name: "resources", pos: pos, externalID: true}, build)
+}
+
+// parseResourceTypes converts array of resource type objects of indy.what_authorized the same way
+// as parseResources converts resources, but without externalId field.
+func parseResourceTypes(term *ast.Term, pos int) ([]*authorizationpb.WhatAuthorizedRequest_ResourceType, error) {
+	return parseResourceList(term, resourceList{name: "resourceTypes", pos: pos},
+		func(f resourceFields) *authorizationpb.WhatAuthorizedRequest_ResourceType {
+			return &authorizationpb.WhatAuthorizedRequest_ResourceType{
+				Type:    f.resourceType,
+				Actions: f.actions,
+			}
+		})
+}
+
+func parseResourceList[R any](term *ast.Term, list resourceList, build func(resourceFields) R) ([]R, error) {
+	resources, err := builtins.ArrayOperand(term.Value, list.pos)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]R, resources.Len())
+	for i := range resources.Len() {
+		obj, ok := resources.Elem(i).Value.(ast.Object)
+		if !ok {
+			return nil, builtins.NewOperandErr(list.pos, "%s[%d] must be object but got %s",
+				list.name, i, ast.TypeName(resources.Elem(i).Value))
+		}
+		var fields resourceFields
+		err = obj.Iter(func(key, value *ast.Term) error {
+			return fields.set(list, i, key, value)
+		})
+		if err != nil {
+			return nil, err
+		}
+		result[i] = build(fields)
+	}
+	return result, nil
+}
+
+func (f *resourceFields) set(list resourceList, index int, key, value *ast.Term) error {
+	keyString, ok := key.Value.(ast.String)
+	if !ok {
+		return builtins.NewOperandErr(list.pos, "%s[%d] has invalid key %v", list.name, index, key)
+	}
+	if _, isNull := value.Value.(ast.Null); isNull {
+		return nil
+	}
+
+	name := string(keyString)
+	var err error
+	switch {
+	case list.externalID && (name == "externalId" || name == "external_id"):
+		f.externalID, err = resourceString(list, index, name, value)
+	case name == "type":
+		f.resourceType, err = resourceString(list, index, name, value)
+	case name == "actions":
+		arr, isArray := value.Value.(*ast.Array)
+		if !isArray {
+			return builtins.NewOperandErr(list.pos, "%s[%d].%s must be array but got %s",
+				list.name, index, name, ast.TypeName(value.Value))
+		}
+		f.actions = make([]string, arr.Len())
+		for j := range arr.Len() {
+			action, isString := arr.Elem(j).Value.(ast.String)
+			if !isString {
+				return builtins.NewOperandErr(list.pos, "%s[%d].%s[%d] must be string but got %s",
+					list.name, index, name, j, ast.TypeName(arr.Elem(j).Value))
+			}
+			f.actions[j] = string(action)
+		}
+	default:
+		return builtins.NewOperandErr(list.pos, "%s[%d] has unknown field %s", list.name, index, name)
+	}
+	return err
+}
+
+func resourceString(list resourceList, index int, name string, value *ast.Term) (string, error) {
+	s, ok := value.Value.(ast.String)
+	if !ok {
+		return "", builtins.NewOperandErr(list.pos, "%s[%d].%s must be string but got %s",
+			list.name, index, name, ast.TypeName(value.Value))
+	}
+	return string(s), nil
+}
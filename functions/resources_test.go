@@ -0,0 +1,153 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/indykite/opa-indykite-plugin/functions"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resources", func() {
+	It("Converts resources in JSON and proto naming", func() {
+		res, err := functions.ParseIsResources(ast.MustParseTerm(`[
+			{"externalId": "res1", "type": "Type", "actions": ["READ", "WRITE"]},
+			{"external_id": "res2", "type": "Type", "actions": null}
+		]`), 1)
+		Expect(err).To(Succeed())
+		Expect(res).To(HaveExactElements(
+			EqualProto(&authorizationpb.IsAuthorizedRequest_Resource{
+				ExternalId: "res1", Type: "Type", Actions: []string{"READ", "WRITE"},
+			}),
+			EqualProto(&authorizationpb.IsAuthorizedRequest_Resource{ExternalId: "res2", Type: "Type"}),
+		))
+
+		whoRes, err := functions.ParseWhoResources(ast.MustParseTerm(
+			`[{"externalId": "res1", "type": "Type", "actions": ["READ"]}]`), 1)
+		Expect(err).To(Succeed())
+		Expect(whoRes).To(HaveExactElements(EqualProto(&authorizationpb.WhoAuthorizedRequest_Resource{
+			ExternalId: "res1", Type: "Type", Actions: []string{"READ"},
+		})))
+	})
+
+	DescribeTable("Returns operand error naming invalid field",
+		func(resources, errMsg string) {
+			res, err := functions.ParseIsResources(ast.MustParseTerm(resources), 2)
+			Expect(res).To(BeNil())
+			Expect(err).To(MatchError(errMsg))
+		},
+		Entry("Not an array", `{"a": 1}`, "operand 2 must be array but got object"),
+		Entry("Not an object", `[{"externalId": "res1"}, "res2"]`,
+			"operand 2 resources[1] must be object but got string"),
+		Entry("Invalid externalId", `[{"externalId": 1}]`,
+			"operand 2 resources[0].externalId must be string but got number"),
+		Entry("Invalid type", `[{"type": true}]`,
+			"operand 2 resources[0].type must be string but got boolean"),
+		Entry("Invalid actions", `[{"actions": "READ"}]`,
+			"operand 2 resources[0].actions must be array but got string"),
+		Entry("Invalid action", `[{"actions": ["READ", 1]}]`,
+			"operand 2 resources[0].actions[1] must be string but got number"),
+		Entry("Unknown field", `[{"id": "res1"}]`, "operand 2 resources[0] has unknown field id"),
+	)
+
+	It("Converts resource types", func() {
+		res, err := functions.ParseResourceTypes(ast.MustParseTerm(
+			`[{"type": "Type", "actions": ["READ"]}, {"type": "Other", "actions": null}]`), 2)
+		Expect(err).To(Succeed())
+		Expect(res).To(HaveExactElements(
+			EqualProto(&authorizationpb.WhatAuthorizedRequest_ResourceType{Type: "Type", Actions: []string{"READ"}}),
+			EqualProto(&authorizationpb.WhatAuthorizedRequest_ResourceType{Type: "Other"}),
+		))
+	})
+
+	DescribeTable("Returns operand error naming invalid field of resource type",
+		func(resourceTypes, errMsg string) {
+			res, err := functions.ParseResourceTypes(ast.MustParseTerm(resourceTypes), 2)
+			Expect(res).To(BeNil())
+			Expect(err).To(MatchError(errMsg))
+		},
+		Entry("Not an array", `{"type": "Type"}`, "operand 2 must be array but got object"),
+		Entry("Not an object", `["Type"]`, "operand 2 resourceTypes[0] must be object but got string"),
+		Entry("Invalid type", `[{"type": 1}]`, "operand 2 resourceTypes[0].type must be string but got number"),
+		Entry("Invalid action", `[{"type": "Type", "actions": [true]}]`,
+			"operand 2 resourceTypes[0].actions[0] must be string but got boolean"),
+		Entry("ExternalId", `[{"type": "Type", "externalId": "res1"}]`,
+			"operand 2 resourceTypes[0] has unknown field externalId"),
+		Entry("Unknown field", `[{"type": "Type", "action": ["READ"]}]`,
+			"operand 2 resourceTypes[0] has unknown field action"),
+	)
+
+	DescribeTable("Builtins report position of resources operand",
+		func(query, errMsg string) {
+			_, err := rego.New(rego.Query(query), rego.StrictBuiltinErrors(true),
+				rego.Input(map[string]interface{}{"res": []interface{}{map[string]interface{}{"externalId": 1}}}),
+			).Eval(context.Background())
+			Expect(err).To(MatchError(ContainSubstring(errMsg)))
+		},
+		Entry("indy.is_authorized", `x = indy.is_authorized({"id": "t"}, input.res, {}, [])`,
+			"indy.is_authorized: operand 2 resources[0].externalId must be string but got number"),
+		Entry("indy.what_authorized", `x = indy.what_authorized({"id": "t"}, input.res, {}, [])`,
+			"indy.what_authorized: operand 2 resourceTypes[0] has unknown field externalId"),
+		Entry("indy.who_authorized", `x = indy.who_authorized(input.res, {}, [])`,
+			"indy.who_authorized: operand 1 resources[0].externalId must be string but got number"),
+	)
+})
+
+func resourcesTerm(n int) *ast.Term {
+	resources := make([]string, n)
+	for i := range n {
+		resources[i] = fmt.Sprintf(`{"externalId": "res%d", "type": "Type", "actions": ["READ", "WRITE"]}`, i)
+	}
+	return ast.MustParseTerm("[" + strings.Join(resources, ",") + "]")
+}
+
+func BenchmarkParseIsResources(b *testing.B) {
+	term := resourcesTerm(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := functions.ParseIsResources(term, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkParseIsResourcesProtoJSON measures former conversion through JSON string as baseline.
+func BenchmarkParseIsResourcesProtoJSON(b *testing.B) {
+	term := resourcesTerm(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		arr := term.Value.(*ast.Array)
+		resources := make([]*authorizationpb.IsAuthorizedRequest_Resource, arr.Len())
+		for i := range arr.Len() {
+			resources[i] = &authorizationpb.IsAuthorizedRequest_Resource{}
+			if err := protojson.Unmarshal([]byte(arr.Elem(i).Value.String()), resources[i]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
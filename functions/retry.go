@@ -0,0 +1,126 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"github.com/indykite/indykite-sdk-go/errors"
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+)
+
+// retryPolicy defines how IndyKite calls failing with transient errors are retried.
+// Zero value makes a single attempt.
+type retryPolicy struct {
+	retryable   map[codes.Code]bool
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	jitter      float64
+	maxAttempts int
+	// logger of the plugin, standard logger is used when nil.
+	logger logging.Logger
+}
+
+// currentRetryPolicy returns retry policy configured by the plugin.
+func currentRetryPolicy(plugin *plugins.IndyKitePlugin) retryPolicy {
+	if plugin == nil {
+		return retryPolicy{}
+	}
+	policy := newRetryPolicy(plugin.Config().Retry)
+	policy.logger = plugin.Logger()
+	return policy
+}
+
+func newRetryPolicy(cfg *plugins.RetryConfig) retryPolicy {
+	if cfg == nil {
+		return retryPolicy{}
+	}
+	// Config is validated by the plugin, so the error cannot happen here.
+	retryable, _ := cfg.Codes()
+	base, maxBackoff := cfg.Backoff()
+	return retryPolicy{
+		retryable:   retryable,
+		baseBackoff: base,
+		maxBackoff:  maxBackoff,
+		jitter:      cfg.JitterFraction(),
+		maxAttempts: cfg.Attempts(),
+	}
+}
+
+// backoff returns delay before given retry, starting from 1.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	delay := p.baseBackoff << (retry - 1)
+	if delay > p.maxBackoff || delay <= 0 {
+		delay = p.maxBackoff
+	}
+	if p.jitter > 0 {
+		delay = time.Duration(float64(delay) * (1 + p.jitter*(2*rand.Float64()-1))) //nolint:gosec // no security
+	}
+	return delay
+}
+
+// callWithRetry calls IndyKite and retries transient errors with exponential backoff.
+// Retries stop when the next attempt would not start before the context deadline.
+func callWithRetry[T any](
+	ctx context.Context,
+	builtin string,
+	policy retryPolicy,
+	call func(ctx context.Context) (T, error),
+) (T, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := call(ctx)
+		if err == nil || attempt >= policy.maxAttempts {
+			return resp, err
+		}
+		statusErr := errors.FromError(err)
+		if !policy.retryable[statusErr.Code()] || ctx.Err() != nil {
+			return resp, err
+		}
+
+		delay := policy.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			return resp, err
+		}
+		policy.log(map[string]interface{}{
+			"builtin":   builtin,
+			"attempt":   attempt,
+			"grpc_code": statusErr.Code().String(),
+			"backoff":   delay.String(),
+		})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, err
+		case <-timer.C:
+		}
+	}
+}
+
+// log reports retried call with fields.
+func (p retryPolicy) log(fields map[string]interface{}) {
+	if p.logger != nil {
+		p.logger.WithFields(fields).Info("IndyKite call failed, retrying")
+		return
+	}
+	logrus.WithFields(fields).Info("IndyKite call failed, retrying")
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/indykite/indykite-sdk-go/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/indykite/opa-indykite-plugin/functions"
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Retry", func() {
+	failing := func(attempts *int, failures int, code codes.Code) func(context.Context) (int, error) {
+		return func(context.Context) (int, error) {
+			*attempts++
+			if *attempts <= failures {
+				return 0, errors.FromError(status.Error(code, "oops"))
+			}
+			return 42, nil
+		}
+	}
+	cfg := &plugins.RetryConfig{MaxAttempts: 3, BaseBackoffMillis: 1, MaxBackoffMillis: 2}
+
+	It("Retries transient errors", func() {
+		attempts := 0
+		resp, err := functions.CallWithRetry(context.Background(), cfg, failing(&attempts, 2, codes.Unavailable))
+		Expect(err).To(Succeed())
+		Expect(resp).To(Equal(42))
+		Expect(attempts).To(Equal(3))
+	})
+
+	It("Stops after max attempts", func() {
+		attempts := 0
+		_, err := functions.CallWithRetry(context.Background(), cfg, failing(&attempts, 5, codes.Unavailable))
+		Expect(err).To(MatchError(ContainSubstring("oops")))
+		Expect(attempts).To(Equal(3))
+	})
+
+	It("Does not retry without config", func() {
+		attempts := 0
+		_, err := functions.CallWithRetry(context.Background(), nil, failing(&attempts, 1, codes.Unavailable))
+		Expect(err).To(HaveOccurred())
+		Expect(attempts).To(Equal(1))
+	})
+
+	It("Does not retry user errors", func() {
+		attempts := 0
+		_, err := functions.CallWithRetry(context.Background(), cfg, failing(&attempts, 1, codes.InvalidArgument))
+		Expect(err).To(HaveOccurred())
+		Expect(attempts).To(Equal(1))
+	})
+
+	It("Retries only configured codes", func() {
+		attempts := 0
+		onlyAborted := &plugins.RetryConfig{RetryableCodes: []string{"ABORTED"}, BaseBackoffMillis: 1}
+		_, err := functions.CallWithRetry(context.Background(), onlyAborted, failing(&attempts, 1, codes.Unavailable))
+		Expect(err).To(HaveOccurred())
+		Expect(attempts).To(Equal(1))
+
+		attempts = 0
+		_, err = functions.CallWithRetry(context.Background(), onlyAborted, failing(&attempts, 1, codes.Aborted))
+		Expect(err).To(Succeed())
+		Expect(attempts).To(Equal(2))
+	})
+
+	It("Does not wait beyond context deadline", func() {
+		attempts := 0
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		slow := &plugins.RetryConfig{MaxAttempts: 5, BaseBackoffMillis: 1000}
+
+		start := time.Now()
+		_, err := functions.CallWithRetry(ctx, slow, failing(&attempts, 5, codes.Unavailable))
+		Expect(err).To(HaveOccurred())
+		Expect(attempts).To(Equal(1))
+		Expect(time.Since(start)).To(BeNumerically("<", 50*time.Millisecond))
+	})
+})
@@ -0,0 +1,99 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions
+
+import (
+	"context"
+	"time"
+
+	"github.com/indykite/indykite-sdk-go/errors"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+)
+
+// builtinCall measures single call of indy.* builtin and records it for decision logs.
+// Call is also observed by Prometheus metrics of the plugin and traced as child span of the evaluation.
+type builtinCall struct {
+	start  time.Time
+	ctx    context.Context
+	span   trace.Span
+	plugin *plugins.IndyKitePlugin
+	record plugins.CallRecord
+}
+
+// startBuiltinCall starts span from ctx with attrs. Call is recorded by plugin, when not nil.
+// IndyKite must be called with returned call.ctx, which carries the trace context also in outgoing gRPC metadata.
+func startBuiltinCall(
+	ctx context.Context,
+	plugin *plugins.IndyKitePlugin,
+	builtin string,
+	resources int,
+	attrs ...attribute.KeyValue,
+) *builtinCall {
+	c := &builtinCall{
+		start:  time.Now(),
+		plugin: plugin,
+		record: plugins.CallRecord{
+			Builtin:   builtin,
+			Resources: resources,
+		},
+	}
+	attrs = append(attrs, attrBuiltin.String(builtin), attrResourceCount.Int(resources))
+	ctx, c.span = tracer(c.plugin).Start(ctx, builtin,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	c.ctx = injectTraceContext(ctx)
+	if c.plugin != nil {
+		c.plugin.Metrics().CallStarted(builtin)
+	}
+	return c
+}
+
+// finish completes the record with result of the call, stores it under decision ID and ends the span.
+func (c *builtinCall) finish(decisionTime *timestamppb.Timestamp, err error) {
+	c.record.LatencyMillis = float64(time.Since(c.start)) / float64(time.Millisecond)
+	code := callCode(err)
+	c.record.GRPCCode = code.String()
+	if decisionTime != nil {
+		c.record.DecisionTime = decisionTime.GetSeconds()
+	}
+	if c.plugin != nil {
+		c.plugin.CallRecorder().Record(c.ctx, c.record)
+		c.plugin.Metrics().CallFinished(c.record)
+	}
+
+	c.span.SetAttributes(attrResultCode.String(c.record.GRPCCode))
+	if code != codes.OK {
+		c.span.SetStatus(otelcodes.Error, code.String())
+		c.span.RecordError(err)
+	}
+	c.span.End()
+}
+
+// callCode returns gRPC code of IndyKite call result. Open circuit breaker is reported as Unavailable.
+func callCode(err error) codes.Code {
+	if err == nil {
+		return codes.OK
+	}
+	if _, ok := asCircuitOpen(err); ok {
+		return codes.Unavailable
+	}
+	return errors.FromError(err).Code()
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions
+
+import (
+	"context"
+	"errors"
+
+	sdkerrors "github.com/indykite/indykite-sdk-go/errors"
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+)
+
+// validateSubject checks access token in subject, when token validation is enabled by plugin.
+// Invalid token is rejected with error, for which rejectedObject returns result of builtin.
+func validateSubject(ctx context.Context, plugin *plugins.IndyKitePlugin, subject *authorizationpb.Subject) error {
+	token := subject.GetAccessToken()
+	if token == "" || plugin == nil {
+		return nil
+	}
+	validator := plugin.TokenValidator()
+	if validator == nil {
+		return nil
+	}
+
+	err := validator.Validate(ctx, token)
+	var tokenErr *plugins.TokenError
+	if errors.As(err, &tokenErr) {
+		return sdkerrors.NewInvalidArgumentErrorWithCause(errors.Unwrap(tokenErr), tokenErr.Reason)
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions
+
+import (
+	"context"
+	"slices"
+
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+)
+
+const tracerName = "github.com/indykite/opa-indykite-plugin/functions"
+
+// Span attributes of indy.* builtin calls.
+const (
+	attrBuiltin       = attribute.Key("indykite.builtin")
+	attrSubjectType   = attribute.Key("indykite.subject.type")
+	attrResourceTypes = attribute.Key("indykite.resource.types")
+	attrResourceCount = attribute.Key("indykite.resource.count")
+	attrActionCount   = attribute.Key("indykite.action.count")
+	attrResultCode    = attribute.Key("indykite.result.code")
+)
+
+// traceContextPropagator writes W3C trace context into gRPC metadata sent to IndyKite.
+// It does not depend on global propagator, which is not configured by OPA.
+var traceContextPropagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{},
+	propagation.Baggage{},
+)
+
+// tracer returns tracer of OPA distributed tracing, or global tracer when plugin is not running.
+func tracer(plugin *plugins.IndyKitePlugin) trace.Tracer {
+	if plugin != nil {
+		if provider := plugin.TracerProvider(); provider != nil {
+			return provider.Tracer(tracerName)
+		}
+	}
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
+
+// injectTraceContext returns ctx with trace context of its span appended to outgoing gRPC metadata.
+func injectTraceContext(ctx context.Context) context.Context {
+	carrier := propagation.MapCarrier{}
+	traceContextPropagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return ctx
+	}
+	pairs := make([]string, 0, 2*len(carrier))
+	for key, value := range carrier {
+		pairs = append(pairs, key, value)
+	}
+	return metadata.AppendToOutgoingContext(ctx, pairs...)
+}
+
+// subjectType returns subjectType of builtin operand, which was used to create subject.
+func subjectType(subject *authorizationpb.Subject) string {
+	switch subject.GetSubject().(type) {
+	case *authorizationpb.Subject_DigitalTwinId:
+		return subjectTypeID
+	case *authorizationpb.Subject_DigitalTwinProperty:
+		return subjectTypeProperty
+	case *authorizationpb.Subject_ExternalId:
+		return subjectTypeExternalID
+	default:
+		return subjectTypeToken
+	}
+}
+
+// resourceAttributes returns sorted unique resource types and total number of actions as span attributes.
+func resourceAttributes[R interface {
+	GetType() string
+	GetActions() []string
+}](resources []R) []attribute.KeyValue {
+	types := make([]string, 0, len(resources))
+	actions := 0
+	for _, r := range resources {
+		types = append(types, r.GetType())
+		actions += len(r.GetActions())
+	}
+	slices.Sort(types)
+	return []attribute.KeyValue{
+		attrResourceTypes.StringSlice(slices.Compact(types)),
+		attrActionCount.Int(actions),
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package functions_test
+
+import (
+	"context"
+
+	"github.com/indykite/indykite-sdk-go/authorization"
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	authorizationm "github.com/indykite/indykite-sdk-go/test/authorization/v1beta1"
+	"github.com/open-policy-agent/opa/rego"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/indykite/opa-indykite-plugin/functions"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tracing", func() {
+	var (
+		mockAuthorizationClient *authorizationm.MockAuthorizationAPIClient
+		exporter                *tracetest.InMemoryExporter
+		provider                *sdktrace.TracerProvider
+		ctx                     context.Context
+	)
+
+	BeforeEach(func() {
+		mockCtrl := gomock.NewController(GinkgoT())
+		mockAuthorizationClient = authorizationm.NewMockAuthorizationAPIClient(mockCtrl)
+		client, _ := authorization.NewClientFromGRPCClient(mockAuthorizationClient)
+		ctx = functions.WithAuthorizationClient(context.Background(), client)
+
+		exporter = tracetest.NewInMemoryExporter()
+		provider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+		oldProvider := otel.GetTracerProvider()
+		otel.SetTracerProvider(provider)
+		DeferCleanup(func() {
+			otel.SetTracerProvider(oldProvider)
+		})
+	})
+
+	eval := func(ctx context.Context, query string) rego.ResultSet {
+		prepared, err := rego.New(rego.Query(query)).PrepareForEval(ctx)
+		Expect(err).To(Succeed())
+		rs, err := prepared.Eval(ctx)
+		Expect(err).To(Succeed())
+		return rs
+	}
+
+	It("Creates child span and propagates trace context to IndyKite", func() {
+		ctx, parent := provider.Tracer("test").Start(ctx, "eval")
+		mockAuthorizationClient.EXPECT().IsAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, _ *authorizationpb.IsAuthorizedRequest, _ ...grpc.CallOption) (
+				*authorizationpb.IsAuthorizedResponse, error,
+			) {
+				md, ok := metadata.FromOutgoingContext(ctx)
+				Expect(ok).To(BeTrue())
+				Expect(md.Get("traceparent")).To(ConsistOf(
+					ContainSubstring(parent.SpanContext().TraceID().String())))
+				return &authorizationpb.IsAuthorizedResponse{}, nil
+			})
+
+		eval(ctx, `x = indy.is_authorized({"id": "ext", "subjectType": "external_id", "type": "Person"}, [
+			{"externalId": "resa", "type": "Doc", "actions": ["READ", "WRITE"]},
+			{"externalId": "resb", "type": "Car", "actions": ["READ"]},
+			{"externalId": "resc", "type": "Doc", "actions": ["READ"]}
+		], {}, [])`)
+		parent.End()
+
+		spans := exporter.GetSpans()
+		Expect(spans).To(HaveLen(2))
+		span := spans[0]
+		Expect(span.Name).To(Equal("indy.is_authorized"))
+		Expect(span.SpanKind).To(Equal(trace.SpanKindClient))
+		Expect(span.Parent.SpanID()).To(Equal(parent.SpanContext().SpanID()))
+		Expect(span.Attributes).To(ConsistOf(
+			attribute.String("indykite.builtin", "indy.is_authorized"),
+			attribute.String("indykite.subject.type", "external_id"),
+			attribute.StringSlice("indykite.resource.types", []string{"Car", "Doc"}),
+			attribute.Int("indykite.resource.count", 3),
+			attribute.Int("indykite.action.count", 4),
+			attribute.String("indykite.result.code", "OK"),
+		))
+		Expect(span.Status.Code).To(Equal(otelcodes.Unset))
+	})
+
+	It("Marks span as failed with result code", func() {
+		mockAuthorizationClient.EXPECT().WhatAuthorized(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(nil, status.Error(codes.InvalidArgument, "bad request"))
+
+		eval(ctx, `x = indy.what_authorized({"id": "`+testAccessToken+`"}, [
+			{"type": "Doc", "actions": ["READ"]}
+		], {}, [])`)
+
+		spans := exporter.GetSpans()
+		Expect(spans).To(HaveLen(1))
+		Expect(spans[0].Name).To(Equal("indy.what_authorized"))
+		Expect(spans[0].Attributes).To(ContainElements(
+			attribute.String("indykite.subject.type", "token"),
+			attribute.String("indykite.result.code", "InvalidArgument"),
+		))
+		Expect(spans[0].Status.Code).To(Equal(otelcodes.Error))
+	})
+})
@@ -15,6 +15,8 @@
 package functions
 
 import (
+	"context"
+
 	"github.com/indykite/indykite-sdk-go/errors"
 	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
 	"github.com/open-policy-agent/opa/ast"
@@ -24,101 +26,156 @@ import (
 	"github.com/indykite/opa-indykite-plugin/utilities"
 )
 
+var (
+	whatAuthorizedArgs = []types.Type{
+		types.Named("subject", types.NewAny(
+			types.NewObject([]*types.StaticProperty{
+				types.NewStaticProperty("id", types.S),
+			}, nil),
+			types.NewObject([]*types.StaticProperty{
+				types.NewStaticProperty("id", types.S),
+				types.NewStaticProperty("subjectType", types.S),
+			}, nil),
+			types.NewObject([]*types.StaticProperty{
+				types.NewStaticProperty("id", types.S),
+				types.NewStaticProperty("subjectType", types.S),
+				types.NewStaticProperty("property", types.S),
+			}, nil),
+			types.NewObject([]*types.StaticProperty{
+				types.NewStaticProperty("id", types.S),
+				types.NewStaticProperty("subjectType", types.S),
+				types.NewStaticProperty("type", types.S),
+			}, nil),
+		)),
+		types.Named("resourcesTypes", types.NewArray(nil, types.NewAny(
+			types.NewObject([]*types.StaticProperty{
+				types.NewStaticProperty("type", types.S),
+			}, nil),
+			types.NewObject([]*types.StaticProperty{
+				types.NewStaticProperty("type", types.S),
+				types.NewStaticProperty("actions", types.NewArray(nil, types.S)),
+			}, nil),
+		))),
+		types.Named(inputParamsKey, types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
+		types.Named(policyTagsKey, types.NewArray(nil, types.S)),
+	}
+	whatAuthorizedResult = types.Named("authorizationResponse", types.NewObject([]*types.StaticProperty{
+		types.NewStaticProperty("decisionTime", types.N),
+		types.NewStaticProperty("decisions", types.NewObject(nil, types.NewDynamicProperty(
+			types.S,
+			types.NewObject(nil, types.NewDynamicProperty(
+				types.S,
+				types.NewObject([]*types.StaticProperty{
+					types.NewStaticProperty("externalId", types.B),
+				}, nil),
+			)),
+		))),
+	}, nil))
+)
+
 func init() {
 	rego.RegisterBuiltin4(
 		&rego.Function{
 			Name: "indy.what_authorized",
-			Decl: types.NewFunction(
-				types.Args(
-					types.Named("subject", types.NewAny(
-						types.NewObject([]*types.StaticProperty{
-							types.NewStaticProperty("id", types.S),
-						}, nil),
-						types.NewObject([]*types.StaticProperty{
-							types.NewStaticProperty("id", types.S),
-							types.NewStaticProperty("subjectType", types.S),
-						}, nil),
-						types.NewObject([]*types.StaticProperty{
-							types.NewStaticProperty("id", types.S),
-							types.NewStaticProperty("subjectType", types.S),
-							types.NewStaticProperty("property", types.S),
-						}, nil),
-						types.NewObject([]*types.StaticProperty{
-							types.NewStaticProperty("id", types.S),
-							types.NewStaticProperty("subjectType", types.S),
-							types.NewStaticProperty("type", types.S),
-						}, nil),
-					)),
-					types.Named("resourcesTypes", types.NewArray(nil, types.NewAny(
-						types.NewObject([]*types.StaticProperty{
-							types.NewStaticProperty("type", types.S),
-						}, nil),
-						types.NewObject([]*types.StaticProperty{
-							types.NewStaticProperty("type", types.S),
-							types.NewStaticProperty("actions", types.NewArray(nil, types.S)),
-						}, nil),
-					))),
-					types.Named(inputParamsKey, types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
-					types.Named(policyTagsKey, types.NewArray(nil, types.S)),
-				),
-				types.Named("authorizationResponse", types.NewObject([]*types.StaticProperty{
-					types.NewStaticProperty("decisionTime", types.N),
-					types.NewStaticProperty("decisions", types.NewObject(nil, types.NewDynamicProperty(
-						types.S,
-						types.NewObject(nil, types.NewDynamicProperty(
-							types.S,
-							types.NewObject([]*types.StaticProperty{
-								types.NewStaticProperty("externalId", types.B),
-							}, nil),
-						)),
-					))),
-				}, nil)),
-			),
+			Decl: types.NewFunction(types.Args(whatAuthorizedArgs...), whatAuthorizedResult),
 		},
 		func(bCtx rego.BuiltinContext, subject, resourceTypes, inputParams, policyTags *ast.Term) (*ast.Term, error) {
-			var (
-				err error
-				req = &authorizationpb.WhatAuthorizedRequest{}
-			)
-
-			req.Subject, err = extractSubject(subject.Value, 1)
-			if err != nil {
-				return nil, err
-			}
+			return whatAuthorizedBuiltin(bCtx, "indy.what_authorized",
+				subject, resourceTypes, inputParams, policyTags, nil)
+		},
+	)
 
-			if err = ast.As(resourceTypes.Value, &req.ResourceTypes); err != nil {
-				return nil, err
-			}
+	rego.RegisterBuiltinDyn(
+		&rego.Function{
+			Name: "indy.what_authorized_with_connection",
+			Decl: types.NewFunction(withConnectionArg(whatAuthorizedArgs), whatAuthorizedResult),
+		},
+		func(bCtx rego.BuiltinContext, terms []*ast.Term) (*ast.Term, error) {
+			return whatAuthorizedBuiltin(bCtx, "indy.what_authorized_with_connection",
+				terms[0], terms[1], terms[2], terms[3], terms[4])
+		},
+	)
+}
 
-			req.InputParams, err = utilities.ParseInputParams(inputParams, 3)
-			if err != nil {
-				return nil, err
-			}
+// whatAuthorizedBuiltin implements indy.what_authorized and its variant with connection name,
+// which is nil when the default connection is used.
+func whatAuthorizedBuiltin(
+	bCtx rego.BuiltinContext,
+	builtin string,
+	subject, resourceTypes, inputParams, policyTags, connection *ast.Term,
+) (*ast.Term, error) {
+	req := &authorizationpb.WhatAuthorizedRequest{}
+	plugin, err := resolvePlugin(bCtx)
+	if err != nil {
+		return nil, err
+	}
 
-			req.PolicyTags = parsePolicyTags(policyTags)
+	req.Subject, err = extractSubject(subject.Value, 1)
+	if err != nil {
+		return nil, err
+	}
 
-			client, err := AuthorizationClient(bCtx.Context)
-			if err != nil {
-				return nil, err
-			}
+	req.ResourceTypes, err = parseResourceTypes(resourceTypes, 2)
+	if err != nil {
+		return nil, err
+	}
 
-			var (
-				resp *authorizationpb.WhatAuthorizedResponse
-				obj  ast.Object
-			)
-			resp, err = client.WhatAuthorizedWithRawRequest(bCtx.Context, req)
-			if statusErr := errors.FromError(err); statusErr != nil {
-				if errors.IsServiceError(statusErr) {
-					return nil, statusErr
-				}
-				obj = ast.NewObject(ast.Item(ast.StringTerm("error"), utilities.BuildUserError(statusErr)))
-			} else {
-				obj = buildWhatAuthorizedObjectFromResponse(resp)
-			}
+	req.InputParams, err = parseInputParams(plugin, inputParams, 3)
+	if err != nil {
+		return nil, err
+	}
 
-			return &ast.Term{Value: obj}, nil
-		},
+	req.PolicyTags, err = parsePolicyTags(policyTags, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn string
+	if err = validateSubject(bCtx.Context, plugin, req.GetSubject()); err == nil {
+		conn, err = resolveConnection(bCtx.Context, plugin, connection, req.GetSubject(), 5)
+	}
+	if obj, ok := rejectedObject(err); ok {
+		return &ast.Term{Value: obj}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	client, release, err := acquireAuthorizationClient(bCtx.Context, plugin, conn)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var (
+		resp *authorizationpb.WhatAuthorizedResponse
+		obj  ast.Object
 	)
+	attrs := append(resourceAttributes(req.GetResourceTypes()),
+		attrSubjectType.String(subjectType(req.GetSubject())))
+	call := startBuiltinCall(bCtx.Context, plugin, builtin,
+		len(req.GetResourceTypes()), attrs...)
+	resp, err = callWithBreaker(call.ctx, currentCircuitBreaker(plugin, conn), builtin,
+		func() (*authorizationpb.WhatAuthorizedResponse, error) {
+			return callWithRetry(call.ctx, builtin, currentRetryPolicy(plugin), func(
+				ctx context.Context,
+			) (*authorizationpb.WhatAuthorizedResponse, error) {
+				return client.WhatAuthorizedWithRawRequest(ctx, req)
+			})
+		})
+	call.finish(resp.GetDecisionTime(), err)
+	explainCall(bCtx, plugin, builtin, req, resp, err)
+	if openErr, ok := asCircuitOpen(err); ok {
+		obj = circuitOpenWhatAuthorized(openErr, req)
+	} else if statusErr := errors.FromError(err); statusErr != nil {
+		if errors.IsServiceError(statusErr) {
+			return nil, statusErr
+		}
+		obj = ast.NewObject(ast.Item(ast.StringTerm("error"), utilities.BuildUserError(statusErr)))
+	} else {
+		obj = buildWhatAuthorizedObjectFromResponse(resp)
+	}
+
+	return &ast.Term{Value: obj}, nil
 }
 
 func buildWhatAuthorizedObjectFromResponse(resp *authorizationpb.WhatAuthorizedResponse) ast.Object {
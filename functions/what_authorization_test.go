@@ -42,7 +42,7 @@ var _ = Describe("indy.what_authorized", func() {
 	var (
 		mockCtrl                *gomock.Controller
 		mockAuthorizationClient *authorizationm.MockAuthorizationAPIClient
-		oldConnection           *authorization.Client
+		ctx                     context.Context
 		idFn                    = func(resource interface{}) string {
 			switch r := resource.(type) {
 			case map[string]interface{}:
@@ -57,10 +57,7 @@ var _ = Describe("indy.what_authorized", func() {
 		mockCtrl = gomock.NewController(GinkgoT())
 		mockAuthorizationClient = authorizationm.NewMockAuthorizationAPIClient(mockCtrl)
 		client, _ := authorization.NewClientFromGRPCClient(mockAuthorizationClient)
-		oldConnection = functions.OverrideAuthorizationClient(client)
-	})
-	AfterEach(func() {
-		functions.OverrideAuthorizationClient(oldConnection)
+		ctx = functions.WithAuthorizationClient(context.Background(), client)
 	})
 
 	type dtIDCase struct {
@@ -117,7 +114,6 @@ var _ = Describe("indy.what_authorized", func() {
 
 			r := rego.New(rego.Query(`x = indy.what_authorized(` + c.regoParam1 + `,[{"type": "TypeOne", "actions": ["READ"]},{"type": "TypeTwo"}], {"string": {"string_value":"42"}, "integer": {"integer_value":42}, "double": {"double_value":4.2}, "boolean": {"bool_value":true}}, ["42"])`)) //nolint:lll
 
-			ctx := context.Background()
 			query, err := r.PrepareForEval(ctx)
 			Expect(err).To(Succeed())
 
@@ -227,7 +223,6 @@ var _ = Describe("indy.what_authorized", func() {
 	DescribeTable("Invalid input arguments - gRPC error",
 		func(regoParams string, errorMessage string, originMessage string) {
 			q := `x = indy.what_authorized(` + regoParams + `)`
-			ctx := context.Background()
 
 			r := rego.New(rego.Query(q))
 
@@ -264,7 +259,6 @@ var _ = Describe("indy.what_authorized", func() {
 	)
 
 	It("Service backend error", func() {
-		ctx := context.Background()
 		mockAuthorizationClient.EXPECT().
 			WhatAuthorized(gomock.Any(), gomock.Any()).
 			Times(2).
@@ -295,10 +289,9 @@ var _ = Describe("indy.what_authorized", func() {
 	})
 
 	It("Fail to create client", func() {
+		// Without plugin and client in context, client is created from environment variables.
 		ctx := context.Background()
 
-		functions.OverrideAuthorizationClient(nil)
-
 		// With StrictBuiltinErrors
 		r := rego.New(
 			rego.Query(`x = indy.what_authorized({"id": "`+testAccessToken+`"}, [{"type": "Type", "actions": ["READ"]}], {}, [])`), //nolint:lll
@@ -358,7 +351,6 @@ var _ = Describe("indy.what_authorized", func() {
 			q := `x = indy.what_authorized({"id": "` + testAccessToken + `"},[{"type": "Type", "actions": ["READ"]}],` + regoOptions + `)` // nolint:lll
 			r := rego.New(rego.Query(q))
 
-			ctx := context.Background()
 			query, err := r.PrepareForEval(ctx)
 			Expect(err).To(Succeed())
 
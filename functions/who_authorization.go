@@ -15,90 +15,169 @@
 package functions
 
 import (
-	"bytes"
+	"context"
 
+	"github.com/indykite/indykite-sdk-go/authorization"
 	"github.com/indykite/indykite-sdk-go/errors"
 	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/rego"
-	"github.com/open-policy-agent/opa/topdown/builtins"
 	"github.com/open-policy-agent/opa/types"
-	"google.golang.org/protobuf/encoding/protojson"
 
+	"github.com/indykite/opa-indykite-plugin/plugins"
 	"github.com/indykite/opa-indykite-plugin/utilities"
 )
 
+var (
+	whoAuthorizedArgs = []types.Type{
+		types.Named("resources", types.NewArray(nil, types.NewObject([]*types.StaticProperty{
+			types.NewStaticProperty("externalId", types.S),
+			types.NewStaticProperty("type", types.S),
+			types.NewStaticProperty("actions", types.NewArray(nil, types.S)),
+		}, nil))),
+		types.Named(inputParamsKey, types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
+		types.Named(policyTagsKey, types.NewArray(nil, types.S)),
+	}
+	whoAuthorizedResult = types.Named("authorizationResponse", types.NewObject([]*types.StaticProperty{
+		types.NewStaticProperty("decisionTime", types.N),
+		types.NewStaticProperty("decisions", types.NewObject(nil, types.NewDynamicProperty(
+			types.S,
+			types.NewObject(nil, types.NewDynamicProperty(
+				types.S,
+				types.NewObject(nil, types.NewDynamicProperty(
+					types.S,
+					types.NewObject([]*types.StaticProperty{
+						types.NewStaticProperty("externalId", types.B),
+					}, nil),
+				)),
+			)),
+		))),
+	}, nil))
+)
+
 func init() {
 	rego.RegisterBuiltin3(
 		&rego.Function{
 			Name: "indy.who_authorized",
-			Decl: types.NewFunction(
-				types.Args(
-					types.Named("resources", types.NewArray(nil, types.NewObject([]*types.StaticProperty{
-						types.NewStaticProperty("externalId", types.S),
-						types.NewStaticProperty("type", types.S),
-						types.NewStaticProperty("actions", types.NewArray(nil, types.S)),
-					}, nil))),
-					types.Named(inputParamsKey, types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
-					types.Named(policyTagsKey, types.NewArray(nil, types.S)),
-				),
-				types.Named("authorizationResponse", types.NewObject([]*types.StaticProperty{
-					types.NewStaticProperty("decisionTime", types.N),
-					types.NewStaticProperty("decisions", types.NewObject(nil, types.NewDynamicProperty(
-						types.S,
-						types.NewObject(nil, types.NewDynamicProperty(
-							types.S,
-							types.NewObject(nil, types.NewDynamicProperty(
-								types.S,
-								types.NewObject([]*types.StaticProperty{
-									types.NewStaticProperty("externalId", types.B),
-								}, nil),
-							)),
-						)),
-					))),
-				}, nil)),
-			),
+			Decl: types.NewFunction(types.Args(whoAuthorizedArgs...), whoAuthorizedResult),
 		},
 		func(bCtx rego.BuiltinContext, resources, inputParams, policyTags *ast.Term) (*ast.Term, error) {
-			var (
-				err error
-				req = &authorizationpb.WhoAuthorizedRequest{}
-			)
-
-			req.Resources, err = parseWhoResources(resources, 1)
-			if err != nil {
-				return nil, err
-			}
+			return whoAuthorizedBuiltin(bCtx, "indy.who_authorized", resources, inputParams, policyTags, nil)
+		},
+	)
 
-			req.InputParams, err = utilities.ParseInputParams(inputParams, 2)
-			if err != nil {
-				return nil, err
-			}
+	rego.RegisterBuiltin4(
+		&rego.Function{
+			Name: "indy.who_authorized_with_connection",
+			Decl: types.NewFunction(withConnectionArg(whoAuthorizedArgs), whoAuthorizedResult),
+		},
+		func(bCtx rego.BuiltinContext, resources, inputParams, policyTags, connection *ast.Term) (*ast.Term, error) {
+			return whoAuthorizedBuiltin(bCtx, "indy.who_authorized_with_connection",
+				resources, inputParams, policyTags, connection)
+		},
+	)
+}
 
-			req.PolicyTags = parsePolicyTags(policyTags)
+// whoAuthorizedBuiltin implements indy.who_authorized and its variant with connection name,
+// which is nil when the default connection is used.
+func whoAuthorizedBuiltin(
+	bCtx rego.BuiltinContext,
+	builtin string,
+	resources, inputParams, policyTags, connection *ast.Term,
+) (*ast.Term, error) {
+	req := &authorizationpb.WhoAuthorizedRequest{}
+	plugin, err := resolvePlugin(bCtx)
+	if err != nil {
+		return nil, err
+	}
 
-			client, err := AuthorizationClient(bCtx.Context)
-			if err != nil {
-				return nil, err
-			}
+	req.Resources, err = parseWhoResources(resources, 1)
+	if err != nil {
+		return nil, err
+	}
 
-			var (
-				resp *authorizationpb.WhoAuthorizedResponse
-				obj  ast.Object
-			)
-			resp, err = client.WhoAuthorized(bCtx.Context, req)
-			if statusErr := errors.FromError(err); statusErr != nil {
-				if errors.IsServiceError(statusErr) {
-					return nil, statusErr
-				}
-				obj = ast.NewObject(ast.Item(ast.StringTerm("error"), utilities.BuildUserError(statusErr)))
-			} else {
-				obj = buildWhoAuthorizedObjectFromResponse(resp)
-			}
+	req.InputParams, err = parseInputParams(plugin, inputParams, 2)
+	if err != nil {
+		return nil, err
+	}
 
-			return &ast.Term{Value: obj}, nil
-		},
+	req.PolicyTags, err = parsePolicyTags(policyTags, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := resolveConnection(bCtx.Context, plugin, connection, nil, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	client, release, err := acquireAuthorizationClient(bCtx.Context, plugin, conn)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var (
+		resp *authorizationpb.WhoAuthorizedResponse
+		obj  ast.Object
 	)
+	call := startBuiltinCall(bCtx.Context, plugin, builtin, len(req.GetResources()),
+		resourceAttributes(req.GetResources())...)
+	resp, err = whoAuthorized(call.ctx, plugin, conn, builtin, client, req)
+	call.finish(resp.GetDecisionTime(), err)
+	explainCall(bCtx, plugin, builtin, req, resp, err)
+	if openErr, ok := asCircuitOpen(err); ok {
+		obj = circuitOpenWhoAuthorized(openErr, req)
+	} else if statusErr := errors.FromError(err); statusErr != nil {
+		if errors.IsServiceError(statusErr) {
+			return nil, statusErr
+		}
+		obj = ast.NewObject(ast.Item(ast.StringTerm("error"), utilities.BuildUserError(statusErr)))
+	} else {
+		obj = buildWhoAuthorizedObjectFromResponse(resp)
+	}
+
+	return &ast.Term{Value: obj}, nil
+}
+
+// whoAuthorized calls IndyKite, resources above the service limit are sent in multiple requests
+// and decisions are merged. Transient errors are retried according to plugin configuration.
+// While the circuit breaker is open, IndyKite is not called and circuitOpenError with outcome of builtin is returned.
+func whoAuthorized(
+	ctx context.Context,
+	plugin *plugins.IndyKitePlugin,
+	connection string,
+	builtin string,
+	client *authorization.Client,
+	req *authorizationpb.WhoAuthorizedRequest,
+) (*authorizationpb.WhoAuthorizedResponse, error) {
+	policy := currentRetryPolicy(plugin)
+	send := func(
+		ctx context.Context,
+		resources []*authorizationpb.WhoAuthorizedRequest_Resource,
+	) (*authorizationpb.WhoAuthorizedResponse, error) {
+		chunkReq := req
+		if len(resources) != len(req.GetResources()) {
+			chunkReq = &authorizationpb.WhoAuthorizedRequest{
+				Resources:   resources,
+				InputParams: req.GetInputParams(),
+				PolicyTags:  req.GetPolicyTags(),
+			}
+		}
+		return callWithRetry(ctx, builtin, policy, func(
+			ctx context.Context,
+		) (*authorizationpb.WhoAuthorizedResponse, error) {
+			return client.WhoAuthorized(ctx, chunkReq)
+		})
+	}
+	responses, err := callWithBreaker(ctx, currentCircuitBreaker(plugin, connection), builtin,
+		func() ([]*authorizationpb.WhoAuthorizedResponse, error) {
+			return callChunked(ctx, req.GetResources(), send)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return mergeWhoAuthorizedResponses(responses), nil
 }
 
 func buildWhoAuthorizedObjectFromResponse(resp *authorizationpb.WhoAuthorizedResponse) ast.Object {
@@ -133,20 +212,11 @@ func buildWhoAuthorizedObjectFromResponse(resp *authorizationpb.WhoAuthorizedRes
 }
 
 func parseWhoResources(term *ast.Term, pos int) ([]*authorizationpb.WhoAuthorizedRequest_Resource, error) {
-	resources, err := builtins.ArrayOperand(term.Value, pos)
-	if err != nil {
-		return nil, err
-	}
-	resp := make([]*authorizationpb.WhoAuthorizedRequest_Resource, resources.Len())
-	for i := 0; i < resources.Len(); i++ {
-		e := resources.Elem(i)
-		if v, ok := e.Value.(ast.Object); ok {
-			var res = &authorizationpb.WhoAuthorizedRequest_Resource{}
-			if err = protojson.Unmarshal(bytes.NewBufferString(v.String()).Bytes(), res); err != nil {
-				return nil, err
-			}
-			resp[i] = res
+	return parseResources(term, pos, func(f resourceFields) *authorizationpb.WhoAuthorizedRequest_Resource {
+		return &authorizationpb.WhoAuthorizedRequest_Resource{
+			ExternalId: f.externalID,
+			Type:       f.resourceType,
+			Actions:    f.actions,
 		}
-	}
-	return resp, nil
+	})
 }
@@ -17,6 +17,7 @@ package functions_test
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/indykite/indykite-sdk-go/authorization"
@@ -25,6 +26,7 @@ import (
 	authorizationm "github.com/indykite/indykite-sdk-go/test/authorization/v1beta1"
 	"github.com/open-policy-agent/opa/rego"
 	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -40,7 +42,7 @@ var _ = Describe("indy.who_authorized", func() {
 	var (
 		mockCtrl                *gomock.Controller
 		mockAuthorizationClient *authorizationm.MockAuthorizationAPIClient
-		oldConnection           *authorization.Client
+		ctx                     context.Context
 		idFn                    = func(subject interface{}) string {
 			switch r := subject.(type) {
 			case map[string]interface{}:
@@ -54,10 +56,7 @@ var _ = Describe("indy.who_authorized", func() {
 		mockCtrl = gomock.NewController(GinkgoT())
 		mockAuthorizationClient = authorizationm.NewMockAuthorizationAPIClient(mockCtrl)
 		client, _ := authorization.NewClientFromGRPCClient(mockAuthorizationClient)
-		oldConnection = functions.OverrideAuthorizationClient(client)
-	})
-	AfterEach(func() {
-		functions.OverrideAuthorizationClient(oldConnection)
+		ctx = functions.WithAuthorizationClient(context.Background(), client)
 	})
 	It("happy path", func() {
 		mockAuthorizationClient.EXPECT().WhoAuthorized(
@@ -102,7 +101,6 @@ var _ = Describe("indy.who_authorized", func() {
 		r := rego.New(rego.Query(
 			`x = indy.who_authorized([{"externalId": "res1", "type": "Type", "actions": ["READ"]},{"externalId": "res2", "type": "Type", "actions": ["READ"]}], {"string": {"string_value":"42"}, "integer": {"integer_value":42}, "double": {"double_value":4.2}, "boolean": {"bool_value":true}}, ["42"])`)) //nolint:lll
 
-		ctx := context.Background()
 		query, err := r.PrepareForEval(ctx)
 		Expect(err).To(Succeed())
 
@@ -134,7 +132,6 @@ var _ = Describe("indy.who_authorized", func() {
 	DescribeTable("Invalid input arguments - gRPC error",
 		func(regoParams string, errorMessage string, originMessage string) {
 			q := `x = indy.who_authorized(` + regoParams + `)`
-			ctx := context.Background()
 
 			r := rego.New(rego.Query(q))
 
@@ -159,7 +156,6 @@ var _ = Describe("indy.who_authorized", func() {
 			"unable to call WhoAuthorized client endpoint", "Resources: value must contain between 1 and 32 items"),
 	)
 	It("Service backend error", func() {
-		ctx := context.Background()
 		mockAuthorizationClient.EXPECT().
 			WhoAuthorized(gomock.Any(), gomock.Any()).
 			Times(2).
@@ -188,11 +184,60 @@ var _ = Describe("indy.who_authorized", func() {
 		Expect(rs).To(HaveLen(0))
 		Expect(err).To(Succeed())
 	})
+	It("Splits resources above service limit into multiple requests", func() {
+		var resources []string
+		for i := 0; i < 33; i++ {
+			resources = append(resources,
+				fmt.Sprintf(`{"externalId": "res%d", "type": "Type", "actions": ["READ"]}`, i))
+		}
+
+		respond := func(
+			_ context.Context,
+			req *authorizationpb.WhoAuthorizedRequest,
+			_ ...grpc.CallOption,
+		) (*authorizationpb.WhoAuthorizedResponse, error) {
+			resp := &authorizationpb.WhoAuthorizedResponse{
+				DecisionTime: timestamppb.New(time.Date(2022, 02, 22, 15, 18, 22, 0, time.UTC)),
+				Decisions: map[string]*authorizationpb.WhoAuthorizedResponse_ResourceType{
+					"Type": {Resources: map[string]*authorizationpb.WhoAuthorizedResponse_Resource{}},
+				},
+			}
+			for _, r := range req.GetResources() {
+				resp.Decisions["Type"].Resources[r.GetExternalId()] = &authorizationpb.WhoAuthorizedResponse_Resource{
+					Actions: map[string]*authorizationpb.WhoAuthorizedResponse_Action{
+						"READ": {Subjects: []*authorizationpb.WhoAuthorizedResponse_Subject{{ExternalId: "subA"}}},
+					},
+				}
+			}
+			return resp, nil
+		}
+		mockAuthorizationClient.EXPECT().WhoAuthorized(gomock.Any(), WrapMatcher(
+			HaveField("Resources", HaveLen(32)),
+		)).DoAndReturn(respond)
+		mockAuthorizationClient.EXPECT().WhoAuthorized(gomock.Any(), WrapMatcher(
+			HaveField("Resources", HaveLen(1)),
+		)).DoAndReturn(respond)
+
+		r := rego.New(rego.Query(`x = indy.who_authorized([` + strings.Join(resources, ",") + `], {}, [])`))
+
+		query, err := r.PrepareForEval(ctx)
+		Expect(err).To(Succeed())
+
+		rs, err := query.Eval(ctx)
+		Expect(err).To(Succeed())
+		Expect(rs[0].Bindings["x"]).To(MatchAllKeys(Keys{
+			"error":        BeNil(),
+			"decisionTime": BeEquivalentTo("1645543102"), // All numbers are json.Number ie string
+			"decisions": MatchAllKeys(Keys{
+				"Type": HaveLen(33),
+			}),
+		}))
+	})
+
 	It("Fail to create client", func() {
+		// Without plugin and client in context, client is created from environment variables.
 		ctx := context.Background()
 
-		functions.OverrideAuthorizationClient(nil)
-
 		// With StrictBuiltinErrors
 		r := rego.New(
 			rego.Query(`x = indy.who_authorized([{"externalId": "res1", "type": "Type", "actions": ["READ"]}], {}, [])`), //nolint:lll
@@ -249,7 +294,6 @@ var _ = Describe("indy.who_authorized", func() {
 			q := `x = indy.who_authorized([{"externalId": "res1", "type": "Type", "actions": ["READ"]}],` + regoOptions + `)` //nolint:lll
 			r := rego.New(rego.Query(q))
 
-			ctx := context.Background()
 			query, err := r.PrepareForEval(ctx)
 			Expect(err).To(Succeed())
 
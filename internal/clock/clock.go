@@ -0,0 +1,39 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package clock provides time source of decision caches, which tests of builtins can replace.
+package clock
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var current atomic.Pointer[func() time.Time]
+
+// Now returns current time of the replaced time source, or of the system clock.
+func Now() time.Time {
+	if now := current.Load(); now != nil {
+		return (*now)()
+	}
+	return time.Now()
+}
+
+// Set replaces time source until restore is called. It is meant for tests only.
+func Set(now func() time.Time) (restore func()) {
+	previous := current.Swap(&now)
+	return func() {
+		current.Store(previous)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerCooldown         = 30 * time.Second
+)
+
+// BreakerState is the state of the circuit breaker.
+type BreakerState string
+
+const (
+	// BreakerClosed lets all calls through.
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen short-circuits all calls until cool-down elapses.
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single probe call through to decide whether to close or open again.
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// Outcome modes of builtins while the circuit breaker is open.
+const (
+	// BreakerModeError returns the error object, same as for other user errors.
+	BreakerModeError = "error"
+	// BreakerModeDeny returns decisions with everything denied.
+	BreakerModeDeny = "deny"
+	// BreakerModeAllow returns allowed decisions for configured resource types, others are denied.
+	// Supported only by indy.is_authorized and indy.allowed.
+	BreakerModeAllow = "allow"
+)
+
+type (
+	// CircuitBreakerConfig defines circuit breaker around IndyKite calls.
+	CircuitBreakerConfig struct {
+		// IsAuthorized defines result of indy.is_authorized while breaker is open.
+		IsAuthorized *BreakerOutcome `json:"is_authorized,omitempty" yaml:"is_authorized,omitempty"`
+		// Allowed defines result of indy.allowed and indy.allowed_with_options while breaker is open.
+		// Defaults to IsAuthorized.
+		Allowed *BreakerOutcome `json:"allowed,omitempty" yaml:"allowed,omitempty"`
+		// WhatAuthorized defines result of indy.what_authorized while breaker is open.
+		WhatAuthorized *BreakerOutcome `json:"what_authorized,omitempty" yaml:"what_authorized,omitempty"`
+		// WhoAuthorized defines result of indy.who_authorized while breaker is open.
+		WhoAuthorized *BreakerOutcome `json:"who_authorized,omitempty" yaml:"who_authorized,omitempty"`
+		// FailureThreshold is the number of consecutive service errors which opens the breaker. Defaults to 5.
+		FailureThreshold int `json:"failure_threshold,omitempty" yaml:"failure_threshold,omitempty"`
+		// CooldownSeconds is how long breaker stays open before letting a probe call through. Defaults to 30.
+		CooldownSeconds int `json:"cooldown_seconds,omitempty" yaml:"cooldown_seconds,omitempty"`
+	}
+
+	// BreakerOutcome defines result of a builtin while the circuit breaker is open.
+	BreakerOutcome struct {
+		// Mode is one of error, deny or allow. Defaults to error.
+		Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+		// AllowResourceTypes lists resource types, which are allowed in allow mode.
+		AllowResourceTypes []string `json:"allow_resource_types,omitempty" yaml:"allow_resource_types,omitempty"`
+	}
+
+	// CircuitBreaker stops calling IndyKite after consecutive service errors.
+	CircuitBreaker struct {
+		openedAt      time.Time
+		now           func() time.Time
+		onStateChange func(BreakerState)
+		config        CircuitBreakerConfig
+		state         BreakerState
+		cooldown      time.Duration
+		threshold     int
+		failures      int
+		probing       bool
+		mtx           sync.Mutex
+	}
+)
+
+// Validate checks circuit breaker configuration.
+func (c *CircuitBreakerConfig) Validate() error {
+	if c.FailureThreshold < 0 || c.CooldownSeconds < 0 {
+		return fmt.Errorf("circuit_breaker: failure_threshold and cooldown_seconds must not be negative")
+	}
+	outcomes := []struct {
+		outcome    *BreakerOutcome
+		name       string
+		allowAllow bool
+	}{
+		{c.IsAuthorized, "is_authorized", true},
+		{c.Allowed, "allowed", true},
+		{c.WhatAuthorized, "what_authorized", false},
+		{c.WhoAuthorized, "who_authorized", false},
+	}
+	for _, o := range outcomes {
+		if o.outcome == nil {
+			continue
+		}
+		switch o.outcome.Mode {
+		case "", BreakerModeError, BreakerModeDeny:
+		case BreakerModeAllow:
+			if !o.allowAllow {
+				return fmt.Errorf("circuit_breaker: mode '%s' is not supported by %s", o.outcome.Mode, o.name)
+			}
+		default:
+			return fmt.Errorf("circuit_breaker: unknown mode '%s' of %s", o.outcome.Mode, o.name)
+		}
+	}
+	return nil
+}
+
+// NewCircuitBreaker creates circuit breaker from cfg. Returns nil when cfg is nil.
+// The onStateChange callback, if set, is called outside of internal lock on every state transition.
+func NewCircuitBreaker(cfg *CircuitBreakerConfig, onStateChange func(BreakerState)) *CircuitBreaker {
+	if cfg == nil {
+		return nil
+	}
+	threshold := cfg.FailureThreshold
+	if threshold == 0 {
+		threshold = defaultBreakerFailureThreshold
+	}
+	cooldown := time.Duration(cfg.CooldownSeconds) * time.Second
+	if cooldown == 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &CircuitBreaker{
+		now:           time.Now,
+		onStateChange: onStateChange,
+		config:        *cfg,
+		state:         BreakerClosed,
+		cooldown:      cooldown,
+		threshold:     threshold,
+	}
+}
+
+// State returns current state of the breaker.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.state
+}
+
+// Outcome returns configured outcome of builtin, like indy.is_authorized, while breaker is open.
+// Variants with connection name share outcome of the builtin.
+func (b *CircuitBreaker) Outcome(builtin string) BreakerOutcome {
+	var outcome *BreakerOutcome
+	switch strings.TrimSuffix(builtin, "_with_connection") {
+	case "indy.is_authorized":
+		outcome = b.config.IsAuthorized
+	case "indy.allowed", "indy.allowed_with_options":
+		if outcome = b.config.Allowed; outcome == nil {
+			outcome = b.config.IsAuthorized
+		}
+	case "indy.what_authorized":
+		outcome = b.config.WhatAuthorized
+	case "indy.who_authorized":
+		outcome = b.config.WhoAuthorized
+	}
+	if outcome == nil || outcome.Mode == "" {
+		return BreakerOutcome{Mode: BreakerModeError}
+	}
+	return *outcome
+}
+
+// Allow reports whether a call can be made and whether it is the probe call. After cool-down, a single probe
+// call is allowed. Both values must be passed to Success, Failure or Abandon, once the call finishes.
+func (b *CircuitBreaker) Allow() (allowed, probe bool) {
+	b.mtx.Lock()
+	switch b.state {
+	case BreakerClosed:
+		b.mtx.Unlock()
+		return true, false
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			b.mtx.Unlock()
+			return false, false
+		}
+		b.probing = true
+		b.setStateAndUnlock(BreakerHalfOpen)
+		return true, true
+	case BreakerHalfOpen:
+		if b.probing {
+			b.mtx.Unlock()
+			return false, false
+		}
+		b.probing = true
+		b.mtx.Unlock()
+		return true, true
+	}
+	b.mtx.Unlock()
+	return false, false
+}
+
+// Success records a call, which reached IndyKite, and closes the breaker. While the breaker is not closed,
+// only the probe call counts, other calls were allowed before it opened and tell nothing about recovery.
+func (b *CircuitBreaker) Success(probe bool) {
+	b.mtx.Lock()
+	if !probe && b.state != BreakerClosed {
+		b.mtx.Unlock()
+		return
+	}
+	b.failures = 0
+	b.probing = false
+	if b.state == BreakerClosed {
+		b.mtx.Unlock()
+		return
+	}
+	b.setStateAndUnlock(BreakerClosed)
+}
+
+// Failure records a service error. Opens the breaker after threshold is reached or when probe fails.
+// While the breaker is not closed, failures of other calls than the probe are ignored.
+func (b *CircuitBreaker) Failure(probe bool) {
+	b.mtx.Lock()
+	if !probe && b.state != BreakerClosed {
+		b.mtx.Unlock()
+		return
+	}
+	b.failures++
+	b.probing = false
+	if b.state == BreakerClosed && b.failures < b.threshold {
+		b.mtx.Unlock()
+		return
+	}
+	b.openedAt = b.now()
+	b.setStateAndUnlock(BreakerOpen)
+}
+
+// Abandon records a call, whose result tells nothing about IndyKite, like a call canceled by the caller.
+// State is not changed, but another probe call is allowed when the abandoned one was the probe.
+func (b *CircuitBreaker) Abandon(probe bool) {
+	if !probe {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.probing = false
+}
+
+func (b *CircuitBreaker) setStateAndUnlock(state BreakerState) {
+	b.state = state
+	onStateChange := b.onStateChange
+	b.mtx.Unlock()
+	if onStateChange != nil {
+		onStateChange(state)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins_test
+
+import (
+	"time"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CircuitBreaker", func() {
+	var (
+		breaker *plugins.CircuitBreaker
+		now     time.Time
+		states  []plugins.BreakerState
+	)
+
+	BeforeEach(func() {
+		now = time.Now()
+		states = nil
+		breaker = plugins.NewCircuitBreaker(&plugins.CircuitBreakerConfig{
+			FailureThreshold: 2,
+			CooldownSeconds:  10,
+		}, func(state plugins.BreakerState) {
+			states = append(states, state)
+		})
+		breaker.SetClock(func() time.Time { return now })
+	})
+
+	// allowProbe reports whether the call is allowed as the probe call.
+	allowProbe := func() bool {
+		allowed, probe := breaker.Allow()
+		return allowed && probe
+	}
+
+	It("Is disabled without config", func() {
+		Expect(plugins.NewCircuitBreaker(nil, nil)).To(BeNil())
+	})
+
+	It("Opens after consecutive failures", func() {
+		breaker.Failure(false)
+		breaker.Success(false)
+		breaker.Failure(false)
+		Expect(breaker.State()).To(Equal(plugins.BreakerClosed))
+		Expect(breaker.Allow()).To(BeTrue())
+
+		breaker.Failure(false)
+		Expect(breaker.State()).To(Equal(plugins.BreakerOpen))
+		Expect(breaker.Allow()).To(BeFalse())
+		Expect(states).To(Equal([]plugins.BreakerState{plugins.BreakerOpen}))
+	})
+
+	It("Lets a single probe through after cool-down", func() {
+		breaker.Failure(false)
+		breaker.Failure(false)
+
+		now = now.Add(10 * time.Second)
+		Expect(allowProbe()).To(BeTrue())
+		Expect(breaker.State()).To(Equal(plugins.BreakerHalfOpen))
+		Expect(breaker.Allow()).To(BeFalse())
+
+		breaker.Success(true)
+		Expect(breaker.State()).To(Equal(plugins.BreakerClosed))
+		Expect(breaker.Allow()).To(BeTrue())
+		Expect(states).To(Equal([]plugins.BreakerState{
+			plugins.BreakerOpen, plugins.BreakerHalfOpen, plugins.BreakerClosed,
+		}))
+	})
+
+	It("Opens again when probe fails", func() {
+		breaker.Failure(false)
+		breaker.Failure(false)
+
+		now = now.Add(10 * time.Second)
+		Expect(allowProbe()).To(BeTrue())
+		breaker.Failure(true)
+		Expect(breaker.State()).To(Equal(plugins.BreakerOpen))
+		Expect(breaker.Allow()).To(BeFalse())
+
+		now = now.Add(10 * time.Second)
+		Expect(allowProbe()).To(BeTrue())
+	})
+
+	It("Ignores calls allowed before the breaker opened", func() {
+		breaker.Failure(false)
+		breaker.Failure(false)
+		// Late outcomes of calls allowed while the breaker was closed.
+		breaker.Success(false)
+		Expect(breaker.State()).To(Equal(plugins.BreakerOpen))
+
+		now = now.Add(10 * time.Second)
+		Expect(allowProbe()).To(BeTrue())
+		breaker.Success(false)
+		breaker.Abandon(false)
+		Expect(breaker.State()).To(Equal(plugins.BreakerHalfOpen))
+		Expect(breaker.Allow()).To(BeFalse())
+		breaker.Failure(false)
+		Expect(breaker.State()).To(Equal(plugins.BreakerHalfOpen))
+
+		breaker.Success(true)
+		Expect(breaker.State()).To(Equal(plugins.BreakerClosed))
+	})
+
+	It("Returns configured outcome", func() {
+		breaker = plugins.NewCircuitBreaker(&plugins.CircuitBreakerConfig{
+			IsAuthorized:  &plugins.BreakerOutcome{Mode: "allow", AllowResourceTypes: []string{"Door"}},
+			WhoAuthorized: &plugins.BreakerOutcome{Mode: "deny"},
+		}, nil)
+		Expect(breaker.Outcome("indy.is_authorized")).To(Equal(plugins.BreakerOutcome{
+			Mode: "allow", AllowResourceTypes: []string{"Door"},
+		}))
+		Expect(breaker.Outcome("indy.who_authorized").Mode).To(Equal("deny"))
+		Expect(breaker.Outcome("indy.who_authorized_with_connection").Mode).To(Equal("deny"))
+		Expect(breaker.Outcome("indy.what_authorized").Mode).To(Equal("error"))
+		// Without own outcome, indy.allowed follows indy.is_authorized.
+		Expect(breaker.Outcome("indy.allowed_with_options").Mode).To(Equal("allow"))
+
+		breaker = plugins.NewCircuitBreaker(&plugins.CircuitBreakerConfig{
+			IsAuthorized: &plugins.BreakerOutcome{Mode: "allow", AllowResourceTypes: []string{"Door"}},
+			Allowed:      &plugins.BreakerOutcome{Mode: "deny"},
+		}, nil)
+		Expect(breaker.Outcome("indy.allowed").Mode).To(Equal("deny"))
+		Expect(breaker.Outcome("indy.allowed_with_options").Mode).To(Equal("deny"))
+		Expect(breaker.Outcome("indy.is_authorized_with_connection").Mode).To(Equal("allow"))
+	})
+
+	It("Allows another probe, when probe is abandoned", func() {
+		breaker.Failure(false)
+		breaker.Failure(false)
+
+		now = now.Add(10 * time.Second)
+		Expect(allowProbe()).To(BeTrue())
+		Expect(breaker.Allow()).To(BeFalse())
+		breaker.Abandon(true)
+		Expect(breaker.State()).To(Equal(plugins.BreakerHalfOpen))
+		Expect(allowProbe()).To(BeTrue())
+	})
+
+	DescribeTable("Validates config",
+		func(cfg plugins.CircuitBreakerConfig, errMsg string) {
+			err := cfg.Validate()
+			if errMsg == "" {
+				Expect(err).To(Succeed())
+			} else {
+				Expect(err).To(MatchError(ContainSubstring(errMsg)))
+			}
+		},
+		Entry("Empty", plugins.CircuitBreakerConfig{}, ""),
+		Entry("Allow is_authorized",
+			plugins.CircuitBreakerConfig{IsAuthorized: &plugins.BreakerOutcome{Mode: "allow"}}, ""),
+		Entry("Allow allowed",
+			plugins.CircuitBreakerConfig{Allowed: &plugins.BreakerOutcome{Mode: "allow"}}, ""),
+		Entry("Allow what_authorized",
+			plugins.CircuitBreakerConfig{WhatAuthorized: &plugins.BreakerOutcome{Mode: "allow"}},
+			"not supported by what_authorized"),
+		Entry("Unknown mode",
+			plugins.CircuitBreakerConfig{WhoAuthorized: &plugins.BreakerOutcome{Mode: "ignore"}},
+			"unknown mode 'ignore'"),
+		Entry("Negative threshold", plugins.CircuitBreakerConfig{FailureThreshold: -1}, "must not be negative"),
+	)
+})
@@ -0,0 +1,177 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/indykite/opa-indykite-plugin/internal/clock"
+)
+
+// defaultDecisionCacheTTL is used when decision cache is enabled without max_ttl_seconds.
+const defaultDecisionCacheTTL = time.Minute
+
+type (
+	// DecisionCacheConfig defines configuration of in-memory cache of indy.is_authorized decisions.
+	DecisionCacheConfig struct {
+		// MaxEntries is the maximum number of cached decisions. Cache is disabled when not positive.
+		MaxEntries int `json:"max_entries,omitempty" yaml:"max_entries,omitempty"`
+		// MaxTTLSeconds caps how long a decision is cached. IndyKite responses do not carry
+		// decision TTL yet, so every entry is kept for this duration. Defaults to 60 seconds.
+		MaxTTLSeconds int64 `json:"max_ttl_seconds,omitempty" yaml:"max_ttl_seconds,omitempty"`
+		// StaleIfErrorSeconds is the max age of a decision, which is returned when IndyKite is unavailable.
+		// Stale decisions are not returned when not positive. Stale decisions are kept by the cache,
+		// so it requires positive MaxEntries.
+		StaleIfErrorSeconds int64 `json:"stale_if_error_seconds,omitempty" yaml:"stale_if_error_seconds,omitempty"`
+	}
+
+	// DecisionCache is LRU cache of IsAuthorized responses keyed by canonical hash of the request.
+	DecisionCache struct {
+		now        func() time.Time
+		entries    map[string]*list.Element
+		lru        *list.List
+		maxEntries int
+		ttl        time.Duration
+		maxStale   time.Duration
+		mtx        sync.Mutex
+	}
+
+	decisionCacheEntry struct {
+		storedAt time.Time
+		resp     *authorizationpb.IsAuthorizedResponse
+		key      string
+	}
+)
+
+// Validate checks decision cache configuration.
+func (c *DecisionCacheConfig) Validate() error {
+	if c.StaleIfErrorSeconds > 0 && c.MaxEntries <= 0 {
+		return errors.New("decision_cache: stale_if_error_seconds requires positive max_entries, " +
+			"stale decisions are kept by the cache")
+	}
+	return nil
+}
+
+// NewDecisionCache creates decision cache from cfg. Returns nil when cache is not enabled.
+func NewDecisionCache(cfg *DecisionCacheConfig) *DecisionCache {
+	if cfg == nil || cfg.MaxEntries <= 0 {
+		return nil
+	}
+	ttl := time.Duration(cfg.MaxTTLSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = defaultDecisionCacheTTL
+	}
+	return &DecisionCache{
+		now:        clock.Now,
+		entries:    make(map[string]*list.Element, cfg.MaxEntries),
+		lru:        list.New(),
+		maxEntries: cfg.MaxEntries,
+		ttl:        ttl,
+		maxStale:   time.Duration(max(cfg.StaleIfErrorSeconds, 0)) * time.Second,
+	}
+}
+
+// DecisionCacheKey returns canonical hash of the request used as the decision cache key.
+func DecisionCacheKey(req *authorizationpb.IsAuthorizedRequest) (string, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Get returns cached response for key, if present and not expired.
+func (c *DecisionCache) Get(key string) (*authorizationpb.IsAuthorizedResponse, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*decisionCacheEntry)
+	age := c.now().Sub(entry.storedAt)
+	if age >= c.ttl {
+		if age >= c.maxStale {
+			c.removeElement(el)
+		}
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return entry.resp, true
+}
+
+// GetStale returns cached response for key, even when expired, if it is not older than
+// configured stale_if_error_seconds. It should be used only when IndyKite is unavailable.
+func (c *DecisionCache) GetStale(key string) (*authorizationpb.IsAuthorizedResponse, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*decisionCacheEntry)
+	age := c.now().Sub(entry.storedAt)
+	if age >= c.maxStale {
+		if age >= c.ttl {
+			c.removeElement(el)
+		}
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return entry.resp, true
+}
+
+// Set stores response under key and evicts the least recently used entry when cache is full.
+func (c *DecisionCache) Set(key string, resp *authorizationpb.IsAuthorizedResponse) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	storedAt := c.now()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*decisionCacheEntry)
+		entry.resp = resp
+		entry.storedAt = storedAt
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&decisionCacheEntry{key: key, resp: resp, storedAt: storedAt})
+	for c.lru.Len() > c.maxEntries {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// Len returns number of entries in the cache, including expired ones not yet evicted.
+func (c *DecisionCache) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.lru.Len()
+}
+
+func (c *DecisionCache) removeElement(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*decisionCacheEntry).key)
+}
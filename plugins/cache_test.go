@@ -0,0 +1,148 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins_test
+
+import (
+	"time"
+
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DecisionCache", func() {
+	var (
+		now   time.Time
+		cache *plugins.DecisionCache
+	)
+
+	BeforeEach(func() {
+		now = time.Date(2024, 9, 9, 21, 10, 0, 0, time.UTC)
+		cache = plugins.NewDecisionCache(&plugins.DecisionCacheConfig{MaxEntries: 2, MaxTTLSeconds: 30})
+		cache.SetClock(func() time.Time { return now })
+	})
+
+	It("Is disabled without max_entries", func() {
+		Expect(plugins.NewDecisionCache(nil)).To(BeNil())
+		Expect(plugins.NewDecisionCache(&plugins.DecisionCacheConfig{MaxTTLSeconds: 30})).To(BeNil())
+	})
+
+	It("Returns stored response until TTL expires", func() {
+		resp := &authorizationpb.IsAuthorizedResponse{DecisionTime: timestamppb.New(now)}
+		cache.Set("a", resp)
+
+		cached, ok := cache.Get("a")
+		Expect(ok).To(BeTrue())
+		Expect(cached).To(BeIdenticalTo(resp))
+
+		now = now.Add(29 * time.Second)
+		_, ok = cache.Get("a")
+		Expect(ok).To(BeTrue())
+
+		now = now.Add(time.Second)
+		_, ok = cache.Get("a")
+		Expect(ok).To(BeFalse())
+		Expect(cache.Len()).To(Equal(0))
+	})
+
+	It("Does not return stale response when stale-if-error is disabled", func() {
+		cache.Set("a", &authorizationpb.IsAuthorizedResponse{})
+		_, ok := cache.GetStale("a")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Returns stale response up to max staleness", func() {
+		cache = plugins.NewDecisionCache(&plugins.DecisionCacheConfig{
+			MaxEntries:          2,
+			MaxTTLSeconds:       30,
+			StaleIfErrorSeconds: 300,
+		})
+		cache.SetClock(func() time.Time { return now })
+		resp := &authorizationpb.IsAuthorizedResponse{DecisionTime: timestamppb.New(now)}
+		cache.Set("a", resp)
+
+		now = now.Add(time.Minute)
+		_, ok := cache.Get("a")
+		Expect(ok).To(BeFalse())
+		stale, ok := cache.GetStale("a")
+		Expect(ok).To(BeTrue())
+		Expect(stale).To(BeIdenticalTo(resp))
+
+		now = now.Add(4 * time.Minute)
+		_, ok = cache.GetStale("a")
+		Expect(ok).To(BeFalse())
+		Expect(cache.Len()).To(Equal(0))
+	})
+
+	It("Evicts least recently used entry", func() {
+		cache.Set("a", &authorizationpb.IsAuthorizedResponse{})
+		cache.Set("b", &authorizationpb.IsAuthorizedResponse{})
+		_, _ = cache.Get("a")
+		cache.Set("c", &authorizationpb.IsAuthorizedResponse{})
+
+		Expect(cache.Len()).To(Equal(2))
+		_, ok := cache.Get("b")
+		Expect(ok).To(BeFalse())
+		_, ok = cache.Get("a")
+		Expect(ok).To(BeTrue())
+		_, ok = cache.Get("c")
+		Expect(ok).To(BeTrue())
+	})
+
+	It("Computes same key for equal requests", func() {
+		newReq := func() *authorizationpb.IsAuthorizedRequest {
+			return &authorizationpb.IsAuthorizedRequest{
+				Subject: &authorizationpb.Subject{Subject: &authorizationpb.Subject_AccessToken{AccessToken: "token"}},
+				Resources: []*authorizationpb.IsAuthorizedRequest_Resource{
+					{ExternalId: "res1", Type: "Type", Actions: []string{"READ"}},
+				},
+				InputParams: map[string]*authorizationpb.InputParam{
+					"a": {Value: &authorizationpb.InputParam_StringValue{StringValue: "1"}},
+					"b": {Value: &authorizationpb.InputParam_BoolValue{BoolValue: true}},
+				},
+			}
+		}
+		key1, err := plugins.DecisionCacheKey(newReq())
+		Expect(err).To(Succeed())
+		key2, err := plugins.DecisionCacheKey(newReq())
+		Expect(err).To(Succeed())
+		Expect(key1).To(Equal(key2))
+
+		other := newReq()
+		other.Resources[0].Actions = []string{"WRITE"}
+		key3, err := plugins.DecisionCacheKey(other)
+		Expect(err).To(Succeed())
+		Expect(key3).NotTo(Equal(key1))
+	})
+
+	DescribeTable("Validates config",
+		func(cfg plugins.DecisionCacheConfig, errMsg string) {
+			err := cfg.Validate()
+			if errMsg == "" {
+				Expect(err).To(Succeed())
+			} else {
+				Expect(err).To(MatchError(ContainSubstring(errMsg)))
+			}
+		},
+		Entry("Empty", plugins.DecisionCacheConfig{}, ""),
+		Entry("Stale if error", plugins.DecisionCacheConfig{MaxEntries: 10, StaleIfErrorSeconds: 300}, ""),
+		Entry("Stale if error without cache", plugins.DecisionCacheConfig{StaleIfErrorSeconds: 300},
+			"stale_if_error_seconds requires positive max_entries"),
+	)
+})
@@ -0,0 +1,116 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/indykite/indykite-sdk-go/authorization"
+	api "github.com/indykite/indykite-sdk-go/grpc"
+	"github.com/indykite/indykite-sdk-go/grpc/config"
+	"github.com/open-policy-agent/opa/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// connectTimeout limits how long new connection to IndyKite may take to become ready, tests shorten it.
+var connectTimeout = 5 * time.Second
+
+// dialOptions are added to options of every IndyKite connection, tests use them to trust test server.
+var dialOptions []api.ClientOption
+
+// errMissingCredentials is returned when neither credentials nor environment variables are configured.
+var errMissingCredentials = errors.New("missing IndyKite credentials, set app_agent_id, endpoint " +
+	"and private key or enable use_env_variables")
+
+// clientHandle wraps authorization client and tracks calls which are currently using it.
+// Handle is retired on credential rotation and the connection is closed once all calls finish.
+type clientHandle struct {
+	client *authorization.Client
+	// conn is nil for clients, which are not dialed by the plugin.
+	conn     *grpc.ClientConn
+	inFlight sync.WaitGroup
+}
+
+// closeWhenIdle waits for in-flight calls and closes the underlying connection.
+func (h *clientHandle) closeWhenIdle(logger logging.Logger) {
+	h.inFlight.Wait()
+	if err := h.client.Close(); err != nil {
+		logger.Warn("Failed to close IndyKite connection: %v", err)
+	}
+}
+
+// waitReady starts connecting and waits until the connection is ready. Returns error when connecting fails
+// or takes longer than timeout.
+func (h *clientHandle) waitReady(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	h.conn.Connect()
+	for {
+		state := h.conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return errUnreachable(state)
+		case connectivity.Idle, connectivity.Connecting:
+		}
+		if !h.conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("IndyKite is not reachable, connection is not ready after %s", timeout)
+		}
+	}
+}
+
+// errUnreachable returns error reported when connection to IndyKite is in state.
+func errUnreachable(state connectivity.State) error {
+	return fmt.Errorf("IndyKite is not reachable, connection is in state %s", state)
+}
+
+// newClientHandle dials IndyKite with credentials in cfg, or from environment variables when UseEnvVariables
+// is set. The connection is established lazily, see waitReady.
+func newClientHandle(ctx context.Context, cfg *ConnectionConfig) (*clientHandle, error) {
+	var loader config.CredentialsLoader
+	switch {
+	case cfg.UseEnvVariables:
+		loader = config.DefaultEnvironmentLoader
+	case cfg.credConfig != nil:
+		loader = config.StaticCredentialConfig(cfg.credConfig)
+	default:
+		return nil, errMissingCredentials
+	}
+
+	// Dial options are the same as defaults of authorization.NewClient, which are not applied
+	// to connection passed to it.
+	pool, _, err := api.DialPool(ctx, append([]api.ClientOption{
+		api.WithGRPCDialOption(grpc.WithDisableServiceConfig()),
+		api.WithGRPCDialOption(grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(math.MaxInt32))),
+		api.WithCredentialsLoader(loader),
+	}, dialOptions...)...)
+	if err != nil {
+		return nil, err
+	}
+	conn := pool.Conn()
+	client, err := authorization.NewClient(ctx, api.WithGRPCConn(conn))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &clientHandle{client: client, conn: conn}, nil
+}
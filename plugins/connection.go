@@ -0,0 +1,205 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/indykite/indykite-sdk-go/grpc/config"
+	"github.com/open-policy-agent/opa/plugins"
+)
+
+// DefaultConnectionName is name of the connection defined by top level credentials of the plugin.
+const DefaultConnectionName = "default"
+
+type (
+	// ConnectionConfig defines credentials of named IndyKite connection.
+	// Credentials use the same keys as top level credentials of the plugin.
+	ConnectionConfig struct {
+		credConfig *config.CredentialsConfig `yaml:"-"`
+
+		UseEnvVariables bool `json:"use_env_variables,omitempty" yaml:"use_env_variables,omitempty"`
+	}
+
+	// connection is state of single IndyKite connection of the plugin.
+	connection struct {
+		// client is nil, when connection is not established.
+		client *clientHandle
+		err    error
+		// unreachable is set, while connection of client is not ready.
+		unreachable error
+		breaker     *CircuitBreaker
+	}
+
+	// ConnectionReleaseHook is called when the named connection of plugin is no longer used,
+	// so state kept for it outside of the plugin can be dropped.
+	ConnectionReleaseHook func(p *IndyKitePlugin, connection string)
+)
+
+var (
+	releaseHooksMtx sync.RWMutex
+	releaseHooks    []ConnectionReleaseHook
+)
+
+// RegisterConnectionReleaseHook adds hook called when connection is removed by Reconfigure,
+// and for all connections of plugin when it is stopped or unregistered.
+func RegisterConnectionReleaseHook(hook ConnectionReleaseHook) {
+	releaseHooksMtx.Lock()
+	defer releaseHooksMtx.Unlock()
+	releaseHooks = append(releaseHooks, hook)
+}
+
+// releaseConnections calls registered hooks for each of the named connections of p.
+func (p *IndyKitePlugin) releaseConnections(names ...string) {
+	releaseHooksMtx.RLock()
+	defer releaseHooksMtx.RUnlock()
+	for _, name := range names {
+		for _, hook := range releaseHooks {
+			hook(p, name)
+		}
+	}
+}
+
+// connectionConfigs returns all connections of cfg by name. Top level credentials define connection
+// named DefaultConnectionName. Without any credentials, the default connection falls back
+// to environment variables, as builtins do without plugin.
+func (c *Config) connectionConfigs() map[string]*ConnectionConfig {
+	conns := make(map[string]*ConnectionConfig, len(c.Connections)+1)
+	for name, conn := range c.Connections {
+		conns[name] = conn
+	}
+	switch {
+	case c.UseEnvVariables || c.credConfig != nil:
+		conns[DefaultConnectionName] = &ConnectionConfig{credConfig: c.credConfig, UseEnvVariables: c.UseEnvVariables}
+	case len(conns) == 0:
+		conns[DefaultConnectionName] = &ConnectionConfig{UseEnvVariables: true}
+	}
+	return conns
+}
+
+// defaultConnection returns name of the connection used by builtins without connection name,
+// or empty string when there is none.
+func (c *Config) defaultConnection() string {
+	if c.DefaultConnection != "" {
+		return c.DefaultConnection
+	}
+	conns := c.connectionConfigs()
+	if _, ok := conns[DefaultConnectionName]; ok {
+		return DefaultConnectionName
+	}
+	if len(conns) == 1 {
+		for name := range conns {
+			return name
+		}
+	}
+	return ""
+}
+
+// validateConnections checks named connections, the default connection name and routes.
+func (c *Config) validateConnections() error {
+	for name, conn := range c.Connections {
+		if name == "" || conn == nil {
+			return fmt.Errorf("connections: connection %q must have a name and credentials", name)
+		}
+		if name == DefaultConnectionName && (c.UseEnvVariables || c.credConfig != nil) {
+			return fmt.Errorf("connections: connection %q is defined by top level credentials", name)
+		}
+	}
+	if c.DefaultConnection != "" {
+		if _, ok := c.connectionConfigs()[c.DefaultConnection]; !ok {
+			return fmt.Errorf("default_connection: unknown connection %q", c.DefaultConnection)
+		}
+	}
+	if c.Routing != nil {
+		if err := c.Routing.Validate(c.connectionConfigs()); err != nil {
+			return fmt.Errorf("routing: %w", err)
+		}
+	}
+	return nil
+}
+
+// connectionChanged reports if connection must be re-created when switching from oldCfg to newCfg.
+func connectionChanged(oldCfg, newCfg *ConnectionConfig) bool {
+	if oldCfg == nil || newCfg == nil {
+		return oldCfg != newCfg
+	}
+	return oldCfg.UseEnvVariables != newCfg.UseEnvVariables ||
+		!reflect.DeepEqual(oldCfg.credConfig, newCfg.credConfig)
+}
+
+// status returns health of the connection.
+func (c *connection) status() *plugins.Status {
+	if c.client == nil {
+		msg := "not connected to IndyKite"
+		if c.err != nil {
+			msg = "failed to connect to IndyKite: " + c.err.Error()
+		}
+		return &plugins.Status{State: plugins.StateErr, Message: msg}
+	}
+	if c.unreachable != nil {
+		return &plugins.Status{State: plugins.StateErr, Message: c.unreachable.Error()}
+	}
+	if c.err != nil {
+		// Connection with rotated credentials failed, so the previous one is still used.
+		return &plugins.Status{
+			State:   plugins.StateWarn,
+			Message: "failed to rotate IndyKite credentials, previous connection is used: " + c.err.Error(),
+		}
+	}
+	return connectedStatus(c.breaker)
+}
+
+// aggregateStatus returns plugin status from statuses of all connections. Plugin is in error state
+// only when no connection works. Messages of unhealthy connections are prefixed with connection name,
+// unless there is only one connection.
+func aggregateStatus(statuses map[string]*plugins.Status) *plugins.Status {
+	names := make([]string, 0, len(statuses))
+	for name := range statuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		messages []string
+		failed   int
+	)
+	for _, name := range names {
+		s := statuses[name]
+		if s.State == plugins.StateErr {
+			failed++
+		}
+		if s.State == plugins.StateOK {
+			continue
+		}
+		if len(statuses) == 1 {
+			messages = append(messages, s.Message)
+		} else {
+			messages = append(messages, "connection "+name+": "+s.Message)
+		}
+	}
+
+	result := &plugins.Status{State: plugins.StateOK, Message: strings.Join(messages, "; ")}
+	switch {
+	case len(statuses) > 0 && failed == len(statuses):
+		result.State = plugins.StateErr
+	case len(messages) > 0:
+		result.State = plugins.StateWarn
+	}
+	return result
+}
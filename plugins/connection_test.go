@@ -0,0 +1,364 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/indykite/indykite-sdk-go/authorization"
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	api "github.com/indykite/indykite-sdk-go/grpc"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	opaplugins "github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Connections", func() {
+	newPlugin := func(config string) (*plugins.IndyKitePlugin, *opaplugins.Manager, error) {
+		manager, err := opaplugins.New([]byte(`{}`), "connections", inmem.New())
+		Expect(err).To(Succeed())
+		plugin, err := plugins.NewPlugin(manager, []byte(config))
+		if err == nil {
+			DeferCleanup(plugin.Stop, context.Background())
+		}
+		return plugin, manager, err
+	}
+
+	DescribeTable("Validates connections",
+		func(config string, errMatcher OmegaMatcher) {
+			_, _, err := newPlugin(config)
+			Expect(err).To(errMatcher)
+		},
+		Entry("Named connections", `{"connections": {"eu": {"endpoint": "eu.example.com"},
+			"us": {"use_env_variables": true}}, "default_connection": "eu"}`, Succeed()),
+		Entry("Default connection of top level credentials", `{"endpoint": "example.com",
+			"connections": {"eu": {"endpoint": "eu.example.com"}}, "default_connection": "default"}`, Succeed()),
+		Entry("Unknown default connection", `{"connections": {"eu": {"endpoint": "eu.example.com"}},
+			"default_connection": "us"}`, MatchError(ContainSubstring(`unknown connection "us"`))),
+		Entry("Default connection redefined", `{"use_env_variables": true,
+			"connections": {"default": {"endpoint": "example.com"}}}`,
+			MatchError(ContainSubstring(`connection "default" is defined by top level credentials`))),
+		Entry("Route to unknown connection", `{"connections": {"eu": {"endpoint": "eu.example.com"}},
+			"routing": {"routes": {"https://us.example.com": "us"}}}`,
+			MatchError(ContainSubstring(`routing: route "https://us.example.com": unknown connection "us"`))),
+		Entry("Connection without credentials", `{"connections": {"eu": null}}`,
+			MatchError(ContainSubstring(`connection "eu" must have a name and credentials`))),
+	)
+
+	DescribeTable("Selects default connection",
+		func(config string, name string) {
+			plugin, _, err := newPlugin(config)
+			Expect(err).To(Succeed())
+			Expect(plugin.DefaultConnection()).To(Equal(name))
+		},
+		Entry("Top level credentials", `{"endpoint": "example.com",
+			"connections": {"eu": {"endpoint": "eu.example.com"}}}`, plugins.DefaultConnectionName),
+		Entry("Without any credentials", `{}`, plugins.DefaultConnectionName),
+		Entry("The only named connection", `{"connections": {"eu": {"endpoint": "eu.example.com"}}}`, "eu"),
+		Entry("Configured connection", `{"connections": {"eu": {"endpoint": "eu.example.com"},
+			"us": {"endpoint": "us.example.com"}}, "default_connection": "us"}`, "us"),
+		Entry("None of multiple named connections", `{"connections": {"eu": {"endpoint": "eu.example.com"},
+			"us": {"endpoint": "us.example.com"}}}`, ""),
+	)
+
+	It("Reports health of each connection", func() {
+		plugin, manager, err := newPlugin(`{"connections": {"eu": {}, "us": {}}}`)
+		Expect(err).To(Succeed())
+		Expect(plugin.HasConnection("eu")).To(BeTrue())
+		Expect(plugin.HasConnection(plugins.DefaultConnectionName)).To(BeFalse())
+
+		Expect(plugin.Start(context.Background())).To(Succeed())
+
+		statuses := plugin.ConnectionStatus()
+		Expect(statuses).To(HaveLen(2))
+		Expect(statuses).To(HaveKeyWithValue("eu", HaveField("State", opaplugins.StateErr)))
+		Expect(statuses["us"].Message).To(ContainSubstring("missing IndyKite credentials"))
+		Expect(manager.PluginStatus()[plugins.PluginName]).To(And(
+			HaveField("State", opaplugins.StateErr),
+			HaveField("Message", And(
+				ContainSubstring("connection eu: failed to connect"),
+				ContainSubstring("connection us: failed to connect"),
+			)),
+		))
+
+		client, release := plugin.AcquireConnectionClient("eu")
+		defer release()
+		Expect(client).To(BeNil())
+	})
+
+	It("Applies connections on reconfiguration", func() {
+		plugin, manager, err := newPlugin(`{"connections": {"eu": {}, "us": {}}}`)
+		Expect(err).To(Succeed())
+		Expect(plugin.Start(context.Background())).To(Succeed())
+
+		cfg, err := plugins.ValidateConfig(manager, []byte(`{"connections": {"us": {}, "ap": {}}}`))
+		Expect(err).To(Succeed())
+		plugin.Reconfigure(context.Background(), cfg)
+
+		Expect(plugin.HasConnection("eu")).To(BeFalse())
+		Expect(plugin.ConnectionStatus()).To(And(HaveKey("us"), HaveKey("ap"), Not(HaveKey("eu"))))
+	})
+
+	Context("Lifecycle", func() {
+		var (
+			privateKeyJWK []byte
+			serverCreds   credentials.TransportCredentials
+		)
+
+		BeforeEach(func() {
+			certificate, roots := selfSignedCertificate()
+			serverCreds = credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{certificate}})
+			plugins.SetDialOptions(api.WithGRPCDialOption(
+				grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots}))))
+			DeferCleanup(plugins.SetDialOptions)
+
+			privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).To(Succeed())
+			key, err := jwk.FromRaw(privateKey)
+			Expect(err).To(Succeed())
+			Expect(key.Set(jwk.KeyIDKey, "key")).To(Succeed())
+			Expect(key.Set(jwk.AlgorithmKey, jwa.ES256)).To(Succeed())
+			privateKeyJWK, err = json.Marshal(key)
+			Expect(err).To(Succeed())
+		})
+
+		credentialsConfig := func(endpoint, appAgentID string) string {
+			return fmt.Sprintf(`{"endpoint": %q, "app_agent_id": %q, "private_key_jwk": %s}`,
+				endpoint, appAgentID, privateKeyJWK)
+		}
+
+		serve := func(lis net.Listener) {
+			server := grpc.NewServer(grpc.Creds(serverCreds))
+			go func() { _ = server.Serve(lis) }()
+			DeferCleanup(server.Stop)
+		}
+		pluginState := func(manager *opaplugins.Manager) func() opaplugins.State {
+			return func() opaplugins.State {
+				return manager.PluginStatus()[plugins.PluginName].State
+			}
+		}
+
+		It("Reports started plugin connected to reachable IndyKite until it is stopped", func() {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).To(Succeed())
+			serve(lis)
+			plugin, manager, err := newPlugin(credentialsConfig(lis.Addr().String(), "agent"))
+			Expect(err).To(Succeed())
+			Expect(pluginState(manager)()).To(Equal(opaplugins.StateNotReady))
+
+			Expect(plugin.Start(context.Background())).To(Succeed())
+			Expect(manager.PluginStatus()[plugins.PluginName]).To(Equal(&opaplugins.Status{State: opaplugins.StateOK}))
+			client, release := plugin.AcquireAuthorizationClient()
+			Expect(client).NotTo(BeNil())
+			release()
+
+			plugin.Stop(context.Background())
+			Expect(pluginState(manager)()).To(Equal(opaplugins.StateNotReady))
+			client, release = plugin.AcquireAuthorizationClient()
+			defer release()
+			Expect(client).To(BeNil())
+		})
+
+		It("Connects with environment variables when no credentials are configured", func() {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).To(Succeed())
+			serve(lis)
+			GinkgoT().Setenv("INDYKITE_APPLICATION_CREDENTIALS", fmt.Sprintf(
+				`{"endpoint": %q, "appAgentId": "agent", "privateKeyJWK": %s}`, lis.Addr().String(), privateKeyJWK))
+			plugin, manager, err := newPlugin(`{}`)
+			Expect(err).To(Succeed())
+
+			Expect(plugin.Start(context.Background())).To(Succeed())
+			Expect(manager.PluginStatus()[plugins.PluginName]).To(Equal(&opaplugins.Status{State: opaplugins.StateOK}))
+			client, release := plugin.AcquireAuthorizationClient()
+			defer release()
+			Expect(client).NotTo(BeNil())
+		})
+
+		It("Keeps acquired client open on credential rotation until it is released", func() {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).To(Succeed())
+			serve(lis)
+			plugin, manager, err := newPlugin(credentialsConfig(lis.Addr().String(), "agent"))
+			Expect(err).To(Succeed())
+			Expect(plugin.Start(context.Background())).To(Succeed())
+
+			// Test server has no services, so call on open connection fails as unimplemented.
+			call := func(client *authorization.Client) error {
+				_, err := client.IsAuthorized(context.Background(),
+					&authorizationpb.DigitalTwin{Id: "gid:AAAAFezuHYVk80pJpoZWFJCKOGo"},
+					[]*authorizationpb.IsAuthorizedRequest_Resource{
+						{ExternalId: "res1", Type: "Type", Actions: []string{"READ"}},
+					}, nil, nil)
+				return err
+			}
+
+			oldClient, release := plugin.AcquireAuthorizationClient()
+			Expect(oldClient).NotTo(BeNil())
+
+			cfg, err := plugins.ValidateConfig(manager, []byte(credentialsConfig(lis.Addr().String(), "rotated")))
+			Expect(err).To(Succeed())
+			plugin.Reconfigure(context.Background(), cfg)
+
+			newClient, newRelease := plugin.AcquireAuthorizationClient()
+			defer newRelease()
+			Expect(newClient).NotTo(BeNil())
+			Expect(newClient).NotTo(BeIdenticalTo(oldClient))
+			Expect(call(newClient)).To(MatchError(ContainSubstring("Unimplemented")))
+
+			Consistently(func() error { return call(oldClient) }).WithTimeout(200 * time.Millisecond).
+				Should(MatchError(ContainSubstring("Unimplemented")))
+			release()
+			Eventually(func() error { return call(oldClient) }).
+				Should(MatchError(ContainSubstring("the client connection is closing")))
+			Expect(call(newClient)).To(MatchError(ContainSubstring("Unimplemented")))
+		})
+
+		It("Waits for unreachable connections concurrently", func() {
+			DeferCleanup(plugins.SetConnectTimeout(500 * time.Millisecond))
+			// Listener which never accepts keeps connections waiting for TLS handshake until timeout.
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).To(Succeed())
+			DeferCleanup(lis.Close)
+			creds := credentialsConfig(lis.Addr().String(), "agent")
+			plugin, manager, err := newPlugin(fmt.Sprintf(`{"connections": {"eu": %s, "us": %s, "asia": %s}}`,
+				creds, creds, creds))
+			Expect(err).To(Succeed())
+
+			start := time.Now()
+			Expect(plugin.Start(context.Background())).To(Succeed())
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(pluginState(manager)()).To(Equal(opaplugins.StateErr))
+		})
+
+		It("Reports failed credential rotation and keeps previous client", func() {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).To(Succeed())
+			serve(lis)
+			plugin, manager, err := newPlugin(credentialsConfig(lis.Addr().String(), "agent"))
+			Expect(err).To(Succeed())
+			Expect(plugin.Start(context.Background())).To(Succeed())
+			oldClient, release := plugin.AcquireAuthorizationClient()
+			release()
+
+			cfg, err := plugins.ValidateConfig(manager, []byte(fmt.Sprintf(
+				`{"endpoint": %q, "app_agent_id": "rotated", "private_key_jwk": {"kty": "oct"}}`, lis.Addr().String())))
+			Expect(err).To(Succeed())
+			plugin.Reconfigure(context.Background(), cfg)
+
+			Expect(manager.PluginStatus()[plugins.PluginName]).To(And(
+				HaveField("State", opaplugins.StateWarn),
+				HaveField("Message", HavePrefix("failed to rotate IndyKite credentials, previous connection is used")),
+			))
+			client, release := plugin.AcquireAuthorizationClient()
+			release()
+			Expect(client).To(BeIdenticalTo(oldClient))
+
+			cfg, err = plugins.ValidateConfig(manager, []byte(credentialsConfig(lis.Addr().String(), "rotated")))
+			Expect(err).To(Succeed())
+			plugin.Reconfigure(context.Background(), cfg)
+			Expect(manager.PluginStatus()[plugins.PluginName]).To(Equal(&opaplugins.Status{State: opaplugins.StateOK}))
+		})
+
+		It("Reports unreachable IndyKite until connection is ready", func() {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).To(Succeed())
+			addr := lis.Addr().String()
+			Expect(lis.Close()).To(Succeed())
+			plugin, manager, err := newPlugin(credentialsConfig(addr, "agent"))
+			Expect(err).To(Succeed())
+
+			Expect(plugin.Start(context.Background())).To(Succeed())
+			Expect(manager.PluginStatus()[plugins.PluginName]).To(Equal(&opaplugins.Status{
+				State:   opaplugins.StateErr,
+				Message: "IndyKite is not reachable, connection is in state TRANSIENT_FAILURE",
+			}))
+			// Client is kept, so calls succeed once IndyKite is reachable again.
+			client, release := plugin.AcquireAuthorizationClient()
+			release()
+			Expect(client).NotTo(BeNil())
+
+			lis, err = net.Listen("tcp", addr)
+			Expect(err).To(Succeed())
+			serve(lis)
+			Eventually(pluginState(manager)).WithTimeout(10 * time.Second).Should(Equal(opaplugins.StateOK))
+		})
+	})
+
+	DescribeTable("Aggregates connection statuses",
+		func(statuses map[string]*opaplugins.Status, expected *opaplugins.Status) {
+			Expect(plugins.AggregateStatus(statuses)).To(Equal(expected))
+		},
+		Entry("Single healthy connection",
+			map[string]*opaplugins.Status{"default": {State: opaplugins.StateOK}},
+			&opaplugins.Status{State: opaplugins.StateOK}),
+		Entry("Single failed connection",
+			map[string]*opaplugins.Status{"default": {State: opaplugins.StateErr, Message: "failed"}},
+			&opaplugins.Status{State: opaplugins.StateErr, Message: "failed"}),
+		Entry("Some connections failed",
+			map[string]*opaplugins.Status{
+				"us": {State: opaplugins.StateErr, Message: "failed"},
+				"eu": {State: opaplugins.StateOK},
+				"ap": {State: opaplugins.StateWarn, Message: "circuit breaker is open"},
+			},
+			&opaplugins.Status{
+				State:   opaplugins.StateWarn,
+				Message: "connection ap: circuit breaker is open; connection us: failed",
+			}),
+		Entry("All connections failed",
+			map[string]*opaplugins.Status{
+				"us": {State: opaplugins.StateErr, Message: "failed"},
+				"eu": {State: opaplugins.StateErr, Message: "timeout"},
+			},
+			&opaplugins.Status{State: opaplugins.StateErr, Message: "connection eu: timeout; connection us: failed"}),
+	)
+})
+
+// selfSignedCertificate returns TLS certificate of 127.0.0.1 and pool trusting it.
+func selfSignedCertificate() (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(Succeed())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).To(Succeed())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).To(Succeed())
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
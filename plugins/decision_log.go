@@ -0,0 +1,359 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	json "github.com/json-iterator/go"
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/plugins/logs"
+)
+
+const (
+	// ConsoleSinkName is the name of the default decision log sink, which writes events to stdout.
+	ConsoleSinkName = "console"
+
+	defaultDecisionLogBufferSize    = 10000
+	defaultDecisionLogBatchSize     = 100
+	defaultDecisionLogFlushInterval = time.Second
+)
+
+var (
+	sinkFactoriesMtx sync.RWMutex
+	sinkFactories    = map[string]DecisionLogSinkFactory{
+		ConsoleSinkName: func(*DecisionLogsConfig) (DecisionLogSink, error) {
+			return &writerSink{w: os.Stdout}, nil
+		},
+	}
+)
+
+type (
+	// DecisionLogsConfig defines how decision log events are buffered and where they are written.
+	DecisionLogsConfig struct {
+		// Sink is the name of registered sink. Defaults to console.
+		Sink string `json:"sink,omitempty" yaml:"sink,omitempty"`
+		// BufferSize is the max number of buffered events. When full, the oldest events are dropped.
+		// Defaults to 10000.
+		BufferSize int `json:"buffer_size,omitempty" yaml:"buffer_size,omitempty"`
+		// BatchSize is the max number of events written to the sink at once. Defaults to 100.
+		BatchSize int `json:"batch_size,omitempty" yaml:"batch_size,omitempty"`
+		// FlushIntervalMillis is how often buffered events are written, even when batch is not full.
+		// Defaults to 1s.
+		FlushIntervalMillis int `json:"flush_interval_ms,omitempty" yaml:"flush_interval_ms,omitempty"`
+		// File configures the file sink.
+		File *FileSinkConfig `json:"file,omitempty" yaml:"file,omitempty"`
+		// Redaction defines masking of sensitive values. Tokens are masked even without it.
+		Redaction *RedactionConfig `json:"redaction,omitempty" yaml:"redaction,omitempty"`
+	}
+
+	// DecisionLogSink writes batches of JSON encoded decision log events.
+	// Calls are never concurrent.
+	DecisionLogSink interface {
+		WriteBatch(ctx context.Context, events [][]byte) error
+		Close() error
+	}
+
+	// DecisionLogSinkFactory creates decision log sink from configuration.
+	DecisionLogSinkFactory func(cfg *DecisionLogsConfig) (DecisionLogSink, error)
+
+	// loggingSink is implemented by sinks, which log errors of their background work.
+	loggingSink interface {
+		setLogger(logger logging.Logger)
+	}
+
+	// decisionLogger buffers encoded events and writes them to the sink in batches from background goroutine.
+	decisionLogger struct {
+		sink       DecisionLogSink
+		logger     logging.Logger
+		redactor   *Redactor
+		flushCh    chan struct{}
+		done       chan struct{}
+		stopped    chan struct{}
+		buffer     [][]byte
+		dropped    atomic.Uint64
+		reported   uint64
+		started    atomic.Bool
+		interval   time.Duration
+		bufferSize int
+		batchSize  int
+		mtx        sync.Mutex
+		stopOnce   sync.Once
+		// next receives events logged after stop, they are rejected when it is nil.
+		next   *decisionLogger
+		closed bool
+	}
+
+	// decisionLogEvent is the logged event extended with IndyKite calls made during evaluation.
+	decisionLogEvent struct {
+		logs.EventV1
+		IndyKiteCalls []CallRecord `json:"indykite_calls,omitempty"`
+	}
+
+	// writerSink writes events as JSON lines.
+	writerSink struct {
+		w io.Writer
+	}
+
+	// failedSink rejects all events with error, which prevented creating the real sink.
+	failedSink struct {
+		err error
+	}
+)
+
+// RegisterDecisionLogSink makes decision log sink available by name in plugin configuration.
+// Registering the same name twice replaces the previous factory.
+func RegisterDecisionLogSink(name string, factory DecisionLogSinkFactory) {
+	sinkFactoriesMtx.Lock()
+	defer sinkFactoriesMtx.Unlock()
+	sinkFactories[name] = factory
+}
+
+func sinkFactory(name string) (DecisionLogSinkFactory, bool) {
+	sinkFactoriesMtx.RLock()
+	defer sinkFactoriesMtx.RUnlock()
+	factory, ok := sinkFactories[name]
+	return factory, ok
+}
+
+// SinkName returns configured sink name with default applied.
+func (c *DecisionLogsConfig) SinkName() string {
+	if c == nil || c.Sink == "" {
+		return ConsoleSinkName
+	}
+	return c.Sink
+}
+
+// Validate checks decision logs configuration.
+func (c *DecisionLogsConfig) Validate() error {
+	if c.BufferSize < 0 || c.BatchSize < 0 || c.FlushIntervalMillis < 0 {
+		return fmt.Errorf("decision_logs: buffer_size, batch_size and flush_interval_ms must not be negative")
+	}
+	if _, ok := sinkFactory(c.SinkName()); !ok {
+		return fmt.Errorf("decision_logs: unknown sink '%s'", c.SinkName())
+	}
+	if c.Redaction != nil {
+		if err := c.Redaction.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.SinkName() == FileSinkName {
+		if c.File == nil {
+			return fmt.Errorf("decision_logs: file sink requires file configuration")
+		}
+		return c.File.Validate()
+	}
+	return nil
+}
+
+// newDecisionLogger creates decision logger with sink from cfg. Nil cfg means defaults.
+// Events are not written until start is called.
+func newDecisionLogger(cfg *DecisionLogsConfig, logger logging.Logger) (*decisionLogger, error) {
+	sink, err := newDecisionLogSink(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	return newDecisionLoggerWithSink(cfg, logger, sink), nil
+}
+
+// newDecisionLogSink creates sink from cfg. Nil cfg means defaults.
+func newDecisionLogSink(cfg *DecisionLogsConfig, logger logging.Logger) (DecisionLogSink, error) {
+	if cfg == nil {
+		cfg = &DecisionLogsConfig{}
+	}
+	factory, ok := sinkFactory(cfg.SinkName())
+	if !ok {
+		return nil, fmt.Errorf("unknown decision log sink '%s'", cfg.SinkName())
+	}
+	sink, err := factory(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decision log sink '%s': %w", cfg.SinkName(), err)
+	}
+	if ls, ok := sink.(loggingSink); ok {
+		ls.setLogger(logger)
+	}
+	return sink, nil
+}
+
+// newDecisionLoggerWithSink creates decision logger, which writes to sink. Nil cfg means defaults.
+// Sink can be nil, then events are only buffered and it must be set before start or stop is called.
+func newDecisionLoggerWithSink(cfg *DecisionLogsConfig, logger logging.Logger, sink DecisionLogSink) *decisionLogger {
+	if cfg == nil {
+		cfg = &DecisionLogsConfig{}
+	}
+	l := &decisionLogger{
+		sink:       sink,
+		logger:     logger,
+		redactor:   NewRedactor(cfg.Redaction),
+		flushCh:    make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		interval:   defaultDecisionLogFlushInterval,
+		bufferSize: defaultDecisionLogBufferSize,
+		batchSize:  defaultDecisionLogBatchSize,
+	}
+	if cfg.FlushIntervalMillis > 0 {
+		l.interval = time.Duration(cfg.FlushIntervalMillis) * time.Millisecond
+	}
+	if cfg.BufferSize > 0 {
+		l.bufferSize = cfg.BufferSize
+	}
+	if cfg.BatchSize > 0 {
+		l.batchSize = min(cfg.BatchSize, l.bufferSize)
+	}
+	return l
+}
+
+// start runs background flushing.
+func (l *decisionLogger) start() {
+	if l.started.CompareAndSwap(false, true) {
+		go l.run()
+	}
+}
+
+// log redacts and encodes event with IndyKite calls and appends it to the buffer.
+// When buffer is full, the oldest event is dropped. Events logged after stop are passed to the next logger.
+func (l *decisionLogger) log(event logs.EventV1, calls []CallRecord) error {
+	data, err := json.Marshal(decisionLogEvent{
+		EventV1:       l.redactor.RedactEvent(event),
+		IndyKiteCalls: calls,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode decision log event: %w", err)
+	}
+
+	l.mtx.Lock()
+	if l.closed {
+		next := l.next
+		l.mtx.Unlock()
+		if next == nil {
+			return errDecisionLogNotStarted
+		}
+		return next.log(event, calls)
+	}
+	if len(l.buffer) >= l.bufferSize {
+		l.buffer[0] = nil
+		l.buffer = l.buffer[1:]
+		l.dropped.Add(1)
+	}
+	l.buffer = append(l.buffer, data)
+	full := len(l.buffer) >= l.batchSize
+	l.mtx.Unlock()
+
+	if full {
+		select {
+		case l.flushCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// droppedEvents returns number of events dropped because buffer was full or the sink failed.
+func (l *decisionLogger) droppedEvents() uint64 {
+	return l.dropped.Load()
+}
+
+// stop stops background flushing, writes all buffered events and closes the sink.
+// Events logged afterwards, including those racing with stop, are passed to next, or rejected when it is nil.
+func (l *decisionLogger) stop(ctx context.Context, next *decisionLogger) {
+	l.stopOnce.Do(func() {
+		close(l.done)
+		if l.started.Load() {
+			<-l.stopped
+		}
+		l.mtx.Lock()
+		l.closed, l.next = true, next
+		l.mtx.Unlock()
+		l.flush(ctx)
+		if err := l.sink.Close(); err != nil {
+			l.logger.Error("Failed to close decision log sink: %v", err)
+		}
+	})
+}
+
+func (l *decisionLogger) run() {
+	defer close(l.stopped)
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		case <-l.flushCh:
+		}
+		l.flush(context.Background())
+	}
+}
+
+// flush writes buffered events in batches. Batch, which failed to be written, is dropped.
+func (l *decisionLogger) flush(ctx context.Context) {
+	for {
+		l.mtx.Lock()
+		n := min(len(l.buffer), l.batchSize)
+		if n == 0 {
+			l.mtx.Unlock()
+			break
+		}
+		batch := make([][]byte, n)
+		copy(batch, l.buffer)
+		clear(l.buffer[:n])
+		l.buffer = l.buffer[n:]
+		l.mtx.Unlock()
+
+		if err := l.sink.WriteBatch(ctx, batch); err != nil {
+			l.dropped.Add(uint64(n))
+			l.logger.Error("Failed to write %d decision log events: %v", n, err)
+		}
+	}
+
+	if dropped := l.dropped.Load(); dropped > l.reported {
+		l.logger.Warn("Dropped %d decision log events, %d in total", dropped-l.reported, dropped)
+		l.reported = dropped
+	}
+}
+
+func (s *writerSink) WriteBatch(_ context.Context, events [][]byte) error {
+	size := 0
+	for _, event := range events {
+		size += len(event) + 1
+	}
+	buf := make([]byte, 0, size)
+	for _, event := range events {
+		buf = append(buf, event...)
+		buf = append(buf, '\n')
+	}
+	_, err := s.w.Write(buf)
+	return err
+}
+
+func (*writerSink) Close() error {
+	return nil
+}
+
+func (s failedSink) WriteBatch(context.Context, [][]byte) error {
+	return s.err
+}
+
+func (failedSink) Close() error {
+	return nil
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	opaplugins "github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/plugins/logs"
+	"github.com/open-policy-agent/opa/storage/inmem"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type memorySink struct {
+	batches [][]string
+	events  []string
+	closed  bool
+	mtx     sync.Mutex
+}
+
+func (s *memorySink) WriteBatch(_ context.Context, events [][]byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var ids []string
+	for _, event := range events {
+		var decoded logs.EventV1
+		if err := json.Unmarshal(event, &decoded); err != nil {
+			return err
+		}
+		ids = append(ids, decoded.DecisionID)
+		s.events = append(s.events, string(event))
+	}
+	s.batches = append(s.batches, ids)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *memorySink) Events() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.events
+}
+
+func (s *memorySink) Batches() [][]string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.batches
+}
+
+var _ = Describe("Decision logs", func() {
+	var sink *memorySink
+
+	BeforeEach(func() {
+		sink = &memorySink{}
+		plugins.RegisterDecisionLogSink("memory", func(*plugins.DecisionLogsConfig) (plugins.DecisionLogSink, error) {
+			return sink, nil
+		})
+	})
+
+	logEvents := func(logger interface{ Log(logs.EventV1) error }, from, to int) {
+		for i := from; i <= to; i++ {
+			Expect(logger.Log(logs.EventV1{DecisionID: fmt.Sprint(i)})).To(Succeed())
+		}
+	}
+
+	It("Writes full batches without waiting for flush interval", func() {
+		logger, err := plugins.NewDecisionLogger(&plugins.DecisionLogsConfig{
+			Sink:                "memory",
+			BatchSize:           2,
+			FlushIntervalMillis: 60000,
+		})
+		Expect(err).To(Succeed())
+		logger.Start()
+		defer logger.Stop(context.Background())
+
+		logEvents(logger, 1, 2)
+		Eventually(sink.Batches).Should(Equal([][]string{{"1", "2"}}))
+	})
+
+	It("Writes partial batch after flush interval", func() {
+		logger, err := plugins.NewDecisionLogger(&plugins.DecisionLogsConfig{
+			Sink:                "memory",
+			FlushIntervalMillis: 10,
+		})
+		Expect(err).To(Succeed())
+		logger.Start()
+		defer logger.Stop(context.Background())
+
+		logEvents(logger, 1, 1)
+		Eventually(sink.Batches).Should(Equal([][]string{{"1"}}))
+	})
+
+	It("Drops oldest events when buffer is full and flushes on stop", func() {
+		logger, err := plugins.NewDecisionLogger(&plugins.DecisionLogsConfig{
+			Sink:       "memory",
+			BufferSize: 3,
+			BatchSize:  2,
+		})
+		Expect(err).To(Succeed())
+
+		logEvents(logger, 1, 5)
+		logger.Stop(context.Background())
+
+		Expect(sink.Batches()).To(Equal([][]string{{"3", "4"}, {"5"}}))
+		Expect(logger.Dropped()).To(BeEquivalentTo(2))
+		Expect(sink.closed).To(BeTrue())
+	})
+
+	It("Passes events logged after stop to the next logger", func() {
+		oldLogger, err := plugins.NewDecisionLogger(&plugins.DecisionLogsConfig{Sink: "memory"})
+		Expect(err).To(Succeed())
+		oldSink := sink
+		sink = &memorySink{}
+		newLogger, err := plugins.NewDecisionLogger(&plugins.DecisionLogsConfig{Sink: "memory"})
+		Expect(err).To(Succeed())
+
+		logEvents(oldLogger, 1, 2)
+		oldLogger.HandOver(context.Background(), newLogger)
+		logEvents(oldLogger, 3, 4)
+		newLogger.Stop(context.Background())
+
+		Expect(oldSink.Batches()).To(Equal([][]string{{"1", "2"}}))
+		Expect(sink.Batches()).To(Equal([][]string{{"3", "4"}}))
+		Expect(newLogger.Log(logs.EventV1{DecisionID: "5"})).To(HaveOccurred())
+	})
+
+	DescribeTable("Validates config",
+		func(cfg plugins.DecisionLogsConfig, errMsg string) {
+			err := cfg.Validate()
+			if errMsg == "" {
+				Expect(err).To(Succeed())
+			} else {
+				Expect(err).To(MatchError(ContainSubstring(errMsg)))
+			}
+		},
+		Entry("Default sink", plugins.DecisionLogsConfig{}, ""),
+		Entry("Registered sink", plugins.DecisionLogsConfig{Sink: "memory"}, ""),
+		Entry("Unknown sink", plugins.DecisionLogsConfig{Sink: "kafka"}, "unknown sink 'kafka'"),
+		Entry("Negative buffer", plugins.DecisionLogsConfig{BufferSize: -1}, "must not be negative"),
+	)
+
+	It("Plugin writes buffered events on stop", func() {
+		manager, err := opaplugins.New([]byte(`{"decision_logs": {"plugin": "indykite_plugin"}}`), "test", inmem.New())
+		Expect(err).To(Succeed())
+		plugin, err := plugins.NewPlugin(manager, []byte(`{"decision_logs": {"sink": "memory"}}`))
+		Expect(err).To(Succeed())
+
+		Expect(plugin.Log(context.Background(), logs.EventV1{})).To(HaveOccurred())
+
+		Expect(plugin.Start(context.Background())).To(Succeed())
+		logEvents(loggerFunc(func(event logs.EventV1) error {
+			return plugin.Log(context.Background(), event)
+		}), 1, 3)
+		plugin.Stop(context.Background())
+
+		Expect(sink.Batches()).To(Equal([][]string{{"1", "2", "3"}}))
+	})
+
+	It("Plugin starts decision logger only as decision logs plugin", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "decisions.log")
+		manager, err := opaplugins.New([]byte(`{}`), "test", inmem.New())
+		Expect(err).To(Succeed())
+		plugin, err := plugins.NewPlugin(manager,
+			[]byte(`{"decision_logs": {"sink": "file", "file": {"path": "`+path+`"}}}`))
+		Expect(err).To(Succeed())
+		Expect(plugin.Start(context.Background())).To(Succeed())
+		defer plugin.Stop(context.Background())
+
+		Expect(path).NotTo(BeAnExistingFile())
+		Expect(plugin.Log(context.Background(), logs.EventV1{})).To(HaveOccurred())
+
+		cfg, err := plugins.ValidateConfig(manager, []byte(`{"decision_logs": {"sink": "memory"}}`))
+		Expect(err).To(Succeed())
+		manager.Config.DecisionLogs = []byte(`{"plugin": "indykite_plugin"}`)
+		plugin.Reconfigure(context.Background(), cfg)
+		logEvents(loggerFunc(func(event logs.EventV1) error {
+			return plugin.Log(context.Background(), event)
+		}), 1, 2)
+
+		manager.Config.DecisionLogs = []byte(`{}`)
+		plugin.Reconfigure(context.Background(), cfg)
+		Expect(sink.Batches()).To(Equal([][]string{{"1", "2"}}))
+		Expect(sink.closed).To(BeTrue())
+		Expect(plugin.Log(context.Background(), logs.EventV1{})).To(HaveOccurred())
+	})
+
+	It("Plugin reopens the same file after old logger wrote its events", func() {
+		dir := GinkgoT().TempDir()
+		fileCfg := func(backups int) []byte {
+			return []byte(fmt.Sprintf(`{"decision_logs": {"sink": "file", "flush_interval_ms": 60000, `+
+				`"file": {"path": "%s", "max_size_mb": 1, "max_backups": %d}}}`,
+				filepath.Join(dir, "decisions.log"), backups))
+		}
+		manager, err := opaplugins.New([]byte(`{"decision_logs": {"plugin": "indykite_plugin"}}`), "test", inmem.New())
+		Expect(err).To(Succeed())
+		plugin, err := plugins.NewPlugin(manager, fileCfg(5))
+		Expect(err).To(Succeed())
+		Expect(plugin.Start(context.Background())).To(Succeed())
+
+		// Two events exceed max size, so the final flush of the old logger rotates the file.
+		var input interface{} = strings.Repeat("a", 600*1024)
+		for _, id := range []string{"1", "2"} {
+			Expect(plugin.Log(context.Background(), logs.EventV1{DecisionID: id, Input: &input})).To(Succeed())
+		}
+		cfg, err := plugins.ValidateConfig(manager, fileCfg(10))
+		Expect(err).To(Succeed())
+		plugin.Reconfigure(context.Background(), cfg)
+		Expect(plugin.Log(context.Background(), logs.EventV1{DecisionID: "3"})).To(Succeed())
+		plugin.Stop(context.Background())
+
+		decisionIDs := func(name string) []string {
+			data, err := os.ReadFile(name)
+			Expect(err).To(Succeed())
+			var ids []string
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				var event logs.EventV1
+				Expect(json.Unmarshal([]byte(line), &event)).To(Succeed())
+				ids = append(ids, event.DecisionID)
+			}
+			return ids
+		}
+		backups, err := filepath.Glob(filepath.Join(dir, "decisions-*.log"))
+		Expect(err).To(Succeed())
+		Expect(backups).To(HaveLen(1))
+		Expect(decisionIDs(backups[0])).To(Equal([]string{"1"}))
+		Expect(decisionIDs(filepath.Join(dir, "decisions.log"))).To(Equal([]string{"2", "3"}))
+	})
+})
+
+type loggerFunc func(logs.EventV1) error
+
+func (f loggerFunc) Log(event logs.EventV1) error {
+	return f(event)
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"github.com/indykite/indykite-sdk-go/authorization"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/logging"
+)
+
+// NewEmbedded creates plugin for builtins of rego instances, which run outside of OPA runtime.
+// Unless runtime is nil, builtins use the plugin when evaluating with runtime information set to Runtime
+// by rego.Runtime. Runtime is a copy of runtime with the same value, which serves as a handle of the plugin
+// and is matched by identity. Plugin stays registered until Unregister is called.
+// Builtins also use the plugin with context returned by WithPlugin.
+// IndyKite is called with client, which is owned by the caller and is never closed by the plugin.
+// Decision logs are not written and metrics are not registered.
+func NewEmbedded(
+	client *authorization.Client,
+	cfg *Config,
+	logger logging.Logger,
+	runtime *ast.Term,
+) *IndyKitePlugin {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	if logger == nil {
+		logger = logging.NewNoOpLogger()
+	}
+	p := &IndyKitePlugin{
+		config:         cfg,
+		logger:         logger,
+		connections:    make(map[string]*connection),
+		decisionCache:  NewDecisionCache(cfg.DecisionCache),
+		tokenValidator: NewTokenValidator(cfg.TokenValidation),
+	}
+	conn := &connection{breaker: p.newCircuitBreaker(DefaultConnectionName, cfg.CircuitBreaker)}
+	if client != nil {
+		conn.client = &clientHandle{client: client}
+	}
+	p.connections[DefaultConnectionName] = conn
+	// Unregistered metrics cannot fail.
+	p.metrics, _ = NewMetrics(nil)
+	if runtime != nil {
+		p.embedded = runtime.Copy()
+		p.embedded.Location = embeddedLocation
+		registered.registerEmbedded(p)
+	}
+	return p
+}
+
+// Runtime returns runtime information of rego instances served by plugin created by NewEmbedded,
+// or nil when it was created without runtime information. For plugins of OPA runtime it is the runtime
+// information of the OPA instance.
+func (p *IndyKitePlugin) Runtime() *ast.Term {
+	return p.runtime()
+}
+
+// Unregister detaches plugin created by NewEmbedded from its runtime information, so builtins no longer use it.
+// State kept by builtins for its connections is released, but client is not closed.
+// Plugins of OPA runtime are unregistered by Stop.
+func (p *IndyKitePlugin) Unregister() {
+	registered.unregister(p)
+
+	p.clientMtx.Lock()
+	names := make([]string, 0, len(p.connections))
+	for name := range p.connections {
+		names = append(names, name)
+	}
+	p.clientMtx.Unlock()
+	p.releaseConnections(names...)
+}
+
+// Logger returns logger of the plugin.
+func (p *IndyKitePlugin) Logger() logging.Logger {
+	return p.logger
+}
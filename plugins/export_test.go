@@ -0,0 +1,147 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"context"
+	"time"
+
+	api "github.com/indykite/indykite-sdk-go/grpc"
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/plugins/logs"
+)
+
+// SetClock overrides time source of the cache for tests.
+func (c *DecisionCache) SetClock(now func() time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = now
+}
+
+// SetClock overrides time source of the circuit breaker for tests.
+func (b *CircuitBreaker) SetClock(now func() time.Time) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.now = now
+}
+
+// SetClock overrides time source of the token validator for tests.
+func (v *TokenValidator) SetClock(now func() time.Time) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.now = now
+}
+
+// DecisionLogger exposes decision logger for tests.
+type DecisionLogger = decisionLogger
+
+// NewDecisionLogger creates decision logger, which does not log own errors.
+func NewDecisionLogger(cfg *DecisionLogsConfig) (*DecisionLogger, error) {
+	return newDecisionLogger(cfg, logging.NewNoOpLogger())
+}
+
+// Start exposes decisionLogger.start for tests.
+func (l *decisionLogger) Start() {
+	l.start()
+}
+
+// Log exposes decisionLogger.log for tests.
+func (l *decisionLogger) Log(event logs.EventV1) error {
+	return l.log(event, nil)
+}
+
+// Stop exposes decisionLogger.stop for tests.
+func (l *decisionLogger) Stop(ctx context.Context) {
+	l.stop(ctx, nil)
+}
+
+// HandOver exposes decisionLogger.stop, which passes later events to next, for tests.
+func (l *decisionLogger) HandOver(ctx context.Context, next *DecisionLogger) {
+	l.stop(ctx, next)
+}
+
+// Dropped exposes decisionLogger.droppedEvents for tests.
+func (l *decisionLogger) Dropped() uint64 {
+	return l.droppedEvents()
+}
+
+// NewPlugin creates plugin the same way as OPA runtime does.
+func NewPlugin(m *plugins.Manager, configData []byte) (*IndyKitePlugin, error) {
+	cfg, err := factory{}.Validate(m, configData)
+	if err != nil {
+		return nil, err
+	}
+	return factory{}.New(m, cfg).(*IndyKitePlugin), nil
+}
+
+// ValidateConfig parses plugin configuration the same way as OPA runtime does.
+func ValidateConfig(m *plugins.Manager, configData []byte) (*Config, error) {
+	cfg, err := factory{}.Validate(m, configData)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.(*Config), nil
+}
+
+// NewFileSink creates file sink with given time source for tests.
+// Max size is in bytes instead of megabytes when maxSizeBytes is positive.
+func NewFileSink(cfg *FileSinkConfig, now func() time.Time, maxSizeBytes int64) (DecisionLogSink, error) {
+	s, err := newFileSink(cfg, now)
+	if err != nil {
+		return nil, err
+	}
+	if maxSizeBytes > 0 {
+		s.maxSize = maxSizeBytes
+	}
+	return s, nil
+}
+
+// SetSinkLogger sets logger of sink, which logs errors of its background work.
+func SetSinkLogger(sink DecisionLogSink, logger logging.Logger) {
+	sink.(loggingSink).setLogger(logger)
+}
+
+// SetClock overrides time source of the call recorder for tests.
+func (r *CallRecorder) SetClock(now func() time.Time) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.now = now
+}
+
+// SetMaxSize overrides max number of decisions with records for tests.
+func (r *CallRecorder) SetMaxSize(maxSize int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.maxSize = maxSize
+}
+
+// AggregateStatus exposes aggregateStatus for tests.
+func AggregateStatus(statuses map[string]*plugins.Status) *plugins.Status {
+	return aggregateStatus(statuses)
+}
+
+// SetDialOptions adds opts to options of IndyKite connections dialed by plugins in tests.
+func SetDialOptions(opts ...api.ClientOption) {
+	dialOptions = opts
+}
+
+// SetConnectTimeout changes how long plugins wait for new IndyKite connection to become ready and returns
+// function restoring the previous timeout.
+func SetConnectTimeout(timeout time.Duration) func() {
+	previous := connectTimeout
+	connectTimeout = timeout
+	return func() { connectTimeout = previous }
+}
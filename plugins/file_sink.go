@@ -0,0 +1,375 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/logging"
+)
+
+const (
+	// FileSinkName is the name of decision log sink, which writes events to rotated local files.
+	FileSinkName = "file"
+
+	defaultFileSinkMaxSizeMB = 100
+	backupTimeFormat         = "2006-01-02T15-04-05.000000000"
+	compressedSuffix         = ".gz"
+	// rotateRetryInterval delays next attempt to rotate the file after rename failed.
+	rotateRetryInterval = time.Minute
+)
+
+type (
+	// FileSinkConfig defines file sink of decision logs. Events are written as JSON lines.
+	FileSinkConfig struct {
+		// Path of the active log file. Rotated files are stored next to it with timestamp in the name.
+		Path string `json:"path,omitempty" yaml:"path,omitempty"`
+		// MaxSizeMB is the size in megabytes, which triggers rotation. Defaults to 100.
+		MaxSizeMB int `json:"max_size_mb,omitempty" yaml:"max_size_mb,omitempty"`
+		// MaxAgeSeconds triggers rotation of the active file, which is older. Disabled when not positive.
+		MaxAgeSeconds int `json:"max_age_seconds,omitempty" yaml:"max_age_seconds,omitempty"`
+		// MaxBackups is the number of rotated files to keep. All are kept when not positive.
+		MaxBackups int `json:"max_backups,omitempty" yaml:"max_backups,omitempty"`
+		// FsyncIntervalMillis is how often the file is synced to disk in background.
+		// Synced after every batch when not positive.
+		FsyncIntervalMillis int `json:"fsync_interval_ms,omitempty" yaml:"fsync_interval_ms,omitempty"`
+		// Compress rotated files with gzip.
+		Compress bool `json:"compress,omitempty" yaml:"compress,omitempty"`
+	}
+
+	// fileSink writes events into file and rotates it by size and age. Rotated files are compressed
+	// and removed in background.
+	fileSink struct {
+		// openedAt is the time since which the active file is written, used for rotation by age.
+		openedAt time.Time
+		// rotateAfter postpones rotation after failed attempt.
+		rotateAfter   time.Time
+		file          *os.File
+		now           func() time.Time
+		logger        logging.Logger
+		done          chan struct{}
+		path          string
+		maxSize       int64
+		size          int64
+		maxAge        time.Duration
+		fsyncInterval time.Duration
+		maxBackups    int
+		compress      bool
+		// dirty is set, when the active file has writes, which are not synced.
+		dirty bool
+		// mtx guards the active file against background sync.
+		mtx sync.Mutex
+		// maintenance serializes compression and removal of rotated files.
+		maintenance sync.Mutex
+		background  sync.WaitGroup
+		closeOnce   sync.Once
+	}
+)
+
+func init() {
+	RegisterDecisionLogSink(FileSinkName, func(cfg *DecisionLogsConfig) (DecisionLogSink, error) {
+		return newFileSink(cfg.File, time.Now)
+	})
+}
+
+// Validate checks file sink configuration.
+func (c *FileSinkConfig) Validate() error {
+	if c.Path == "" {
+		return errors.New("decision_logs: file.path is required")
+	}
+	if c.MaxSizeMB < 0 || c.MaxAgeSeconds < 0 || c.MaxBackups < 0 || c.FsyncIntervalMillis < 0 {
+		return errors.New("decision_logs: file limits and intervals must not be negative")
+	}
+	return nil
+}
+
+// sameFileSink reports if both configurations write decision logs to the same file.
+func sameFileSink(a, b *DecisionLogsConfig) bool {
+	if a.SinkName() != FileSinkName || b.SinkName() != FileSinkName || a.File == nil || b.File == nil {
+		return false
+	}
+	return filepath.Clean(a.File.Path) == filepath.Clean(b.File.Path)
+}
+
+func newFileSink(cfg *FileSinkConfig, now func() time.Time) (*fileSink, error) {
+	if cfg == nil {
+		return nil, errors.New("missing file sink configuration")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	maxSizeMB := cfg.MaxSizeMB
+	if maxSizeMB == 0 {
+		maxSizeMB = defaultFileSinkMaxSizeMB
+	}
+	s := &fileSink{
+		now:           now,
+		logger:        logging.NewNoOpLogger(),
+		done:          make(chan struct{}),
+		path:          cfg.Path,
+		maxSize:       int64(maxSizeMB) * 1024 * 1024,
+		maxAge:        time.Duration(cfg.MaxAgeSeconds) * time.Second,
+		fsyncInterval: time.Duration(cfg.FsyncIntervalMillis) * time.Millisecond,
+		maxBackups:    cfg.MaxBackups,
+		compress:      cfg.Compress,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	if s.fsyncInterval > 0 {
+		s.background.Add(1)
+		go s.syncPeriodically()
+	}
+	return s, nil
+}
+
+func (s *fileSink) setLogger(logger logging.Logger) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.logger = logger
+}
+
+// WriteBatch appends events to the active file, rotating it before an event would exceed limits.
+func (s *fileSink) WriteBatch(_ context.Context, events [][]byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	for _, event := range events {
+		if s.shouldRotate(int64(len(event) + 1)) {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+		n, err := s.file.Write(append(slices.Clip(event), '\n'))
+		s.size += int64(n)
+		s.dirty = true
+		if err != nil {
+			return err
+		}
+	}
+	if s.fsyncInterval <= 0 {
+		s.dirty = false
+		return s.file.Sync()
+	}
+	return nil
+}
+
+// Close waits for background work, then syncs and closes the active file.
+func (s *fileSink) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.background.Wait()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.closeFile()
+}
+
+func (s *fileSink) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	s.dirty = false
+	return err
+}
+
+func (s *fileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o750); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	s.openedAt = s.now()
+	// Existing file is at least as old as its last write.
+	if info.Size() > 0 && info.ModTime().Before(s.openedAt) {
+		s.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+// syncPeriodically syncs written events to disk every fsyncInterval until the sink is closed.
+func (s *fileSink) syncPeriodically() {
+	defer s.background.Done()
+	ticker := time.NewTicker(s.fsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.mtx.Lock()
+		if s.file != nil && s.dirty {
+			if err := s.file.Sync(); err != nil {
+				s.logger.Error("Failed to sync decision log file: %v", err)
+			}
+			s.dirty = false
+		}
+		s.mtx.Unlock()
+	}
+}
+
+func (s *fileSink) shouldRotate(next int64) bool {
+	if s.size == 0 || s.now().Before(s.rotateAfter) {
+		return false
+	}
+	if s.size+next > s.maxSize {
+		return true
+	}
+	return s.maxAge > 0 && s.now().Sub(s.openedAt) >= s.maxAge
+}
+
+// rotate renames the active file to backup name and opens new file. The backup is compressed and old backups
+// are removed in background. Only failure to open new file is returned, other failures are logged.
+// When rename fails, writing continues to the same file and rotation is not attempted again for rotateRetryInterval.
+func (s *fileSink) rotate() error {
+	if err := s.closeFile(); err != nil {
+		s.logger.Error("Failed to close rotated decision log: %v", err)
+	}
+	openedAt := s.openedAt
+	backup := s.backupName(s.now())
+	renameErr := os.Rename(s.path, backup)
+	if err := s.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		s.logger.Error("Failed to rotate decision log, writing continues to the same file: %v", renameErr)
+		s.openedAt = openedAt
+		s.rotateAfter = s.now().Add(rotateRetryInterval)
+		return nil
+	}
+	s.background.Add(1)
+	go s.maintain(backup, s.logger)
+	return nil
+}
+
+// maintain compresses rotated backup and removes old backups.
+func (s *fileSink) maintain(backup string, logger logging.Logger) {
+	defer s.background.Done()
+	s.maintenance.Lock()
+	defer s.maintenance.Unlock()
+	if s.compress {
+		if err := compressFile(backup); err != nil {
+			logger.Error("Failed to compress rotated decision log: %v", err)
+		}
+	}
+	if err := s.removeOldBackups(); err != nil {
+		logger.Error("Failed to remove old decision logs: %v", err)
+	}
+}
+
+// backupName returns path like /var/log/decisions-2024-09-09T21-10-00.000000000.log for /var/log/decisions.log.
+func (s *fileSink) backupName(t time.Time) string {
+	ext := filepath.Ext(s.path)
+	return strings.TrimSuffix(s.path, ext) + "-" + t.UTC().Format(backupTimeFormat) + ext
+}
+
+// backups returns rotated files from the oldest to the newest.
+func (s *fileSink) backups() ([]string, error) {
+	ext := filepath.Ext(s.path)
+	prefix := filepath.Base(strings.TrimSuffix(s.path, ext)) + "-"
+	entries, err := os.ReadDir(filepath.Dir(s.path))
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), compressedSuffix)
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		if _, err = time.Parse(backupTimeFormat, stamp); err != nil {
+			continue
+		}
+		result = append(result, filepath.Join(filepath.Dir(s.path), entry.Name()))
+	}
+	// Timestamp format sorts chronologically.
+	slices.SortFunc(result, func(a, b string) int {
+		return strings.Compare(strings.TrimSuffix(a, compressedSuffix), strings.TrimSuffix(b, compressedSuffix))
+	})
+	return result, nil
+}
+
+func (s *fileSink) removeOldBackups() error {
+	if s.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := s.backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > s.maxBackups {
+		if err = os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// compressFile replaces file with its gzip compressed copy.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+compressedSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path + compressedSuffix)
+		return err
+	}
+	return os.Remove(path)
+}
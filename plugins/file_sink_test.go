@@ -0,0 +1,195 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/open-policy-agent/opa/logging"
+	loggingtest "github.com/open-policy-agent/opa/logging/test"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("File sink", func() {
+	var (
+		dir  string
+		path string
+		now  time.Time
+	)
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		path = filepath.Join(dir, "decisions.log")
+		now = time.Date(2024, 9, 9, 21, 10, 0, 0, time.UTC)
+	})
+
+	clock := func() time.Time { return now }
+
+	readFile := func(name string) string {
+		data, err := os.ReadFile(name)
+		Expect(err).To(Succeed())
+		return string(data)
+	}
+
+	backups := func(pattern string) []string {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		Expect(err).To(Succeed())
+		return matches
+	}
+
+	It("Writes events as JSON lines", func() {
+		sink, err := plugins.NewFileSink(&plugins.FileSinkConfig{Path: path}, clock, 0)
+		Expect(err).To(Succeed())
+		Expect(sink.WriteBatch(context.Background(), [][]byte{[]byte(`{"a":1}`), []byte(`{"b":2}`)})).To(Succeed())
+		Expect(sink.Close()).To(Succeed())
+
+		Expect(readFile(path)).To(Equal("{\"a\":1}\n{\"b\":2}\n"))
+	})
+
+	It("Rotates by size and keeps configured number of backups", func() {
+		sink, err := plugins.NewFileSink(&plugins.FileSinkConfig{Path: path, MaxBackups: 2}, clock, 10)
+		Expect(err).To(Succeed())
+		for _, event := range []string{`"first"`, `"second"`, `"third"`, `"fourth"`} {
+			now = now.Add(time.Second)
+			Expect(sink.WriteBatch(context.Background(), [][]byte{[]byte(event)})).To(Succeed())
+		}
+		Expect(sink.Close()).To(Succeed())
+
+		Expect(readFile(path)).To(Equal("\"fourth\"\n"))
+		rotated := backups("decisions-*.log")
+		Expect(rotated).To(HaveLen(2))
+		Expect(readFile(rotated[0])).To(Equal("\"second\"\n"))
+		Expect(readFile(rotated[1])).To(Equal("\"third\"\n"))
+	})
+
+	It("Rotates by age and compresses backups", func() {
+		sink, err := plugins.NewFileSink(&plugins.FileSinkConfig{
+			Path:          path,
+			MaxAgeSeconds: 60,
+			Compress:      true,
+		}, clock, 0)
+		Expect(err).To(Succeed())
+		Expect(sink.WriteBatch(context.Background(), [][]byte{[]byte(`"old"`)})).To(Succeed())
+		now = now.Add(30 * time.Second)
+		Expect(sink.WriteBatch(context.Background(), [][]byte{[]byte(`"still old"`)})).To(Succeed())
+		now = now.Add(30 * time.Second)
+		Expect(sink.WriteBatch(context.Background(), [][]byte{[]byte(`"new"`)})).To(Succeed())
+		Expect(sink.Close()).To(Succeed())
+
+		Expect(readFile(path)).To(Equal("\"new\"\n"))
+		Expect(backups("decisions-*.log")).To(BeEmpty())
+		compressed := backups("decisions-*.log.gz")
+		Expect(compressed).To(HaveLen(1))
+
+		file, err := os.Open(compressed[0])
+		Expect(err).To(Succeed())
+		defer file.Close()
+		gz, err := gzip.NewReader(file)
+		Expect(err).To(Succeed())
+		data, err := io.ReadAll(gz)
+		Expect(err).To(Succeed())
+		Expect(string(data)).To(Equal("\"old\"\n\"still old\"\n"))
+	})
+
+	It("Rotates reopened file by age of its last write", func() {
+		Expect(os.WriteFile(path, []byte("\"old\"\n"), 0o600)).To(Succeed())
+		Expect(os.Chtimes(path, now.Add(-time.Hour), now.Add(-time.Hour))).To(Succeed())
+		sink, err := plugins.NewFileSink(&plugins.FileSinkConfig{Path: path, MaxAgeSeconds: 60}, clock, 0)
+		Expect(err).To(Succeed())
+		Expect(sink.WriteBatch(context.Background(), [][]byte{[]byte(`"new"`)})).To(Succeed())
+		Expect(sink.Close()).To(Succeed())
+
+		Expect(readFile(path)).To(Equal("\"new\"\n"))
+		rotated := backups("decisions-*.log")
+		Expect(rotated).To(HaveLen(1))
+		Expect(readFile(rotated[0])).To(Equal("\"old\"\n"))
+	})
+
+	It("Postpones rotation after failed rename", func() {
+		sink, err := plugins.NewFileSink(&plugins.FileSinkConfig{Path: path, MaxAgeSeconds: 60}, clock, 10)
+		Expect(err).To(Succeed())
+		logger := loggingtest.New()
+		plugins.SetSinkLogger(sink, logger)
+		// Non-empty directory in place of backup makes rename fail.
+		backup := filepath.Join(dir, "decisions-"+now.Format("2006-01-02T15-04-05.000000000")+".log")
+		Expect(os.MkdirAll(filepath.Join(backup, "taken"), 0o750)).To(Succeed())
+
+		events := [][]byte{[]byte(`"first"`), []byte(`"second"`), []byte(`"third"`)}
+		Expect(sink.WriteBatch(context.Background(), events)).To(Succeed())
+		Expect(readFile(path)).To(Equal("\"first\"\n\"second\"\n\"third\"\n"))
+		Expect(logger.Entries()).To(ConsistOf(
+			HaveField("Message", ContainSubstring("Failed to rotate decision log")),
+		))
+
+		// Rotation is retried later and the file keeps its age.
+		now = now.Add(time.Minute)
+		Expect(sink.WriteBatch(context.Background(), [][]byte{[]byte(`"fourth"`)})).To(Succeed())
+		Expect(sink.Close()).To(Succeed())
+		Expect(readFile(path)).To(Equal("\"fourth\"\n"))
+		backup = filepath.Join(dir, "decisions-"+now.Format("2006-01-02T15-04-05.000000000")+".log")
+		Expect(readFile(backup)).To(Equal("\"first\"\n\"second\"\n\"third\"\n"))
+	})
+
+	It("Logs failed compression and keeps writing the batch", func() {
+		sink, err := plugins.NewFileSink(&plugins.FileSinkConfig{Path: path, Compress: true}, clock, 10)
+		Expect(err).To(Succeed())
+		logger := loggingtest.New()
+		plugins.SetSinkLogger(sink, logger)
+		// Directory in place of compressed backup makes compression fail.
+		now = now.Add(time.Second)
+		backup := filepath.Join(dir, "decisions-"+now.Format("2006-01-02T15-04-05.000000000")+".log")
+		Expect(os.Mkdir(backup+".gz", 0o750)).To(Succeed())
+
+		Expect(sink.WriteBatch(context.Background(), [][]byte{[]byte(`"first"`), []byte(`"second"`)})).To(Succeed())
+		Expect(sink.Close()).To(Succeed())
+
+		Expect(readFile(path)).To(Equal("\"second\"\n"))
+		Expect(readFile(backup)).To(Equal("\"first\"\n"))
+		Expect(logger.Entries()).To(ConsistOf(And(
+			HaveField("Level", logging.Error),
+			HaveField("Message", ContainSubstring("Failed to compress rotated decision log")),
+		)))
+	})
+
+	It("Syncs events in background", func() {
+		sink, err := plugins.NewFileSink(&plugins.FileSinkConfig{Path: path, FsyncIntervalMillis: 1}, clock, 0)
+		Expect(err).To(Succeed())
+		logger := loggingtest.New()
+		plugins.SetSinkLogger(sink, logger)
+		Expect(sink.WriteBatch(context.Background(), [][]byte{[]byte(`"first"`)})).To(Succeed())
+		time.Sleep(10 * time.Millisecond)
+		Expect(sink.WriteBatch(context.Background(), [][]byte{[]byte(`"second"`)})).To(Succeed())
+		Expect(sink.Close()).To(Succeed())
+
+		Expect(readFile(path)).To(Equal("\"first\"\n\"second\"\n"))
+		Expect(logger.Entries()).To(BeEmpty())
+	})
+
+	It("Requires path", func() {
+		err := (&plugins.DecisionLogsConfig{Sink: "file", File: &plugins.FileSinkConfig{}}).Validate()
+		Expect(err).To(MatchError(ContainSubstring("file.path is required")))
+		err = (&plugins.DecisionLogsConfig{Sink: "file"}).Validate()
+		Expect(err).To(MatchError(ContainSubstring("requires file configuration")))
+	})
+})
@@ -16,16 +16,21 @@ package plugins
 
 import (
 	"context"
-	"fmt"
-	"os"
+	"errors"
+	"reflect"
 	"sync"
+	"sync/atomic"
 
 	"github.com/indykite/indykite-sdk-go/authorization"
 	"github.com/indykite/indykite-sdk-go/grpc/config"
 	json "github.com/json-iterator/go"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/logging"
 	"github.com/open-policy-agent/opa/plugins"
 	"github.com/open-policy-agent/opa/plugins/logs"
 	"github.com/open-policy-agent/opa/runtime"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/connectivity"
 )
 
 func init() {
@@ -33,7 +38,7 @@ func init() {
 }
 
 var (
-	defaultPlugin *IndyKitePlugin
+	errDecisionLogNotStarted = errors.New("decision logger is not started")
 )
 
 // PluginName defines name of plugin used in config files.
@@ -44,33 +49,110 @@ type (
 	Config struct {
 		credConfig *config.CredentialsConfig `yaml:"-"`
 
+		DecisionCache *DecisionCacheConfig `json:"decision_cache,omitempty" yaml:"decision_cache,omitempty"`
+		Batching      *BatchingConfig      `json:"batching,omitempty" yaml:"batching,omitempty"`
+		Retry         *RetryConfig         `json:"retry,omitempty" yaml:"retry,omitempty"`
+
+		CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker,omitempty" yaml:"circuit_breaker,omitempty"`
+		InputParams    *InputParamsConfig    `json:"input_params,omitempty" yaml:"input_params,omitempty"`
+		DecisionLogs   *DecisionLogsConfig   `json:"decision_logs,omitempty" yaml:"decision_logs,omitempty"`
+
+		// Connections defines named IndyKite connections in addition to the one of top level credentials,
+		// which is named DefaultConnectionName. Builtins select connection by name.
+		Connections map[string]*ConnectionConfig `json:"connections,omitempty" yaml:"connections,omitempty"`
+		// DefaultConnection is used by builtins without connection name. Defaults to the connection
+		// of top level credentials, or to the only connection.
+		DefaultConnection string `json:"default_connection,omitempty" yaml:"default_connection,omitempty"`
+		// Routing selects connection from access token in subject, when builtin is called without connection name.
+		Routing *RoutingConfig `json:"routing,omitempty" yaml:"routing,omitempty"`
+		// TokenValidation checks access token in subject locally before calling IndyKite.
+		TokenValidation *TokenValidationConfig `json:"token_validation,omitempty" yaml:"token_validation,omitempty"`
+
+		// Debug prints IndyKite requests and responses of builtins like print() does.
+		Debug bool `json:"debug,omitempty" yaml:"debug,omitempty"`
+
 		Test            string `json:"test,omitempty" yaml:"test,omitempty"`
 		UseEnvVariables bool   `json:"use_env_variables,omitempty" yaml:"use_env_variables,omitempty"`
 	}
 
+	// BatchingConfig defines merging of concurrent indy.is_authorized calls into a single request.
+	// Calls are merged when they have the same subject, input params and policy tags.
+	BatchingConfig struct {
+		// WindowMillis is how long the first call waits for others to join. Batching is disabled when not positive.
+		WindowMillis int `json:"window_ms,omitempty" yaml:"window_ms,omitempty"`
+		// MaxResources limits number of resources in merged request. Defaults to and is capped by service limit 32.
+		MaxResources int `json:"max_resources,omitempty" yaml:"max_resources,omitempty"`
+	}
+
+	// InputParamsConfig defines how inputParams of builtins are converted to IndyKite input parameters.
+	InputParamsConfig struct {
+		// Native accepts plain Rego values and infers their type, instead of values wrapped
+		// like {"string_value": "42"}.
+		Native bool `json:"native,omitempty" yaml:"native,omitempty"`
+		// ParseTime converts strings in RFC3339 format to time values in native mode.
+		ParseTime bool `json:"parse_time,omitempty" yaml:"parse_time,omitempty"`
+	}
+
 	factory struct{}
 
 	// IndyKitePlugin defines internal structure of OPA Plugin.
 	IndyKitePlugin struct {
-		manager             *plugins.Manager
-		config              *Config
-		authorizationClient *authorization.Client
-		mtx                 sync.Mutex
+		manager       *plugins.Manager
+		logger        logging.Logger
+		config        *Config
+		connections   map[string]*connection
+		decisionCache *DecisionCache
+		decisionLog   *decisionLogger
+		callRecorder  *CallRecorder
+		// logsDecisions is set, when plugin is configured as decision logs plugin of OPA.
+		logsDecisions  atomic.Bool
+		metrics        *Metrics
+		tokenValidator *TokenValidator
+		// embedded is runtime information of rego instances served by plugin created by NewEmbedded.
+		embedded *ast.Term
+		// started is set between Start and Stop.
+		started   bool
+		mtx       sync.Mutex
+		clientMtx sync.RWMutex
 	}
 )
 
 // IndyKite returns Plugin instance if it was defined in config, otherwise returns nil.
+// With multiple OPA instances in the process, the most recently created plugin is returned.
+//
+// Deprecated: Use Resolve, which returns plugin of the OPA instance evaluating the query.
 func IndyKite() *IndyKitePlugin {
-	return defaultPlugin
+	all := registered.load().all
+	if len(all) == 0 {
+		return nil
+	}
+	return all[len(all)-1]
 }
 
 func (factory) New(m *plugins.Manager, config interface{}) plugins.Plugin {
 	m.UpdatePluginStatus(PluginName, &plugins.Status{State: plugins.StateNotReady})
 
-	return &IndyKitePlugin{
-		manager: m,
-		config:  config.(*Config),
+	cfg := config.(*Config)
+	p := &IndyKitePlugin{
+		manager:        m,
+		logger:         m.Logger(),
+		config:         cfg,
+		connections:    make(map[string]*connection),
+		decisionCache:  NewDecisionCache(cfg.DecisionCache),
+		tokenValidator: NewTokenValidator(cfg.TokenValidation),
+		callRecorder:   NewCallRecorder(),
+	}
+	p.logsDecisions.Store(isDecisionLogsPlugin(m))
+	for name := range cfg.connectionConfigs() {
+		p.connections[name] = &connection{breaker: p.newCircuitBreaker(name, cfg.CircuitBreaker)}
 	}
+	metrics, err := NewMetrics(m.PrometheusRegister())
+	if err != nil {
+		m.Logger().Error("Failed to register IndyKite metrics: %v", err)
+	}
+	p.metrics = metrics
+	registered.register(p)
+	return p
 }
 
 func (factory) Validate(_ *plugins.Manager, configData []byte) (interface{}, error) {
@@ -79,58 +161,537 @@ func (factory) Validate(_ *plugins.Manager, configData []byte) (interface{}, err
 	if err != nil {
 		return nil, err
 	}
-	if parsedConfig.UseEnvVariables {
-		return parsedConfig, nil
+	if parsedConfig.DecisionCache != nil {
+		if err = parsedConfig.DecisionCache.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if parsedConfig.Retry != nil {
+		if err = parsedConfig.Retry.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if parsedConfig.CircuitBreaker != nil {
+		if err = parsedConfig.CircuitBreaker.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if parsedConfig.DecisionLogs != nil {
+		if err = parsedConfig.DecisionLogs.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if parsedConfig.TokenValidation != nil {
+		if err = parsedConfig.TokenValidation.Validate(); err != nil {
+			return nil, err
+		}
 	}
-
-	cfg := new(config.CredentialsConfig)
 
 	// Take from the fastest config except precision and change the TagKey
-	err = json.Config{
+	credentialsConfig := json.Config{
 		EscapeHTML:                    false,
 		ObjectFieldMustBeSimpleString: true,
 		TagKey:                        "yaml",
-	}.Froze().Unmarshal(configData, cfg)
-	if err != nil {
-		return nil, err
+	}.Froze()
+	if !parsedConfig.UseEnvVariables {
+		cfg := new(config.CredentialsConfig)
+		if err = credentialsConfig.Unmarshal(configData, cfg); err != nil {
+			return nil, err
+		}
+		if cfg.Endpoint != "" {
+			parsedConfig.credConfig = cfg
+		}
 	}
-	if cfg.Endpoint != "" {
-		parsedConfig.credConfig = cfg
+	if len(parsedConfig.Connections) > 0 {
+		var named struct {
+			Connections map[string]*config.CredentialsConfig `yaml:"connections"`
+		}
+		if err = credentialsConfig.Unmarshal(configData, &named); err != nil {
+			return nil, err
+		}
+		for name, conn := range parsedConfig.Connections {
+			cfg := named.Connections[name]
+			if conn != nil && !conn.UseEnvVariables && cfg != nil && cfg.Endpoint != "" {
+				conn.credConfig = cfg
+			}
+		}
+	}
+	if err = parsedConfig.validateConnections(); err != nil {
+		return nil, err
 	}
 
 	return parsedConfig, nil
 }
 
 // Start plugin based on its configuration.
+// It starts decision logger, when plugin is the decision logs plugin of OPA, dials all IndyKite connections
+// with configured credentials concurrently and waits until they are ready. Failure to connect does not stop OPA,
+// but the plugin status is set to ERROR when no connection works, or to WARN when only some of them fail.
+// Status keeps following reachability of IndyKite afterwards.
 func (p *IndyKitePlugin) Start(ctx context.Context) (err error) {
-	_ = p.Log(ctx, logs.EventV1{})
+	p.mtx.Lock()
+	cfg := p.config
+	p.mtx.Unlock()
+
+	var decisionLog *decisionLogger
+	if p.logsDecisions.Load() {
+		if decisionLog, err = newDecisionLogger(cfg.DecisionLogs, p.manager.Logger()); err != nil {
+			return err
+		}
+		decisionLog.start()
+	}
+	p.mtx.Lock()
+	p.decisionLog = decisionLog
+	p.started = true
+	p.mtx.Unlock()
+
+	p.reconnect(ctx, cfg, cfg)
 	return nil
 }
 
 // Stop plugin instance.
+// Writes buffered decision log events, waits for in-flight calls and closes connections to IndyKite.
+// Builtins no longer resolve the stopped plugin and state they keep for its connections is released.
 func (p *IndyKitePlugin) Stop(ctx context.Context) {
+	registered.unregister(p)
+
+	p.mtx.Lock()
+	decisionLog := p.decisionLog
+	p.decisionLog = nil
+	p.started = false
+	p.mtx.Unlock()
+	if decisionLog != nil {
+		decisionLog.stop(ctx, nil)
+	}
+
+	p.clientMtx.Lock()
+	old := p.connections
+	p.connections = make(map[string]*connection)
+	p.clientMtx.Unlock()
+
+	names := make([]string, 0, len(old))
+	for name, c := range old {
+		names = append(names, name)
+		if c.client != nil {
+			c.client.closeWhenIdle(p.logger)
+		}
+	}
+	p.releaseConnections(names...)
 	p.manager.UpdatePluginStatus(PluginName, &plugins.Status{State: plugins.StateNotReady})
 }
 
 // Reconfigure internal plugin configuration state.
+// When credentials of a connection change, new connection is created and swapped in. Calls already running
+// finish on the previous connection, which is closed afterwards. Removed connections are closed the same way.
+// When decision logs configuration changes, new logger replaces the current one, which is flushed and passes
+// events logged during the swap to the new logger. Decision logger is stopped, when plugin is no longer
+// the decision logs plugin of OPA, and started, when it becomes one.
 func (p *IndyKitePlugin) Reconfigure(ctx context.Context, config interface{}) {
+	newCfg := config.(*Config)
+
+	enabled := isDecisionLogsPlugin(p.manager)
+	p.logsDecisions.Store(enabled)
+	p.reconfigureDecisionLog(ctx, newCfg, enabled)
+
+	p.mtx.Lock()
+	oldCfg := p.config
+	p.config = newCfg
+	if !reflect.DeepEqual(oldCfg.DecisionCache, newCfg.DecisionCache) {
+		p.decisionCache = NewDecisionCache(newCfg.DecisionCache)
+	}
+	if !reflect.DeepEqual(oldCfg.TokenValidation, newCfg.TokenValidation) {
+		p.tokenValidator = NewTokenValidator(newCfg.TokenValidation)
+	}
+	p.mtx.Unlock()
+
+	p.reconnect(ctx, oldCfg, newCfg)
+}
+
+// Log buffers decision log event, which is written to configured sink in background.
+// IndyKite calls made during evaluation of the decision are attached to the event.
+func (p *IndyKitePlugin) Log(_ context.Context, event logs.EventV1) error {
+	p.mtx.Lock()
+	decisionLog := p.decisionLog
+	p.mtx.Unlock()
+	calls := p.callRecorder.Take(event.DecisionID)
+	if decisionLog == nil {
+		return errDecisionLogNotStarted
+	}
+	return decisionLog.log(event, calls)
+}
+
+// CallRecorder returns recorder of IndyKite calls, which are attached to decision log events.
+// Returns nil, when plugin is not the decision logs plugin of OPA, as the records would never be taken.
+func (p *IndyKitePlugin) CallRecorder() *CallRecorder {
+	if !p.logsDecisions.Load() {
+		return nil
+	}
+	return p.callRecorder
+}
+
+// isDecisionLogsPlugin reports if decision_logs.plugin of OPA configuration of m is this plugin.
+func isDecisionLogsPlugin(m *plugins.Manager) bool {
+	if m == nil || m.Config == nil || len(m.Config.DecisionLogs) == 0 {
+		return false
+	}
+	var cfg struct {
+		Plugin string `json:"plugin"`
+	}
+	return json.Unmarshal(m.Config.DecisionLogs, &cfg) == nil && cfg.Plugin == PluginName
+}
+
+// Metrics returns Prometheus metrics of indy.* builtins. Returns nil, when registration failed.
+func (p *IndyKitePlugin) Metrics() *Metrics {
+	return p.metrics
+}
+
+// TracerProvider returns tracer provider of OPA distributed tracing, or nil when tracing is not enabled.
+func (p *IndyKitePlugin) TracerProvider() trace.TracerProvider {
+	if p.manager == nil {
+		return nil
+	}
+	if provider := p.manager.TracerProvider(); provider != nil {
+		return provider
+	}
+	return nil
+}
+
+// DroppedDecisionLogs returns number of decision log events dropped by the current logger.
+func (p *IndyKitePlugin) DroppedDecisionLogs() uint64 {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
-	p.config = config.(*Config)
+	if p.decisionLog == nil {
+		return 0
+	}
+	return p.decisionLog.droppedEvents()
 }
 
-// Log plugin events.
-func (p *IndyKitePlugin) Log(ctx context.Context, event logs.EventV1) error {
+// reconfigureDecisionLog makes decision logger of started plugin follow new configuration. Logger runs only
+// when enabled, otherwise the current one is stopped. Running logger is replaced, when its configuration changed.
+// On failure the current logger is kept.
+func (p *IndyKitePlugin) reconfigureDecisionLog(ctx context.Context, newCfg *Config, enabled bool) {
+	p.mtx.Lock()
+	old := p.decisionLog
+	oldCfg := p.config.DecisionLogs
+	started := p.started
+	changed := !reflect.DeepEqual(oldCfg, newCfg.DecisionLogs)
+	if started && !enabled {
+		p.decisionLog = nil
+	}
+	p.mtx.Unlock()
+	if !started {
+		return
+	}
+	if !enabled {
+		if old != nil {
+			old.stop(ctx, nil)
+		}
+		return
+	}
+	if old != nil && !changed {
+		return
+	}
+	if old != nil && sameFileSink(oldCfg, newCfg.DecisionLogs) {
+		p.reopenDecisionLog(ctx, old, newCfg.DecisionLogs)
+		return
+	}
+
+	decisionLog, err := newDecisionLogger(newCfg.DecisionLogs, p.manager.Logger())
+	if err != nil {
+		p.manager.Logger().Error("Failed to reconfigure decision logs: %v", err)
+		return
+	}
+	decisionLog.start()
+	p.mtx.Lock()
+	p.decisionLog = decisionLog
+	p.mtx.Unlock()
+	if old != nil {
+		// Events logged to the old logger meanwhile are passed to the new one.
+		old.stop(ctx, decisionLog)
+	}
+}
+
+// reopenDecisionLog replaces decision logger, which writes to the same file as the old one. The file is opened
+// again only after the old logger wrote its events and closed it, as that can rotate the file. Events logged
+// meanwhile are buffered by the new logger. When the file cannot be opened, decision logs are disabled.
+func (p *IndyKitePlugin) reopenDecisionLog(ctx context.Context, old *decisionLogger, cfg *DecisionLogsConfig) {
+	decisionLog := newDecisionLoggerWithSink(cfg, p.manager.Logger(), nil)
+	p.mtx.Lock()
+	p.decisionLog = decisionLog
+	p.mtx.Unlock()
+	old.stop(ctx, decisionLog)
+
+	sink, err := newDecisionLogSink(cfg, p.manager.Logger())
+	if err != nil {
+		p.manager.Logger().Error("Failed to reconfigure decision logs, they are disabled: %v", err)
+		p.mtx.Lock()
+		if p.decisionLog == decisionLog {
+			p.decisionLog = nil
+		}
+		p.mtx.Unlock()
+		// Buffered events are dropped and reported.
+		decisionLog.sink = failedSink{err: err}
+		decisionLog.stop(ctx, nil)
+		return
+	}
+	decisionLog.sink = sink
+	decisionLog.start()
+}
+
+// AuthorizationClient returns IndyKite authorization client of the default connection.
+// Returns nil, when plugin is not started or connection failed.
+// Prefer AcquireAuthorizationClient, which guarantees the connection is not closed during the call.
+func (p *IndyKitePlugin) AuthorizationClient() *authorization.Client {
+	p.clientMtx.RLock()
+	defer p.clientMtx.RUnlock()
+	if c := p.connections[p.DefaultConnection()]; c != nil && c.client != nil {
+		return c.client.client
+	}
+	return nil
+}
+
+// Config returns current plugin configuration. Returned value must not be modified.
+func (p *IndyKitePlugin) Config() *Config {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.config
+}
+
+// DecisionCache returns cache of indy.is_authorized decisions, or nil when caching is not enabled.
+func (p *IndyKitePlugin) DecisionCache() *DecisionCache {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
-	w := os.Stdout
-	if _, err := fmt.Fprintln(w, event); err != nil {
-		p.manager.UpdatePluginStatus(PluginName, &plugins.Status{State: plugins.StateErr})
+	return p.decisionCache
+}
+
+// CircuitBreaker returns circuit breaker around IndyKite calls of the default connection, or nil when not enabled.
+func (p *IndyKitePlugin) CircuitBreaker() *CircuitBreaker {
+	return p.ConnectionCircuitBreaker(p.DefaultConnection())
+}
+
+// ConnectionCircuitBreaker returns circuit breaker around IndyKite calls of the named connection,
+// or nil when not enabled or the connection does not exist.
+func (p *IndyKitePlugin) ConnectionCircuitBreaker(name string) *CircuitBreaker {
+	p.clientMtx.RLock()
+	defer p.clientMtx.RUnlock()
+	if c := p.connections[name]; c != nil {
+		return c.breaker
 	}
 	return nil
 }
 
-// AuthorizationClient returns IndyKite authorization client created from plugin configuration.
-func (p *IndyKitePlugin) AuthorizationClient() *authorization.Client {
-	return p.authorizationClient
+// DefaultConnection returns name of the connection used by builtins without connection name,
+// or empty string when there is none.
+func (p *IndyKitePlugin) DefaultConnection() string {
+	return p.Config().defaultConnection()
+}
+
+// HasConnection reports if connection with name is configured.
+func (p *IndyKitePlugin) HasConnection(name string) bool {
+	_, ok := p.Config().connectionConfigs()[name]
+	return ok
+}
+
+// ConnectionStatus returns health of each IndyKite connection by name.
+func (p *IndyKitePlugin) ConnectionStatus() map[string]*plugins.Status {
+	p.clientMtx.RLock()
+	defer p.clientMtx.RUnlock()
+	statuses := make(map[string]*plugins.Status, len(p.connections))
+	for name, c := range p.connections {
+		statuses[name] = c.status()
+	}
+	return statuses
+}
+
+// AcquireAuthorizationClient returns IndyKite authorization client of the default connection
+// and release function, see AcquireConnectionClient.
+func (p *IndyKitePlugin) AcquireAuthorizationClient() (*authorization.Client, func()) {
+	return p.AcquireConnectionClient(p.DefaultConnection())
+}
+
+// AcquireConnectionClient returns IndyKite authorization client of the named connection and release function,
+// which must be called when the client is no longer used.
+// Connection is not closed by credential rotation until all acquired clients are released.
+// Returns nil client and no-op release, when plugin is not started, connection failed or does not exist.
+func (p *IndyKitePlugin) AcquireConnectionClient(name string) (*authorization.Client, func()) {
+	p.clientMtx.RLock()
+	defer p.clientMtx.RUnlock()
+	c := p.connections[name]
+	if c == nil || c.client == nil {
+		return nil, func() {}
+	}
+	h := c.client
+	h.inFlight.Add(1)
+	return h.client, h.inFlight.Done
+}
+
+// reconnect applies connections of newCfg, which replaces oldCfg. Connections with changed credentials
+// and those not connected yet are dialed concurrently, removed connections are closed once idle.
+// Circuit breakers are re-created when their configuration changes.
+func (p *IndyKitePlugin) reconnect(ctx context.Context, oldCfg, newCfg *Config) {
+	oldConns, newConns := oldCfg.connectionConfigs(), newCfg.connectionConfigs()
+	breakerChanged := !reflect.DeepEqual(oldCfg.CircuitBreaker, newCfg.CircuitBreaker)
+
+	var (
+		retired []*clientHandle
+		removed []string
+		dial    []string
+	)
+	p.clientMtx.Lock()
+	for name, c := range p.connections {
+		if _, ok := newConns[name]; !ok {
+			if c.client != nil {
+				retired = append(retired, c.client)
+			}
+			removed = append(removed, name)
+			delete(p.connections, name)
+		}
+	}
+	for name, connCfg := range newConns {
+		c, ok := p.connections[name]
+		if !ok {
+			c = &connection{}
+			p.connections[name] = c
+		}
+		if !ok || breakerChanged {
+			c.breaker = p.newCircuitBreaker(name, newCfg.CircuitBreaker)
+		}
+		if c.client == nil || connectionChanged(oldConns[name], connCfg) {
+			dial = append(dial, name)
+		}
+	}
+	p.clientMtx.Unlock()
+
+	for _, h := range retired {
+		go h.closeWhenIdle(p.logger)
+	}
+	p.releaseConnections(removed...)
+	// Connections are dialed concurrently, so unreachable ones do not delay each other.
+	var wg sync.WaitGroup
+	for _, name := range dial {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			p.connect(ctx, name, newConns[name])
+		}(name)
+	}
+	wg.Wait()
+	p.updateStatus()
+}
+
+// connect creates new client of the named connection from cfg and atomically replaces the current one.
+// It waits until the new connection is ready and keeps reporting whether IndyKite is reachable afterwards.
+// On failure the current client, if any, is kept and the error is reported in connection status.
+func (p *IndyKitePlugin) connect(ctx context.Context, name string, cfg *ConnectionConfig) {
+	h, err := newClientHandle(ctx, cfg)
+	if err != nil {
+		p.logger.Error("Failed to connect to IndyKite with connection %q: %v", name, err)
+	}
+	var unreachable error
+	if h != nil {
+		if unreachable = h.waitReady(ctx, connectTimeout); unreachable != nil {
+			p.logger.Warn("Connection %q: %v", name, unreachable)
+		}
+	}
+
+	p.clientMtx.Lock()
+	c := p.connections[name]
+	var retired *clientHandle
+	switch {
+	case c == nil:
+		// Connection was removed meanwhile.
+		retired = h
+	case err != nil:
+		c.err = err
+	default:
+		retired = c.client
+		c.client, c.err, c.unreachable = h, nil, unreachable
+	}
+	p.clientMtx.Unlock()
+
+	if retired != nil {
+		go retired.closeWhenIdle(p.logger)
+	}
+	if c != nil && err == nil {
+		go p.watchConnection(name, h)
+	}
+}
+
+// watchConnection reports in plugin status whether IndyKite is reachable by client h of the named connection,
+// until the connection is closed.
+func (p *IndyKitePlugin) watchConnection(name string, h *clientHandle) {
+	for state := h.conn.GetState(); state != connectivity.Shutdown; state = h.conn.GetState() {
+		switch state {
+		case connectivity.Ready:
+			p.setUnreachable(name, h, nil)
+		case connectivity.TransientFailure:
+			p.setUnreachable(name, h, errUnreachable(state))
+		case connectivity.Idle, connectivity.Connecting:
+		}
+		h.conn.WaitForStateChange(context.Background(), state)
+	}
+}
+
+// setUnreachable records whether IndyKite is reachable by client h of the named connection
+// and updates plugin status on change. Retired clients are ignored.
+func (p *IndyKitePlugin) setUnreachable(name string, h *clientHandle, unreachable error) {
+	p.clientMtx.Lock()
+	c := p.connections[name]
+	changed := c != nil && c.client == h && (c.unreachable == nil) != (unreachable == nil)
+	if changed {
+		c.unreachable = unreachable
+	}
+	p.clientMtx.Unlock()
+	if changed {
+		p.updateStatus()
+	}
+}
+
+// updateStatus reports health of all connections in plugin status.
+func (p *IndyKitePlugin) updateStatus() {
+	if p.manager == nil {
+		return
+	}
+	p.manager.UpdatePluginStatus(PluginName, aggregateStatus(p.ConnectionStatus()))
+}
+
+// newCircuitBreaker creates circuit breaker of the named connection, which reports its state in plugin status
+// as long as it is the current one.
+func (p *IndyKitePlugin) newCircuitBreaker(name string, cfg *CircuitBreakerConfig) *CircuitBreaker {
+	var breaker *CircuitBreaker
+	breaker = NewCircuitBreaker(cfg, func(state BreakerState) {
+		p.clientMtx.RLock()
+		c := p.connections[name]
+		current := c != nil && c.breaker == breaker && c.client != nil
+		p.clientMtx.RUnlock()
+		if !current {
+			return
+		}
+		if state == BreakerOpen {
+			p.logger.Warn("IndyKite circuit breaker of connection %q is open", name)
+		}
+		p.updateStatus()
+	})
+	return breaker
+}
+
+// connectedStatus returns plugin status of connected plugin, which is degraded while breaker is not closed.
+func connectedStatus(breaker *CircuitBreaker) *plugins.Status {
+	if breaker == nil {
+		return &plugins.Status{State: plugins.StateOK}
+	}
+	switch breaker.State() {
+	case BreakerOpen:
+		return &plugins.Status{
+			State:   plugins.StateWarn,
+			Message: "circuit breaker is open, IndyKite is not called",
+		}
+	case BreakerHalfOpen:
+		return &plugins.Status{
+			State:   plugins.StateWarn,
+			Message: "circuit breaker is half-open, probing IndyKite",
+		}
+	case BreakerClosed:
+	}
+	return &plugins.Status{State: plugins.StateOK}
 }
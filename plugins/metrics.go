@@ -0,0 +1,183 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "indykite"
+
+// Metrics are Prometheus metrics of indy.* builtins, exposed on OPA /metrics endpoint.
+// All methods are safe to call on nil Metrics.
+type Metrics struct {
+	requests      *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	resources     *prometheus.HistogramVec
+	cacheRequests *prometheus.CounterVec
+	cacheHitRatio *cacheHitRatio
+	inFlight      *prometheus.GaugeVec
+}
+
+// cacheHitRatio is collector of ratio of decision cache hits to all lookups by builtin.
+// Counts are kept by the collector, so plugin instances sharing it report the ratio of all their lookups.
+type cacheHitRatio struct {
+	desc  *prometheus.Desc
+	stats map[string]*cacheStats
+	mtx   sync.Mutex
+}
+
+type cacheStats struct {
+	hits, total float64
+}
+
+func newCacheHitRatio() *cacheHitRatio {
+	return &cacheHitRatio{
+		desc: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "builtin_cache_hit_ratio"),
+			"Ratio of decision cache hits to all lookups since the metrics were registered.",
+			[]string{"builtin"}, nil),
+		stats: make(map[string]*cacheStats),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *cacheHitRatio) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector.
+func (c *cacheHitRatio) Collect(ch chan<- prometheus.Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for builtin, stats := range c.stats {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, stats.hits/stats.total, builtin)
+	}
+}
+
+// observe counts decision cache lookup of builtin.
+func (c *cacheHitRatio) observe(builtin string, hit bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	stats, ok := c.stats[builtin]
+	if !ok {
+		stats = &cacheStats{}
+		c.stats[builtin] = stats
+	}
+	stats.total++
+	if hit {
+		stats.hits++
+	}
+}
+
+// NewMetrics creates metrics and registers them with reg. When reg is nil, metrics are not exposed.
+// Collectors already registered by previous plugin instance are reused.
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "builtin_requests_total",
+			Help:      "Number of indy.* builtin calls by gRPC result code.",
+		}, []string{"builtin", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "builtin_duration_seconds",
+			Help:      "Latency of indy.* builtin calls including retries.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"builtin"}),
+		resources: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "builtin_resources",
+			Help:      "Number of resources or resource types requested by indy.* builtin call.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		}, []string{"builtin"}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "builtin_cache_requests_total",
+			Help:      "Number of decision cache lookups by result, hit or miss.",
+		}, []string{"builtin", "result"}),
+		cacheHitRatio: newCacheHitRatio(),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "builtin_in_flight_requests",
+			Help:      "Number of indy.* builtin calls in progress.",
+		}, []string{"builtin"}),
+	}
+	if reg == nil {
+		return m, nil
+	}
+
+	var err error
+	if m.requests, err = register(reg, m.requests); err != nil {
+		return nil, err
+	}
+	if m.duration, err = register(reg, m.duration); err != nil {
+		return nil, err
+	}
+	if m.resources, err = register(reg, m.resources); err != nil {
+		return nil, err
+	}
+	if m.cacheRequests, err = register(reg, m.cacheRequests); err != nil {
+		return nil, err
+	}
+	if m.cacheHitRatio, err = register(reg, m.cacheHitRatio); err != nil {
+		return nil, err
+	}
+	if m.inFlight, err = register(reg, m.inFlight); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CallStarted marks builtin call as in flight.
+func (m *Metrics) CallStarted(builtin string) {
+	if m == nil {
+		return
+	}
+	m.inFlight.WithLabelValues(builtin).Inc()
+}
+
+// CallFinished observes finished builtin call, which was started with CallStarted.
+func (m *Metrics) CallFinished(record CallRecord) {
+	if m == nil {
+		return
+	}
+	m.inFlight.WithLabelValues(record.Builtin).Dec()
+	m.requests.WithLabelValues(record.Builtin, record.GRPCCode).Inc()
+	m.duration.WithLabelValues(record.Builtin).Observe(record.LatencyMillis / 1000)
+	m.resources.WithLabelValues(record.Builtin).Observe(float64(record.Resources))
+	if record.Cache == "" {
+		return
+	}
+	m.cacheRequests.WithLabelValues(record.Builtin, record.Cache).Inc()
+	m.cacheHitRatio.observe(record.Builtin, record.Cache == CacheHit)
+}
+
+// register registers c with reg, or returns already registered collector of the same description.
+func register[T prometheus.Collector](reg prometheus.Registerer, c T) (T, error) {
+	err := reg.Register(c)
+	if err == nil {
+		return c, nil
+	}
+	var already prometheus.AlreadyRegisteredError
+	if errors.As(err, &already) {
+		if existing, ok := already.ExistingCollector.(T); ok {
+			return existing, nil
+		}
+	}
+	return c, err
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins_test
+
+import (
+	"context"
+	"strings"
+
+	opaplugins "github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	var registry *prometheus.Registry
+
+	BeforeEach(func() {
+		registry = prometheus.NewRegistry()
+	})
+
+	It("Observes builtin calls", func() {
+		metrics, err := plugins.NewMetrics(registry)
+		Expect(err).To(Succeed())
+
+		metrics.CallStarted("indy.is_authorized")
+		metrics.CallStarted("indy.is_authorized")
+		Expect(testutil.CollectAndCompare(registry, strings.NewReader(`
+# HELP indykite_builtin_in_flight_requests Number of indy.* builtin calls in progress.
+# TYPE indykite_builtin_in_flight_requests gauge
+indykite_builtin_in_flight_requests{builtin="indy.is_authorized"} 2
+`), "indykite_builtin_in_flight_requests")).To(Succeed())
+
+		metrics.CallFinished(plugins.CallRecord{
+			Builtin: "indy.is_authorized", GRPCCode: "OK", Cache: plugins.CacheHit, Resources: 3, LatencyMillis: 20,
+		})
+		metrics.CallFinished(plugins.CallRecord{
+			Builtin: "indy.is_authorized", GRPCCode: "Unavailable", Cache: plugins.CacheMiss, Resources: 1,
+		})
+		Expect(testutil.CollectAndCompare(registry, strings.NewReader(`
+# HELP indykite_builtin_cache_hit_ratio Ratio of decision cache hits to all lookups since the metrics were registered.
+# TYPE indykite_builtin_cache_hit_ratio gauge
+indykite_builtin_cache_hit_ratio{builtin="indy.is_authorized"} 0.5
+# HELP indykite_builtin_in_flight_requests Number of indy.* builtin calls in progress.
+# TYPE indykite_builtin_in_flight_requests gauge
+indykite_builtin_in_flight_requests{builtin="indy.is_authorized"} 0
+# HELP indykite_builtin_requests_total Number of indy.* builtin calls by gRPC result code.
+# TYPE indykite_builtin_requests_total counter
+indykite_builtin_requests_total{builtin="indy.is_authorized",code="OK"} 1
+indykite_builtin_requests_total{builtin="indy.is_authorized",code="Unavailable"} 1
+`), "indykite_builtin_cache_hit_ratio", "indykite_builtin_in_flight_requests",
+			"indykite_builtin_requests_total")).To(Succeed())
+		Expect(testutil.CollectAndCount(registry, "indykite_builtin_duration_seconds")).To(Equal(1))
+		Expect(testutil.CollectAndCount(registry, "indykite_builtin_resources")).To(Equal(1))
+		Expect(testutil.CollectAndCount(registry, "indykite_builtin_cache_requests_total")).To(Equal(2))
+	})
+
+	It("Reuses collectors registered by previous plugin", func() {
+		manager, err := opaplugins.New([]byte(`{}`), "test", inmem.New(), opaplugins.WithPrometheusRegister(registry))
+		Expect(err).To(Succeed())
+		first, err := plugins.NewPlugin(manager, []byte(`{}`))
+		Expect(err).To(Succeed())
+		DeferCleanup(first.Stop, context.Background())
+		second, err := plugins.NewPlugin(manager, []byte(`{}`))
+		Expect(err).To(Succeed())
+		DeferCleanup(second.Stop, context.Background())
+		Expect(first.Metrics()).NotTo(BeNil())
+		Expect(second.Metrics()).NotTo(BeNil())
+
+		first.Metrics().CallFinished(plugins.CallRecord{Builtin: "indy.who_authorized", GRPCCode: "OK"})
+		second.Metrics().CallFinished(plugins.CallRecord{Builtin: "indy.who_authorized", GRPCCode: "OK"})
+		Expect(testutil.CollectAndCompare(registry, strings.NewReader(`
+# HELP indykite_builtin_requests_total Number of indy.* builtin calls by gRPC result code.
+# TYPE indykite_builtin_requests_total counter
+indykite_builtin_requests_total{builtin="indy.who_authorized",code="OK"} 2
+`), "indykite_builtin_requests_total")).To(Succeed())
+
+		// Cache hit ratio is computed from lookups of both plugins.
+		first.Metrics().CallFinished(plugins.CallRecord{Builtin: "indy.is_authorized", Cache: plugins.CacheHit})
+		second.Metrics().CallFinished(plugins.CallRecord{Builtin: "indy.is_authorized", Cache: plugins.CacheMiss})
+		second.Metrics().CallFinished(plugins.CallRecord{Builtin: "indy.is_authorized", Cache: plugins.CacheMiss})
+		first.Metrics().CallFinished(plugins.CallRecord{Builtin: "indy.is_authorized", Cache: plugins.CacheMiss})
+		Expect(testutil.CollectAndCompare(registry, strings.NewReader(`
+# HELP indykite_builtin_cache_hit_ratio Ratio of decision cache hits to all lookups since the metrics were registered.
+# TYPE indykite_builtin_cache_hit_ratio gauge
+indykite_builtin_cache_hit_ratio{builtin="indy.is_authorized"} 0.25
+`), "indykite_builtin_cache_hit_ratio")).To(Succeed())
+	})
+
+	It("Ignores nil metrics", func() {
+		var metrics *plugins.Metrics
+		metrics.CallStarted("indy.is_authorized")
+		metrics.CallFinished(plugins.CallRecord{Builtin: "indy.is_authorized"})
+	})
+})
@@ -0,0 +1,305 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	json "github.com/json-iterator/go"
+	"github.com/open-policy-agent/opa/plugins/logs"
+)
+
+// Redaction modes.
+const (
+	// RedactionModePlaceholder replaces values with fixed placeholder.
+	RedactionModePlaceholder = "placeholder"
+	// RedactionModeHash replaces values with SHA-256 hash, so equal values can still be correlated.
+	RedactionModeHash = "hash"
+
+	defaultRedactionPlaceholder = "[REDACTED]"
+	inputParamsField            = "inputParams"
+	wildcardSegment             = "*"
+)
+
+// jwtPattern matches JWT-shaped strings, header and payload are base64url encoded JSON objects.
+var jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`)
+
+type (
+	// RedactionConfig defines which values are masked before decision log events leave the process.
+	RedactionConfig struct {
+		// Mode is placeholder or hash. Defaults to placeholder.
+		Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+		// Placeholder replaces masked values in placeholder mode. Defaults to [REDACTED].
+		Placeholder string `json:"placeholder,omitempty" yaml:"placeholder,omitempty"`
+		// Paths are slash separated paths in the event, like /input/subject/id.
+		// Segment * matches any object key or array index.
+		Paths []string `json:"paths,omitempty" yaml:"paths,omitempty"`
+		// InputParams are keys of inputParams objects, which are masked wherever inputParams appear.
+		InputParams []string `json:"input_params,omitempty" yaml:"input_params,omitempty"`
+		// KeepTokens disables masking of JWT-shaped strings, which are masked by default.
+		KeepTokens bool `json:"keep_tokens,omitempty" yaml:"keep_tokens,omitempty"`
+	}
+
+	// Redactor masks sensitive values in decision log events and other logged data.
+	Redactor struct {
+		inputParams map[string]bool
+		placeholder string
+		paths       [][]string
+		hash        bool
+		maskTokens  bool
+	}
+)
+
+// Validate checks redaction configuration.
+func (c *RedactionConfig) Validate() error {
+	switch c.Mode {
+	case "", RedactionModePlaceholder, RedactionModeHash:
+	default:
+		return fmt.Errorf("decision_logs: unknown redaction mode '%s'", c.Mode)
+	}
+	for _, path := range c.Paths {
+		if !strings.HasPrefix(path, "/") || len(path) < 2 {
+			return fmt.Errorf("decision_logs: redaction path '%s' must start with / and name a field", path)
+		}
+	}
+	return nil
+}
+
+// NewRedactor creates redactor from cfg. With nil cfg only tokens are masked.
+func NewRedactor(cfg *RedactionConfig) *Redactor {
+	if cfg == nil {
+		cfg = &RedactionConfig{}
+	}
+	r := &Redactor{
+		inputParams: make(map[string]bool, len(cfg.InputParams)),
+		placeholder: cfg.Placeholder,
+		hash:        cfg.Mode == RedactionModeHash,
+		maskTokens:  !cfg.KeepTokens,
+	}
+	if r.placeholder == "" {
+		r.placeholder = defaultRedactionPlaceholder
+	}
+	for _, key := range cfg.InputParams {
+		r.inputParams[key] = true
+	}
+	for _, path := range cfg.Paths {
+		r.paths = append(r.paths, strings.Split(strings.TrimPrefix(path, "/"), "/"))
+	}
+	return r
+}
+
+// RedactEvent returns copy of event with sensitive values masked. Original event is not modified.
+// Input, results and builtin cache are masked by paths, inputParams and tokens, query, error and HTTP headers
+// by tokens. Masked paths are appended to event.Masked.
+func (r *Redactor) RedactEvent(event logs.EventV1) logs.EventV1 {
+	var masked []string
+	redactField := func(name string, value *interface{}) *interface{} {
+		if value == nil {
+			return nil
+		}
+		out := r.redact(*value, []string{name}, &masked)
+		return &out
+	}
+	event.Input = redactField("input", event.Input)
+	event.Result = redactField("result", event.Result)
+	event.MappedResult = redactField("mapped_result", event.MappedResult)
+	event.NDBuiltinCache = redactField("nd_builtin_cache", event.NDBuiltinCache)
+	if query := r.RedactString(event.Query); query != event.Query {
+		event.Query = query
+		masked = append(masked, "/query")
+	}
+	if err, ok := r.redactError(event.Error); ok {
+		event.Error = err
+		masked = append(masked, "/error")
+	}
+	if headers, names := r.redactHeaders(event.RequestContext); len(names) > 0 {
+		event.RequestContext = &logs.RequestContext{HTTPRequest: &logs.HTTPRequestContext{Headers: headers}}
+		for _, name := range names {
+			masked = append(masked, "/request_context/http/headers/"+name)
+		}
+	}
+	if len(masked) > 0 {
+		event.Masked = append(append([]string(nil), event.Masked...), masked...)
+	}
+	return event
+}
+
+// redactedError is error of decision log event with masked tokens. It is encoded as the original error
+// with tokens masked in all its strings.
+type redactedError struct {
+	value   interface{}
+	message string
+}
+
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+// MarshalJSON encodes masked value of the original error.
+func (e *redactedError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.value)
+}
+
+// redactError returns copy of err with masked tokens, or false when err contains none.
+func (r *Redactor) redactError(err error) (error, bool) {
+	if err == nil || !r.maskTokens {
+		return nil, false
+	}
+	var value interface{}
+	if data, mErr := json.Marshal(err); mErr == nil {
+		_ = json.Unmarshal(data, &value)
+	}
+	redacted := &redactedError{message: r.RedactString(err.Error()), value: r.Redact(value)}
+	if redacted.message == err.Error() && reflect.DeepEqual(redacted.value, value) {
+		return nil, false
+	}
+	return redacted, true
+}
+
+// redactHeaders returns copy of HTTP headers of rc with masked tokens and sorted names of headers,
+// whose values were masked. Without masked header, no copy is returned.
+func (r *Redactor) redactHeaders(rc *logs.RequestContext) (map[string][]string, []string) {
+	if rc == nil || rc.HTTPRequest == nil {
+		return nil, nil
+	}
+	var names []string
+	headers := make(map[string][]string, len(rc.HTTPRequest.Headers))
+	for name, values := range rc.HTTPRequest.Headers {
+		out := make([]string, len(values))
+		changed := false
+		for i, v := range values {
+			out[i] = r.RedactString(v)
+			changed = changed || out[i] != v
+		}
+		if changed {
+			names = append(names, name)
+		}
+		headers[name] = out
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+	return headers, names
+}
+
+// Redact returns copy of JSON compatible value with tokens and configured inputParams masked.
+// Paths are not applied, as they are relative to the decision log event.
+func (r *Redactor) Redact(value interface{}) interface{} {
+	return r.redact(value, nil, nil)
+}
+
+// RedactString masks tokens in s.
+func (r *Redactor) RedactString(s string) string {
+	if !r.maskTokens {
+		return s
+	}
+	return jwtPattern.ReplaceAllStringFunc(s, func(token string) string {
+		return r.Mask(token)
+	})
+}
+
+// redact walks value and returns masked copy. When path is nil, path rules are not evaluated.
+func (r *Redactor) redact(value interface{}, path []string, masked *[]string) interface{} {
+	if path != nil && r.matchesPath(path) {
+		*masked = append(*masked, "/"+strings.Join(path, "/"))
+		return r.Mask(value)
+	}
+	switch v := value.(type) {
+	case string:
+		return r.RedactString(v)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if key == inputParamsField {
+				item = r.redactInputParams(item)
+			}
+			out[key] = r.redact(item, childPath(path, key), masked)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = r.redact(item, childPath(path, strconv.Itoa(i)), masked)
+		}
+		return out
+	default:
+		return value
+	}
+}
+
+func (r *Redactor) redactInputParams(value interface{}) interface{} {
+	params, ok := value.(map[string]interface{})
+	if !ok || len(r.inputParams) == 0 {
+		return value
+	}
+	out := make(map[string]interface{}, len(params))
+	for key, item := range params {
+		if r.inputParams[key] {
+			item = r.Mask(item)
+		}
+		out[key] = item
+	}
+	return out
+}
+
+func (r *Redactor) matchesPath(path []string) bool {
+	for _, rule := range r.paths {
+		if len(rule) != len(path) {
+			continue
+		}
+		matches := true
+		for i, segment := range rule {
+			if segment != wildcardSegment && segment != path[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// Mask returns placeholder or hash of value according to redaction mode.
+func (r *Redactor) Mask(value interface{}) string {
+	if !r.hash {
+		return r.placeholder
+	}
+	var data []byte
+	if s, ok := value.(string); ok {
+		data = []byte(s)
+	} else {
+		// Value comes from decoded JSON, so it can always be encoded back.
+		data, _ = json.Marshal(value)
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func childPath(path []string, segment string) []string {
+	if path == nil {
+		return nil
+	}
+	return append(path[:len(path):len(path)], segment)
+}
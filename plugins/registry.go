@@ -0,0 +1,175 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// registry keeps plugins of all OPA instances in the process.
+// Lookups read immutable snapshot without locking, changes replace the snapshot atomically.
+type registry struct {
+	mtx      sync.Mutex
+	snapshot atomic.Pointer[registrySnapshot]
+}
+
+type registrySnapshot struct {
+	// byRuntime maps runtime information of OPA instance, which is passed to every builtin call,
+	// to the plugin of the same instance.
+	byRuntime map[*ast.Term]*IndyKitePlugin
+	// embedded maps runtime information created by NewEmbedded, which is the handle of rego instances
+	// bound to the plugin, to the plugin.
+	embedded map[*ast.Term]*IndyKitePlugin
+	// all plugins of OPA runtime in order of creation.
+	all []*IndyKitePlugin
+}
+
+type pluginContextKey struct{}
+
+var (
+	registered registry
+	// embeddedLocation marks runtime information created by NewEmbedded, so evaluation with it fails
+	// after the plugin was released. Location is not part of the value, policies cannot see it.
+	embeddedLocation = &ast.Location{File: PluginName}
+
+	errEmbeddedReleased = errors.New("IndyKite settings of the rego instance were released")
+	errNotResolved      = errors.New("IndyKite plugin of the rego instance cannot be resolved, " +
+		"its runtime information matches none of registered plugins")
+)
+
+// register adds p, replacing plugin previously registered for the same OPA instance.
+func (r *registry) register(p *IndyKitePlugin) {
+	r.update(func(s *registrySnapshot) {
+		if old, ok := s.byRuntime[p.runtime()]; ok && p.runtime() != nil {
+			s.all = removePlugin(s.all, old)
+		}
+		s.all = append(s.all, p)
+		if p.runtime() != nil {
+			s.byRuntime[p.runtime()] = p
+		}
+	})
+}
+
+// registerEmbedded adds embedded plugin p for evaluations with its runtime information.
+// Embedded plugins are not used as the only registered plugin.
+func (r *registry) registerEmbedded(p *IndyKitePlugin) {
+	r.update(func(s *registrySnapshot) {
+		s.embedded[p.embedded] = p
+	})
+}
+
+// unregister removes p, if it is still registered.
+func (r *registry) unregister(p *IndyKitePlugin) {
+	r.update(func(s *registrySnapshot) {
+		s.all = removePlugin(s.all, p)
+		if s.byRuntime[p.runtime()] == p {
+			delete(s.byRuntime, p.runtime())
+		}
+		if s.embedded[p.embedded] == p {
+			delete(s.embedded, p.embedded)
+		}
+	})
+}
+
+// update applies change to a copy of current snapshot and swaps it in.
+func (r *registry) update(change func(s *registrySnapshot)) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	next := &registrySnapshot{
+		byRuntime: make(map[*ast.Term]*IndyKitePlugin),
+		embedded:  make(map[*ast.Term]*IndyKitePlugin),
+	}
+	if current := r.snapshot.Load(); current != nil {
+		for k, v := range current.byRuntime {
+			next.byRuntime[k] = v
+		}
+		for k, v := range current.embedded {
+			next.embedded[k] = v
+		}
+		next.all = append(next.all, current.all...)
+	}
+	change(next)
+	r.snapshot.Store(next)
+}
+
+func (r *registry) load() *registrySnapshot {
+	if s := r.snapshot.Load(); s != nil {
+		return s
+	}
+	return &registrySnapshot{}
+}
+
+func removePlugin(all []*IndyKitePlugin, p *IndyKitePlugin) []*IndyKitePlugin {
+	for i, v := range all {
+		if v == p {
+			return append(all[:i:i], all[i+1:]...)
+		}
+	}
+	return all
+}
+
+// WithPlugin returns ctx, in which builtins use plugin p regardless of OPA instance evaluating the query.
+// It is meant for embedding OPA as a library with multiple plugin instances.
+func WithPlugin(ctx context.Context, p *IndyKitePlugin) context.Context {
+	return context.WithValue(ctx, pluginContextKey{}, p)
+}
+
+// Resolve returns plugin which serves evaluation with ctx and runtime information of OPA instance.
+// Plugin set by WithPlugin takes precedence, then plugin of OPA instance or plugin created by NewEmbedded
+// with given runtime. Runtime information is matched by identity, not by value. When neither matches,
+// the only registered plugin is returned, or nil if there is none. Returns error, when plugin created
+// by NewEmbedded was released or when multiple plugins are registered and none matches, so evaluation does not
+// silently continue with other settings or client.
+// Plugins created by NewEmbedded count only for evaluations with runtime information, evaluations without it
+// cannot have been bound to them.
+func Resolve(ctx context.Context, runtime *ast.Term) (*IndyKitePlugin, error) {
+	if ctx != nil {
+		if p, ok := ctx.Value(pluginContextKey{}).(*IndyKitePlugin); ok && p != nil {
+			return p, nil
+		}
+	}
+	s := registered.load()
+	if runtime != nil {
+		if p, ok := s.byRuntime[runtime]; ok {
+			return p, nil
+		}
+		if p, ok := s.embedded[runtime]; ok {
+			return p, nil
+		}
+		if runtime.Location == embeddedLocation {
+			return nil, errEmbeddedReleased
+		}
+	}
+	switch {
+	case len(s.all) > 1, runtime != nil && len(s.embedded) > 0:
+		return nil, errNotResolved
+	case len(s.all) == 1:
+		return s.all[0], nil
+	}
+	return nil, nil
+}
+
+// runtime returns runtime information of the OPA instance of the plugin.
+func (p *IndyKitePlugin) runtime() *ast.Term {
+	if p.manager == nil {
+		return p.embedded
+	}
+	return p.manager.Info
+}
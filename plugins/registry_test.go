@@ -0,0 +1,125 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins_test
+
+import (
+	"context"
+	"sync"
+
+	"github.com/open-policy-agent/opa/ast"
+	opaplugins "github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/storage/inmem"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+	createPlugin := func(id string) (*plugins.IndyKitePlugin, *ast.Term) {
+		info := ast.ObjectTerm(ast.Item(ast.StringTerm("id"), ast.StringTerm(id)))
+		manager, err := opaplugins.New([]byte(`{}`), id, inmem.New(), opaplugins.Info(info))
+		Expect(err).To(Succeed())
+		plugin, err := plugins.NewPlugin(manager, []byte(`{}`))
+		Expect(err).To(Succeed())
+		return plugin, info
+	}
+	newPlugin := func(id string) (*plugins.IndyKitePlugin, *ast.Term) {
+		plugin, info := createPlugin(id)
+		DeferCleanup(plugin.Stop, context.Background())
+		return plugin, info
+	}
+
+	It("Resolves plugin of OPA instance by runtime information", func() {
+		first, firstInfo := newPlugin("first")
+		second, secondInfo := newPlugin("second")
+
+		Expect(plugins.Resolve(context.Background(), firstInfo)).To(BeIdenticalTo(first))
+		Expect(plugins.Resolve(context.Background(), secondInfo)).To(BeIdenticalTo(second))
+		// Equal runtime information of other instance must not match.
+		_, err := plugins.Resolve(context.Background(), firstInfo.Copy())
+		Expect(err).To(MatchError(ContainSubstring("IndyKite plugin of the rego instance cannot be resolved")))
+	})
+
+	It("Fails without matching runtime information, when multiple plugins are registered", func() {
+		newPlugin("first")
+		newPlugin("second")
+
+		plugin, err := plugins.Resolve(context.Background(), nil)
+		Expect(plugin).To(BeNil())
+		Expect(err).To(MatchError(ContainSubstring("IndyKite plugin of the rego instance cannot be resolved")))
+	})
+
+	It("Prefers plugin from context", func() {
+		first, _ := newPlugin("first")
+		_, secondInfo := newPlugin("second")
+
+		ctx := plugins.WithPlugin(context.Background(), first)
+		Expect(plugins.Resolve(ctx, secondInfo)).To(BeIdenticalTo(first))
+	})
+
+	It("Does not resolve stopped plugin", func() {
+		plugin, info := newPlugin("stopped")
+		plugin.Stop(context.Background())
+
+		resolved, _ := plugins.Resolve(context.Background(), info)
+		Expect(resolved).NotTo(BeIdenticalTo(plugin))
+	})
+
+	It("Resolves embedded plugin by its runtime information", func() {
+		runtime := ast.MustParseTerm(`{"env": {"TENANT": "first"}}`)
+		plugin := plugins.NewEmbedded(nil, nil, nil, runtime)
+		DeferCleanup(plugin.Unregister)
+		Expect(plugin.Runtime().Equal(runtime)).To(BeTrue())
+
+		Expect(plugins.Resolve(context.Background(), plugin.Runtime())).To(BeIdenticalTo(plugin))
+		// Equal runtime information, including the one passed to NewEmbedded, must not match.
+		_, err := plugins.Resolve(context.Background(), runtime)
+		Expect(err).To(MatchError(ContainSubstring("IndyKite plugin of the rego instance cannot be resolved")))
+		_, err = plugins.Resolve(context.Background(), plugin.Runtime().Copy())
+		Expect(err).To(HaveOccurred())
+
+		// Evaluation without runtime information is not bound to embedded plugin.
+		Expect(plugins.Resolve(context.Background(), nil)).To(BeNil())
+
+		plugin.Unregister()
+		_, err = plugins.Resolve(context.Background(), plugin.Runtime())
+		Expect(err).To(MatchError("IndyKite settings of the rego instance were released"))
+	})
+
+	It("Resolves concurrently with plugins being created and stopped", func() {
+		plugin, info := newPlugin("stable")
+
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				defer GinkgoRecover()
+				for range 100 {
+					Expect(plugins.Resolve(context.Background(), info)).To(BeIdenticalTo(plugin))
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				defer GinkgoRecover()
+				other, _ := createPlugin("other")
+				other.Stop(context.Background())
+			}()
+		}
+		wg.Wait()
+	})
+})
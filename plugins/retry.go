@@ -0,0 +1,125 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBaseBackoff = 100 * time.Millisecond
+	defaultRetryMaxBackoff  = 2 * time.Second
+	defaultRetryJitter      = 0.2
+)
+
+var defaultRetryableCodes = []codes.Code{
+	codes.Unavailable,
+	codes.DeadlineExceeded,
+	codes.ResourceExhausted,
+	codes.Aborted,
+}
+
+// RetryConfig defines retries of IndyKite calls, which failed with transient gRPC errors.
+// Zero values are replaced with defaults, except explicitly set Jitter.
+type RetryConfig struct {
+	// RetryableCodes lists gRPC codes, like Unavailable or DEADLINE_EXCEEDED, which are retried.
+	// Defaults to Unavailable, DeadlineExceeded, ResourceExhausted and Aborted.
+	RetryableCodes []string `json:"retryable_codes,omitempty" yaml:"retryable_codes,omitempty"`
+	// MaxAttempts is the total number of attempts including the first one. Defaults to 3.
+	MaxAttempts int `json:"max_attempts,omitempty" yaml:"max_attempts,omitempty"`
+	// BaseBackoffMillis is delay before the first retry, doubled for every next one. Defaults to 100ms.
+	BaseBackoffMillis int `json:"base_backoff_ms,omitempty" yaml:"base_backoff_ms,omitempty"`
+	// MaxBackoffMillis caps delay between attempts. Defaults to 2s.
+	MaxBackoffMillis int `json:"max_backoff_ms,omitempty" yaml:"max_backoff_ms,omitempty"`
+	// Jitter randomizes each delay by up to the given fraction, must be between 0 and 1.
+	// Defaults to 0.2 when not set, 0 disables jitter.
+	Jitter *float64 `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+}
+
+// Validate checks retry configuration.
+func (c *RetryConfig) Validate() error {
+	if c.MaxAttempts < 0 || c.BaseBackoffMillis < 0 || c.MaxBackoffMillis < 0 {
+		return fmt.Errorf("retry: max_attempts, base_backoff_ms and max_backoff_ms must not be negative")
+	}
+	if c.Jitter != nil && (*c.Jitter < 0 || *c.Jitter > 1) {
+		return fmt.Errorf("retry: jitter must be between 0 and 1, got %v", *c.Jitter)
+	}
+	_, err := c.Codes()
+	return err
+}
+
+// Codes returns set of retryable gRPC codes.
+func (c *RetryConfig) Codes() (map[codes.Code]bool, error) {
+	result := make(map[codes.Code]bool)
+	if len(c.RetryableCodes) == 0 {
+		for _, code := range defaultRetryableCodes {
+			result[code] = true
+		}
+		return result, nil
+	}
+	for _, name := range c.RetryableCodes {
+		code, ok := ParseCode(name)
+		if !ok {
+			return nil, fmt.Errorf("retry: unknown gRPC code '%s'", name)
+		}
+		result[code] = true
+	}
+	return result, nil
+}
+
+// Attempts returns max number of attempts with default applied.
+func (c *RetryConfig) Attempts() int {
+	if c.MaxAttempts == 0 {
+		return defaultRetryMaxAttempts
+	}
+	return c.MaxAttempts
+}
+
+// Backoff returns base and max backoff with defaults applied.
+func (c *RetryConfig) Backoff() (base, maxBackoff time.Duration) {
+	base, maxBackoff = defaultRetryBaseBackoff, defaultRetryMaxBackoff
+	if c.BaseBackoffMillis > 0 {
+		base = time.Duration(c.BaseBackoffMillis) * time.Millisecond
+	}
+	if c.MaxBackoffMillis > 0 {
+		maxBackoff = time.Duration(c.MaxBackoffMillis) * time.Millisecond
+	}
+	return base, maxBackoff
+}
+
+// JitterFraction returns jitter with default applied.
+func (c *RetryConfig) JitterFraction() float64 {
+	if c.Jitter == nil {
+		return defaultRetryJitter
+	}
+	return *c.Jitter
+}
+
+// ParseCode converts gRPC code name into codes.Code. Both Go names, like DeadlineExceeded,
+// and canonical names, like DEADLINE_EXCEEDED, are accepted case-insensitively.
+func ParseCode(name string) (codes.Code, bool) {
+	normalized := strings.ToLower(strings.ReplaceAll(name, "_", ""))
+	for code := codes.OK; code <= codes.Unauthenticated; code++ {
+		if strings.ToLower(code.String()) == normalized {
+			return code, true
+		}
+	}
+	return codes.Unknown, false
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins_test
+
+import (
+	"encoding/json"
+
+	"google.golang.org/grpc/codes"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RetryConfig", func() {
+	jitter := func(v float64) *float64 { return &v }
+
+	DescribeTable("ParseCode",
+		func(name string, expected codes.Code, ok bool) {
+			code, found := plugins.ParseCode(name)
+			Expect(found).To(Equal(ok))
+			Expect(code).To(Equal(expected))
+		},
+		Entry("Go name", "DeadlineExceeded", codes.DeadlineExceeded, true),
+		Entry("Canonical name", "DEADLINE_EXCEEDED", codes.DeadlineExceeded, true),
+		Entry("Lower case", "unavailable", codes.Unavailable, true),
+		Entry("Unknown", "Oops", codes.Unknown, false),
+	)
+
+	DescribeTable("Validate",
+		func(cfg *plugins.RetryConfig, errMatcher OmegaMatcher) {
+			Expect(cfg.Validate()).To(errMatcher)
+		},
+		Entry("Empty config", &plugins.RetryConfig{}, Succeed()),
+		Entry("Valid config", &plugins.RetryConfig{
+			RetryableCodes: []string{"Unavailable"}, MaxAttempts: 5, Jitter: jitter(0.5),
+		}, Succeed()),
+		Entry("Unknown code", &plugins.RetryConfig{RetryableCodes: []string{"Oops"}},
+			MatchError(ContainSubstring("unknown gRPC code 'Oops'"))),
+		Entry("Invalid jitter", &plugins.RetryConfig{Jitter: jitter(2)},
+			MatchError(ContainSubstring("jitter must be between 0 and 1"))),
+		Entry("Negative attempts", &plugins.RetryConfig{MaxAttempts: -1},
+			MatchError(ContainSubstring("must not be negative"))),
+	)
+
+	DescribeTable("JitterFraction",
+		func(cfg string, expected float64) {
+			var retry plugins.RetryConfig
+			Expect(json.Unmarshal([]byte(cfg), &retry)).To(Succeed())
+			Expect(retry.Validate()).To(Succeed())
+			Expect(retry.JitterFraction()).To(Equal(expected))
+		},
+		Entry("Default", `{}`, 0.2),
+		Entry("Explicit zero disables jitter", `{"jitter": 0}`, 0.0),
+		Entry("Configured", `{"jitter": 0.5}`, 0.5),
+	)
+})
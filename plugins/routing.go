@@ -0,0 +1,83 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// defaultRoutingClaim is claim of access token used for routing, when not configured.
+const defaultRoutingClaim = "iss"
+
+// RoutingConfig selects IndyKite connection from claim of the access token in subject of builtins,
+// so a single OPA serves multiple tenants. Token is decoded locally without verifying its signature,
+// IndyKite verifies it during the call. Tokens without matching route are rejected before calling IndyKite.
+type RoutingConfig struct {
+	// Claim of access token with tenant identifier. Defaults to iss.
+	Claim string `json:"claim,omitempty" yaml:"claim,omitempty"`
+	// Routes maps claim values to connection names.
+	Routes map[string]string `json:"routes,omitempty" yaml:"routes,omitempty"`
+}
+
+// Validate checks routing configuration, connection names are checked against connections.
+func (c *RoutingConfig) Validate(connections map[string]*ConnectionConfig) error {
+	if len(c.Routes) == 0 {
+		return errors.New("routes must not be empty")
+	}
+	for value, name := range c.Routes {
+		if _, ok := connections[name]; !ok {
+			return fmt.Errorf("route %q: unknown connection %q", value, name)
+		}
+	}
+	return nil
+}
+
+// Route returns name of the connection for access token, based on value of the routing claim.
+func (c *RoutingConfig) Route(token string) (string, error) {
+	claim := c.Claim
+	if claim == "" {
+		claim = defaultRoutingClaim
+	}
+	parsed, err := jwt.ParseString(token, jwt.WithVerify(false), jwt.WithValidate(false))
+	if err != nil {
+		return "", errors.New("access token is not a valid JWT")
+	}
+	raw, ok := parsed.Get(claim)
+	if !ok {
+		return "", fmt.Errorf("access token has no %s claim", claim)
+	}
+	value, ok := raw.(string)
+	if !ok {
+		return "", fmt.Errorf("access token claim %s is not a string", claim)
+	}
+	name, ok := c.Routes[value]
+	if !ok {
+		return "", fmt.Errorf("access token %s %q is not routed to any IndyKite connection", claim, value)
+	}
+	return name, nil
+}
+
+// RouteToken returns name of the connection for access token when routing is configured,
+// or empty string otherwise.
+func (p *IndyKitePlugin) RouteToken(token string) (string, error) {
+	routing := p.Config().Routing
+	if routing == nil {
+		return "", nil
+	}
+	return routing.Route(token)
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// unsignedToken returns JWT with claims and fake signature.
+func unsignedToken(claims map[string]any) string {
+	payload, err := json.Marshal(claims)
+	Expect(err).To(Succeed())
+	return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload) + ".c2lnbmF0dXJl"
+}
+
+var _ = Describe("RoutingConfig", func() {
+	routing := &plugins.RoutingConfig{Routes: map[string]string{
+		"https://eu.example.com": "eu",
+		"https://us.example.com": "us",
+	}}
+
+	DescribeTable("Route",
+		func(cfg *plugins.RoutingConfig, token string, expected string, errMatcher OmegaMatcher) {
+			name, err := cfg.Route(token)
+			Expect(err).To(errMatcher)
+			Expect(name).To(Equal(expected))
+		},
+		Entry("Issuer", routing, unsignedToken(map[string]any{"iss": "https://us.example.com"}), "us", Succeed()),
+		Entry("Tenant claim", &plugins.RoutingConfig{Claim: "tenant", Routes: map[string]string{"acme": "eu"}},
+			unsignedToken(map[string]any{"iss": "https://us.example.com", "tenant": "acme"}), "eu", Succeed()),
+		Entry("Expired token is routed", routing,
+			unsignedToken(map[string]any{"iss": "https://eu.example.com", "exp": 1}), "eu", Succeed()),
+		Entry("Unknown issuer", routing, unsignedToken(map[string]any{"iss": "https://evil.example.com"}), "",
+			MatchError(`access token iss "https://evil.example.com" is not routed to any IndyKite connection`)),
+		Entry("Missing claim", routing, unsignedToken(map[string]any{"sub": "user"}), "",
+			MatchError("access token has no iss claim")),
+		Entry("Claim is not a string", &plugins.RoutingConfig{Claim: "tenant", Routes: map[string]string{"1": "eu"}},
+			unsignedToken(map[string]any{"tenant": 1}), "", MatchError("access token claim tenant is not a string")),
+		Entry("Not a JWT", routing, "not-a-token", "", MatchError("access token is not a valid JWT")),
+	)
+
+	DescribeTable("Validate",
+		func(cfg *plugins.RoutingConfig, errMatcher OmegaMatcher) {
+			Expect(cfg.Validate(map[string]*plugins.ConnectionConfig{"eu": {}, "us": {}})).To(errMatcher)
+		},
+		Entry("Valid routes", routing, Succeed()),
+		Entry("No routes", &plugins.RoutingConfig{}, MatchError("routes must not be empty")),
+		Entry("Unknown connection", &plugins.RoutingConfig{Routes: map[string]string{"https://ap.example.com": "ap"}},
+			MatchError(`route "https://ap.example.com": unknown connection "ap"`)),
+	)
+})
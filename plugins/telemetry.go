@@ -0,0 +1,149 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/logging"
+)
+
+const (
+	// callRecordsTTL is how long records wait for decision log event, which may never come
+	// when decision is not logged.
+	callRecordsTTL = time.Minute
+	// callRecordsMaxSize caps number of decisions with records, the oldest ones are evicted first.
+	callRecordsMaxSize = 10000
+)
+
+// Cache results of CallRecord.
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+type (
+	// CallRecord describes single IndyKite call made by indy.* builtin during policy evaluation.
+	CallRecord struct {
+		// Builtin is the name of builtin, like indy.is_authorized.
+		Builtin string `json:"builtin"`
+		// GRPCCode is the result code of the call, OK on success.
+		GRPCCode string `json:"grpc_code"`
+		// Cache is hit or miss, when decision cache is enabled for the builtin.
+		Cache string `json:"cache,omitempty"`
+		// Resources is the number of requested resources or resource types.
+		Resources int `json:"resources"`
+		// LatencyMillis is duration of the builtin call including retries.
+		LatencyMillis float64 `json:"latency_ms"`
+		// DecisionTime is the decision time returned by IndyKite as Unix timestamp.
+		DecisionTime int64 `json:"decision_time,omitempty"`
+		// Stale is set, when cached decision was returned because IndyKite was unavailable.
+		Stale bool `json:"stale,omitempty"`
+	}
+
+	// CallRecorder keeps call records of evaluations by decision ID until they are attached
+	// to the decision log event. Records of at most callRecordsMaxSize decisions are kept.
+	CallRecorder struct {
+		lastSweep time.Time
+		now       func() time.Time
+		records   map[string]*list.Element
+		// order lists records from the oldest one.
+		order   *list.List
+		maxSize int
+		mtx     sync.Mutex
+	}
+
+	callRecords struct {
+		createdAt  time.Time
+		decisionID string
+		records    []CallRecord
+	}
+)
+
+// NewCallRecorder creates empty call recorder.
+func NewCallRecorder() *CallRecorder {
+	return &CallRecorder{
+		now:       time.Now,
+		records:   make(map[string]*list.Element),
+		order:     list.New(),
+		maxSize:   callRecordsMaxSize,
+		lastSweep: time.Now(),
+	}
+}
+
+// Record stores record under decision ID from ctx. Records without decision ID, like from opa eval,
+// are ignored as they would never be logged. Nil recorder ignores all records.
+func (r *CallRecorder) Record(ctx context.Context, record CallRecord) {
+	if r == nil {
+		return
+	}
+	decisionID, ok := logging.DecisionIDFromContext(ctx)
+	if !ok || decisionID == "" {
+		return
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	now := r.now()
+	if now.Sub(r.lastSweep) >= callRecordsTTL {
+		r.sweepLocked(now)
+	}
+	if el, ok := r.records[decisionID]; ok {
+		entry := el.Value.(*callRecords)
+		entry.records = append(entry.records, record)
+		return
+	}
+	if r.order.Len() >= r.maxSize {
+		r.removeLocked(r.order.Front())
+	}
+	r.records[decisionID] = r.order.PushBack(&callRecords{
+		createdAt:  now,
+		decisionID: decisionID,
+		records:    []CallRecord{record},
+	})
+}
+
+// Take removes and returns records of decision.
+func (r *CallRecorder) Take(decisionID string) []CallRecord {
+	if r == nil {
+		return nil
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	el, ok := r.records[decisionID]
+	if !ok {
+		return nil
+	}
+	r.removeLocked(el)
+	return el.Value.(*callRecords).records
+}
+
+// sweepLocked removes expired records. Records are ordered by creation, so only expired ones are visited.
+func (r *CallRecorder) sweepLocked(now time.Time) {
+	r.lastSweep = now
+	for el := r.order.Front(); el != nil && now.Sub(el.Value.(*callRecords).createdAt) >= callRecordsTTL; {
+		next := el.Next()
+		r.removeLocked(el)
+		el = next
+	}
+}
+
+func (r *CallRecorder) removeLocked(el *list.Element) {
+	r.order.Remove(el)
+	delete(r.records, el.Value.(*callRecords).decisionID)
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/open-policy-agent/opa/logging"
+	opaplugins "github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/plugins/logs"
+	"github.com/open-policy-agent/opa/storage/inmem"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CallRecorder", func() {
+	record := plugins.CallRecord{
+		Builtin:       "indy.is_authorized",
+		GRPCCode:      "OK",
+		Cache:         plugins.CacheMiss,
+		Resources:     2,
+		LatencyMillis: 12.5,
+		DecisionTime:  1645543102,
+	}
+
+	It("Returns records of decision once", func() {
+		recorder := plugins.NewCallRecorder()
+		recorder.Record(logging.WithDecisionID(context.Background(), "abc"), record)
+		recorder.Record(logging.WithDecisionID(context.Background(), "other"), record)
+		recorder.Record(context.Background(), record)
+
+		Expect(recorder.Take("abc")).To(Equal([]plugins.CallRecord{record}))
+		Expect(recorder.Take("abc")).To(BeEmpty())
+	})
+
+	It("Forgets records, which were not logged", func() {
+		now := time.Now()
+		recorder := plugins.NewCallRecorder()
+		recorder.SetClock(func() time.Time { return now })
+		recorder.Record(logging.WithDecisionID(context.Background(), "abc"), record)
+
+		now = now.Add(2 * time.Minute)
+		recorder.Record(logging.WithDecisionID(context.Background(), "new"), record)
+		Expect(recorder.Take("abc")).To(BeEmpty())
+		Expect(recorder.Take("new")).To(HaveLen(1))
+	})
+
+	It("Evicts the oldest records above max size", func() {
+		recorder := plugins.NewCallRecorder()
+		recorder.SetMaxSize(2)
+		for _, id := range []string{"a", "b", "a", "c"} {
+			recorder.Record(logging.WithDecisionID(context.Background(), id), record)
+		}
+
+		Expect(recorder.Take("a")).To(BeEmpty())
+		Expect(recorder.Take("b")).To(HaveLen(1))
+		Expect(recorder.Take("c")).To(HaveLen(1))
+	})
+
+	It("Ignores records with nil recorder", func() {
+		var recorder *plugins.CallRecorder
+		recorder.Record(logging.WithDecisionID(context.Background(), "abc"), record)
+		Expect(recorder.Take("abc")).To(BeEmpty())
+	})
+
+	It("Does not record calls, when plugin is not the decision logs plugin", func() {
+		for _, cfg := range []string{`{}`, `{"decision_logs": {"console": true}}`} {
+			manager, err := opaplugins.New([]byte(cfg), "test", inmem.New())
+			Expect(err).To(Succeed())
+			plugin, err := plugins.NewPlugin(manager, []byte(`{}`))
+			Expect(err).To(Succeed())
+			DeferCleanup(plugin.Stop, context.Background())
+			Expect(plugin.CallRecorder()).To(BeNil())
+		}
+	})
+
+	It("Attaches records to decision log event", func() {
+		sink := &memorySink{}
+		plugins.RegisterDecisionLogSink("telemetry",
+			func(*plugins.DecisionLogsConfig) (plugins.DecisionLogSink, error) {
+				return sink, nil
+			})
+		manager, err := opaplugins.New([]byte(`{"decision_logs": {"plugin": "indykite_plugin"}}`),
+			"test", inmem.New())
+		Expect(err).To(Succeed())
+		plugin, err := plugins.NewPlugin(manager, []byte(`{"decision_logs": {"sink": "telemetry"}}`))
+		Expect(err).To(Succeed())
+		Expect(plugin.Start(context.Background())).To(Succeed())
+
+		plugin.CallRecorder().Record(logging.WithDecisionID(context.Background(), "abc"), record)
+		Expect(plugin.Log(context.Background(), logs.EventV1{DecisionID: "abc"})).To(Succeed())
+		Expect(plugin.Log(context.Background(), logs.EventV1{DecisionID: "def"})).To(Succeed())
+		plugin.Stop(context.Background())
+
+		events := sink.Events()
+		Expect(events).To(HaveLen(2))
+		Expect(events[0]).To(MatchJSON(`{
+			"decision_id": "abc",
+			"labels": null,
+			"timestamp": "0001-01-01T00:00:00Z",
+			"indykite_calls": [{
+				"builtin": "indy.is_authorized",
+				"grpc_code": "OK",
+				"cache": "miss",
+				"resources": 2,
+				"latency_ms": 12.5,
+				"decision_time": 1645543102
+			}]
+		}`))
+		Expect(events[1]).NotTo(ContainSubstring("indykite_calls"))
+	})
+})
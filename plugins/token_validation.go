@@ -0,0 +1,220 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+const (
+	// defaultJWKSRefresh is how long key set fetched from URL is used, when not configured.
+	defaultJWKSRefresh = 15 * time.Minute
+	// jwksFetchTimeout limits fetching of key set from URL.
+	jwksFetchTimeout = 10 * time.Second
+	// jwksFetchBackoff is how long key set is not fetched again after failed fetch.
+	jwksFetchBackoff = 30 * time.Second
+)
+
+type (
+	// TokenValidationConfig enables local checks of access token in subject of builtins, so invalid tokens
+	// are rejected without calling IndyKite. Token structure and exp and nbf claims are always checked,
+	// signature only when JWKS is configured.
+	TokenValidationConfig struct {
+		// keys is key set read from JWKSFile.
+		keys jwk.Set
+
+		// ClockSkewSeconds tolerates clock difference when checking exp and nbf claims.
+		ClockSkewSeconds int `json:"clock_skew_seconds,omitempty" yaml:"clock_skew_seconds,omitempty"`
+		// JWKSFile is path to JSON Web Key Set verifying token signature. It is read on (re)configuration.
+		JWKSFile string `json:"jwks_file,omitempty" yaml:"jwks_file,omitempty"`
+		// JWKSURL is URL of JSON Web Key Set verifying token signature. It is fetched on first use and cached.
+		JWKSURL string `json:"jwks_url,omitempty" yaml:"jwks_url,omitempty"`
+		// JWKSRefreshSeconds is how long key set fetched from JWKSURL is used. Defaults to 15 minutes.
+		JWKSRefreshSeconds int `json:"jwks_refresh_seconds,omitempty" yaml:"jwks_refresh_seconds,omitempty"`
+	}
+
+	// TokenValidator checks access tokens according to TokenValidationConfig.
+	TokenValidator struct {
+		now     func() time.Time
+		keys    jwk.Set
+		fetched time.Time
+		// failed is time and fetchErr is error of the last failed fetch.
+		failed   time.Time
+		fetchErr error
+		// fetching is closed, when fetch in progress finishes.
+		fetching chan struct{}
+		cfg      TokenValidationConfig
+		mtx      sync.Mutex
+	}
+
+	// TokenError is returned by TokenValidator for access token, which failed validation.
+	TokenError struct {
+		cause  error
+		Reason string
+	}
+)
+
+// Validate checks token validation configuration and reads key set from JWKSFile.
+func (c *TokenValidationConfig) Validate() error {
+	if c.ClockSkewSeconds < 0 || c.JWKSRefreshSeconds < 0 {
+		return errors.New("token_validation: clock_skew_seconds and jwks_refresh_seconds must not be negative")
+	}
+	if c.JWKSFile != "" && c.JWKSURL != "" {
+		return errors.New("token_validation: only one of jwks_file and jwks_url can be set")
+	}
+	if c.JWKSURL != "" {
+		if u, err := url.Parse(c.JWKSURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			return fmt.Errorf("token_validation: jwks_url '%s' must be HTTP(S) URL", c.JWKSURL)
+		}
+	}
+	if c.JWKSFile != "" {
+		keys, err := jwk.ReadFile(c.JWKSFile)
+		if err != nil {
+			return fmt.Errorf("token_validation: failed to read jwks_file: %w", err)
+		}
+		c.keys = keys
+	}
+	return nil
+}
+
+// NewTokenValidator creates validator from validated cfg. Returns nil when validation is not enabled.
+func NewTokenValidator(cfg *TokenValidationConfig) *TokenValidator {
+	if cfg == nil {
+		return nil
+	}
+	return &TokenValidator{now: time.Now, keys: cfg.keys, cfg: *cfg}
+}
+
+// Validate checks token structure, exp and nbf claims and signature, when JWKS is configured.
+// Token failing validation is reported with *TokenError, other errors mean JWKS is not available.
+func (v *TokenValidator) Validate(ctx context.Context, token string) error {
+	keys, err := v.keySet(ctx)
+	if err != nil {
+		return err
+	}
+
+	options := []jwt.ParseOption{
+		jwt.WithValidate(true),
+		jwt.WithAcceptableSkew(time.Duration(v.cfg.ClockSkewSeconds) * time.Second),
+		jwt.WithClock(jwt.ClockFunc(v.now)),
+	}
+	if keys != nil {
+		options = append(options, jwt.WithKeySet(keys, jws.WithInferAlgorithmFromKey(true)))
+	} else {
+		options = append(options, jwt.WithVerify(false))
+	}
+	if _, err = jwt.ParseString(token, options...); err != nil {
+		return newTokenError(err)
+	}
+	return nil
+}
+
+// keySet returns key set verifying token signature, or nil when signature is not checked.
+// Key set from URL is fetched again in background once it is older than refresh interval, meanwhile
+// and when fetching fails previously fetched key set is used. Without previously fetched key set, callers wait
+// for the fetch. Fetch is not retried for jwksFetchBackoff after it failed.
+func (v *TokenValidator) keySet(ctx context.Context) (jwk.Set, error) {
+	if v.cfg.JWKSURL == "" {
+		return v.keys, nil
+	}
+	refresh := time.Duration(v.cfg.JWKSRefreshSeconds) * time.Second
+	if refresh <= 0 {
+		refresh = defaultJWKSRefresh
+	}
+
+	v.mtx.Lock()
+	now := v.now()
+	stale := v.keys == nil || now.Sub(v.fetched) >= refresh
+	if stale && v.fetching == nil && (v.fetchErr == nil || now.Sub(v.failed) >= jwksFetchBackoff) {
+		v.fetching = make(chan struct{})
+		// Fetch is shared by all callers, so it must not be canceled with ctx of the first one.
+		go v.fetch(context.WithoutCancel(ctx), v.fetching)
+	}
+	keys, fetching := v.keys, v.fetching
+	v.mtx.Unlock()
+	if keys != nil {
+		return keys, nil
+	}
+
+	if fetching != nil {
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to fetch JWKS for access token validation: %w", ctx.Err())
+		}
+	}
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if v.keys == nil {
+		return nil, fmt.Errorf("failed to fetch JWKS for access token validation: %w", v.fetchErr)
+	}
+	return v.keys, nil
+}
+
+// fetch fetches key set from URL and closes done.
+func (v *TokenValidator) fetch(ctx context.Context, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	keys, err := jwk.Fetch(ctx, v.cfg.JWKSURL)
+
+	v.mtx.Lock()
+	if err != nil {
+		v.failed, v.fetchErr = v.now(), err
+	} else {
+		v.keys, v.fetched, v.fetchErr = keys, v.now(), nil
+	}
+	v.fetching = nil
+	v.mtx.Unlock()
+	close(done)
+}
+
+func newTokenError(err error) *TokenError {
+	reason := "access token is not a valid JWT"
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired()):
+		reason = "access token is expired"
+	case errors.Is(err, jwt.ErrTokenNotYetValid()), errors.Is(err, jwt.ErrInvalidIssuedAt()):
+		reason = "access token is not valid yet"
+	case jwt.IsValidationError(err):
+		reason = "access token is not valid"
+	case jws.IsVerificationError(err):
+		reason = "access token signature is not valid"
+	}
+	return &TokenError{Reason: reason, cause: err}
+}
+
+func (e *TokenError) Error() string {
+	return e.Reason
+}
+
+func (e *TokenError) Unwrap() error {
+	return e.cause
+}
+
+// TokenValidator returns validator of access tokens in subject of builtins, or nil when validation is not enabled.
+func (p *IndyKitePlugin) TokenValidator() *TokenValidator {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.tokenValidator
+}
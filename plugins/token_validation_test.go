@@ -0,0 +1,218 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugins_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+
+	"github.com/indykite/opa-indykite-plugin/plugins"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TokenValidator", func() {
+	now := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	newKey := func(kid string) jwk.Key {
+		raw, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).To(Succeed())
+		key, err := jwk.FromRaw(raw)
+		Expect(err).To(Succeed())
+		Expect(key.Set(jwk.KeyIDKey, kid)).To(Succeed())
+		Expect(key.Set(jwk.AlgorithmKey, jwa.RS256)).To(Succeed())
+		return key
+	}
+	signingKey, otherKey := newKey("key1"), newKey("key1")
+
+	signedToken := func(key jwk.Key, exp, nbf time.Time) string {
+		token := jwt.New()
+		Expect(token.Set(jwt.IssuerKey, "https://example.com")).To(Succeed())
+		Expect(token.Set(jwt.ExpirationKey, exp)).To(Succeed())
+		Expect(token.Set(jwt.NotBeforeKey, nbf)).To(Succeed())
+		signed, err := jwt.Sign(token, jwt.WithKey(jwa.RS256, key))
+		Expect(err).To(Succeed())
+		return string(signed)
+	}
+	validToken := func() string {
+		return signedToken(signingKey, now.Add(time.Hour), now.Add(-time.Hour))
+	}
+
+	jwksData := func() []byte {
+		public, err := jwk.PublicSetOf(func() jwk.Set {
+			set := jwk.NewSet()
+			Expect(set.AddKey(signingKey)).To(Succeed())
+			return set
+		}())
+		Expect(err).To(Succeed())
+		data, err := json.Marshal(public)
+		Expect(err).To(Succeed())
+		return data
+	}
+	jwksFile := func() string {
+		path := filepath.Join(GinkgoT().TempDir(), "jwks.json")
+		Expect(os.WriteFile(path, jwksData(), 0o600)).To(Succeed())
+		return path
+	}
+
+	newValidator := func(cfg *plugins.TokenValidationConfig) *plugins.TokenValidator {
+		Expect(cfg.Validate()).To(Succeed())
+		validator := plugins.NewTokenValidator(cfg)
+		validator.SetClock(func() time.Time { return now })
+		return validator
+	}
+
+	DescribeTable("Validate token",
+		func(withJWKS bool, skew int, token func() string, reason string) {
+			cfg := &plugins.TokenValidationConfig{ClockSkewSeconds: skew}
+			if withJWKS {
+				cfg.JWKSFile = jwksFile()
+			}
+			err := newValidator(cfg).Validate(context.Background(), token())
+			if reason == "" {
+				Expect(err).To(Succeed())
+				return
+			}
+			Expect(err).To(BeAssignableToTypeOf(&plugins.TokenError{}))
+			Expect(err).To(HaveField("Reason", reason))
+		},
+		Entry("Valid token", true, 0, validToken, ""),
+		Entry("Expired token", true, 0, func() string {
+			return signedToken(signingKey, now.Add(-time.Minute), now.Add(-time.Hour))
+		}, "access token is expired"),
+		Entry("Expired token within clock skew", true, 120, func() string {
+			return signedToken(signingKey, now.Add(-time.Minute), now.Add(-time.Hour))
+		}, ""),
+		Entry("Token not valid yet", true, 0, func() string {
+			return signedToken(signingKey, now.Add(time.Hour), now.Add(time.Minute))
+		}, "access token is not valid yet"),
+		Entry("Token signed with other key", true, 0, func() string {
+			return signedToken(otherKey, now.Add(time.Hour), now.Add(-time.Hour))
+		}, "access token signature is not valid"),
+		Entry("Token signed with other key without JWKS", false, 0, func() string {
+			return signedToken(otherKey, now.Add(time.Hour), now.Add(-time.Hour))
+		}, ""),
+		Entry("Malformed token", false, 0, func() string { return "not-a-token" }, "access token is not a valid JWT"),
+	)
+
+	It("Fetches JWKS from URL and caches it", func() {
+		var (
+			fetches   atomic.Int32
+			available atomic.Bool
+		)
+		available.Store(true)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			fetches.Add(1)
+			if !available.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write(jwksData())
+		}))
+		DeferCleanup(server.Close)
+
+		validator := newValidator(&plugins.TokenValidationConfig{JWKSURL: server.URL, JWKSRefreshSeconds: 60})
+		clock := now
+		validator.SetClock(func() time.Time { return clock })
+		token := validToken()
+		for range 3 {
+			Expect(validator.Validate(context.Background(), token)).To(Succeed())
+		}
+		Expect(fetches.Load()).To(BeEquivalentTo(1))
+
+		// Previously fetched keys are used, when JWKS is not available after refresh interval.
+		available.Store(false)
+		clock = clock.Add(2 * time.Minute)
+		Expect(validator.Validate(context.Background(), token)).To(Succeed())
+		Eventually(fetches.Load).Should(BeEquivalentTo(2))
+		Expect(validator.Validate(context.Background(), token)).To(Succeed())
+		Consistently(fetches.Load).WithTimeout(100 * time.Millisecond).Should(BeEquivalentTo(2))
+	})
+
+	It("Fails without JWKS and backs off", func() {
+		var fetches atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			fetches.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		DeferCleanup(server.Close)
+
+		validator := newValidator(&plugins.TokenValidationConfig{JWKSURL: server.URL})
+		clock := now
+		validator.SetClock(func() time.Time { return clock })
+		err := validator.Validate(context.Background(), validToken())
+		Expect(err).To(MatchError(ContainSubstring("failed to fetch JWKS")))
+		Expect(err).NotTo(BeAssignableToTypeOf(&plugins.TokenError{}))
+
+		Expect(validator.Validate(context.Background(), validToken())).
+			To(MatchError(ContainSubstring("failed to fetch JWKS")))
+		Expect(fetches.Load()).To(BeEquivalentTo(1))
+
+		clock = clock.Add(time.Minute)
+		Expect(validator.Validate(context.Background(), validToken())).
+			To(MatchError(ContainSubstring("failed to fetch JWKS")))
+		Expect(fetches.Load()).To(BeEquivalentTo(2))
+	})
+
+	It("Does not cancel shared fetch with context of the caller", func() {
+		var fetches atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			fetches.Add(1)
+			_, _ = w.Write(jwksData())
+		}))
+		DeferCleanup(server.Close)
+
+		validator := newValidator(&plugins.TokenValidationConfig{JWKSURL: server.URL})
+		validator.SetClock(func() time.Time { return now })
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(validator.Validate(ctx, validToken())).To(MatchError(ContainSubstring("context canceled")))
+
+		Eventually(func() error {
+			return validator.Validate(context.Background(), validToken())
+		}).Should(Succeed())
+		Expect(fetches.Load()).To(BeEquivalentTo(1))
+	})
+
+	DescribeTable("Validate config",
+		func(cfg *plugins.TokenValidationConfig, errMatcher OmegaMatcher) {
+			Expect(cfg.Validate()).To(errMatcher)
+		},
+		Entry("Empty config", &plugins.TokenValidationConfig{}, Succeed()),
+		Entry("JWKS URL", &plugins.TokenValidationConfig{JWKSURL: "https://example.com/jwks.json"}, Succeed()),
+		Entry("Negative skew", &plugins.TokenValidationConfig{ClockSkewSeconds: -1},
+			MatchError(ContainSubstring("must not be negative"))),
+		Entry("Both JWKS file and URL", &plugins.TokenValidationConfig{
+			JWKSFile: "jwks.json", JWKSURL: "https://example.com/jwks.json",
+		}, MatchError(ContainSubstring("only one of jwks_file and jwks_url"))),
+		Entry("Invalid JWKS URL", &plugins.TokenValidationConfig{JWKSURL: "file:///jwks.json"},
+			MatchError(ContainSubstring("must be HTTP(S) URL"))),
+		Entry("Missing JWKS file", &plugins.TokenValidationConfig{JWKSFile: "/nonexistent/jwks.json"},
+			MatchError(ContainSubstring("failed to read jwks_file"))),
+	)
+})
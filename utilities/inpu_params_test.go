@@ -50,7 +50,14 @@ var _ = Describe("ParseInputParams", func() {
 		),
 		Entry("not an object",
 			ast.StringTerm("sth"),
-			BeNil(),
+			Equal(builtins.NewOperandTypeErr(3, ast.String("sth"), "object")),
+		),
+		Entry("not a string key",
+			ast.ObjectTerm([2]*ast.Term{
+				ast.IntNumberTerm(1),
+				ast.ObjectTerm([2]*ast.Term{ast.StringTerm("string_value"), ast.StringTerm("x")}),
+			}),
+			MatchError("operand 3 key 1 must be string but got number"),
 		),
 		Entry("not an string",
 			ast.ObjectTerm([2]*ast.Term{
@@ -21,20 +21,24 @@ import (
 )
 
 // ParseInputParams parses inputParams to a map of param's name to [authorizationpb.InputParam].
+// Malformed inputParams are reported as operand error at pos.
 func ParseInputParams(inputParams *ast.Term, pos int) (map[string]*authorizationpb.InputParam, error) {
 	if inputParams == nil {
 		return nil, nil
 	}
 
-	inputParamObj, ok := inputParams.Value.(ast.Object)
-	if !ok {
-		return nil, nil
+	inputParamObj, err := builtins.ObjectOperand(inputParams.Value, pos)
+	if err != nil {
+		return nil, err
 	}
 
 	result := map[string]*authorizationpb.InputParam{}
 
 	for _, key := range inputParamObj.Keys() {
-		inputParamKey := string(key.Value.(ast.String))
+		inputParamKey, err := ObjectKey(key, pos)
+		if err != nil {
+			return nil, err
+		}
 		inputParamValue, err := parseInputParamValue(key, inputParamObj.Get(key), pos)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,133 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utilities
+
+import (
+	"fmt"
+	"time"
+
+	authorizationpb "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	objects "github.com/indykite/indykite-sdk-go/gen/indykite/objects/v1beta2"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown/builtins"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ParseNativeInputParams parses inputParams with plain Rego values to a map of param's name
+// to [authorizationpb.InputParam]. Type of each param is inferred from the value. Strings, booleans
+// and numbers map directly, where numbers without fraction and exponent are integers.
+// Arrays, sets and objects map recursively to array and map values.
+// With parseTime, strings in RFC3339 format are converted to time values.
+func ParseNativeInputParams(
+	inputParams *ast.Term,
+	pos int,
+	parseTime bool,
+) (map[string]*authorizationpb.InputParam, error) {
+	if inputParams == nil {
+		return nil, nil
+	}
+
+	inputParamObj, err := builtins.ObjectOperand(inputParams.Value, pos)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*authorizationpb.InputParam, inputParamObj.Len())
+	for _, key := range inputParamObj.Keys() {
+		inputParamKey, err := ObjectKey(key, pos)
+		if err != nil {
+			return nil, err
+		}
+		value, err := nativeValue(inputParamObj.Get(key), parseTime)
+		if err != nil {
+			return nil, builtins.NewOperandErr(pos, "invalid input parameter %s: %v", key, err)
+		}
+		result[inputParamKey] = inputParamFromValue(value)
+	}
+
+	return result, nil
+}
+
+func nativeValue(term *ast.Term, parseTime bool) (*objects.Value, error) {
+	switch v := term.Value.(type) {
+	case ast.String:
+		if parseTime {
+			if t, err := time.Parse(time.RFC3339Nano, string(v)); err == nil {
+				return &objects.Value{Type: &objects.Value_TimeValue{TimeValue: timestamppb.New(t)}}, nil
+			}
+		}
+		return &objects.Value{Type: &objects.Value_StringValue{StringValue: string(v)}}, nil
+	case ast.Boolean:
+		return &objects.Value{Type: &objects.Value_BoolValue{BoolValue: bool(v)}}, nil
+	case ast.Number:
+		if i, ok := v.Int64(); ok {
+			return &objects.Value{Type: &objects.Value_IntegerValue{IntegerValue: i}}, nil
+		}
+		f, ok := v.Float64()
+		if !ok {
+			return nil, fmt.Errorf("invalid number value: %v", v)
+		}
+		return &objects.Value{Type: &objects.Value_DoubleValue{DoubleValue: f}}, nil
+	case *ast.Array:
+		values := make([]*objects.Value, 0, v.Len())
+		for i := range v.Len() {
+			item, err := nativeValue(v.Elem(i), parseTime)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, item)
+		}
+		return &objects.Value{Type: &objects.Value_ArrayValue{ArrayValue: &objects.Array{Values: values}}}, nil
+	case ast.Set:
+		return nativeValue(ast.NewTerm(v.Sorted()), parseTime)
+	case ast.Object:
+		fields := make(map[string]*objects.Value, v.Len())
+		for _, key := range v.Keys() {
+			name, ok := key.Value.(ast.String)
+			if !ok {
+				return nil, fmt.Errorf("invalid map key: %v", key)
+			}
+			item, err := nativeValue(v.Get(key), parseTime)
+			if err != nil {
+				return nil, err
+			}
+			fields[string(name)] = item
+		}
+		return &objects.Value{Type: &objects.Value_MapValue{MapValue: &objects.Map{Fields: fields}}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported value: %v", term)
+	}
+}
+
+func inputParamFromValue(value *objects.Value) *authorizationpb.InputParam {
+	param := &authorizationpb.InputParam{}
+	switch v := value.GetType().(type) {
+	case *objects.Value_StringValue:
+		param.Value = &authorizationpb.InputParam_StringValue{StringValue: v.StringValue}
+	case *objects.Value_BoolValue:
+		param.Value = &authorizationpb.InputParam_BoolValue{BoolValue: v.BoolValue}
+	case *objects.Value_IntegerValue:
+		param.Value = &authorizationpb.InputParam_IntegerValue{IntegerValue: v.IntegerValue}
+	case *objects.Value_DoubleValue:
+		param.Value = &authorizationpb.InputParam_DoubleValue{DoubleValue: v.DoubleValue}
+	case *objects.Value_TimeValue:
+		param.Value = &authorizationpb.InputParam_TimeValue{TimeValue: v.TimeValue}
+	case *objects.Value_ArrayValue:
+		param.Value = &authorizationpb.InputParam_ArrayValue{ArrayValue: v.ArrayValue}
+	case *objects.Value_MapValue:
+		param.Value = &authorizationpb.InputParam_MapValue{MapValue: v.MapValue}
+	}
+	return param
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utilities_test
+
+import (
+	"time"
+
+	authorizationv1beta1 "github.com/indykite/indykite-sdk-go/gen/indykite/authorization/v1beta1"
+	objectsv1beta2 "github.com/indykite/indykite-sdk-go/gen/indykite/objects/v1beta2"
+	"github.com/indykite/indykite-sdk-go/test"
+	"github.com/open-policy-agent/opa/ast"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/indykite/opa-indykite-plugin/utilities"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseNativeInputParams", func() {
+	It("Infers types of plain values", func() {
+		term := ast.MustParseTerm(`{
+			"string": "42",
+			"time": "2024-02-22T15:18:22Z",
+			"bool": true,
+			"integer": 42,
+			"double": 4.2,
+			"array": [1, "a", {"b": false}],
+			"set": {"x"},
+			"map": {"nested": {"value": 1.5}}
+		}`)
+
+		res, err := utilities.ParseNativeInputParams(term, 3, false)
+		Expect(err).To(Succeed())
+		Expect(res).To(matchInputParams(map[string]*authorizationv1beta1.InputParam{
+			"string": {Value: &authorizationv1beta1.InputParam_StringValue{StringValue: "42"}},
+			"time": {Value: &authorizationv1beta1.InputParam_StringValue{
+				StringValue: "2024-02-22T15:18:22Z",
+			}},
+			"bool":    {Value: &authorizationv1beta1.InputParam_BoolValue{BoolValue: true}},
+			"integer": {Value: &authorizationv1beta1.InputParam_IntegerValue{IntegerValue: 42}},
+			"double":  {Value: &authorizationv1beta1.InputParam_DoubleValue{DoubleValue: 4.2}},
+			"array": {Value: &authorizationv1beta1.InputParam_ArrayValue{ArrayValue: &objectsv1beta2.Array{
+				Values: []*objectsv1beta2.Value{
+					{Type: &objectsv1beta2.Value_IntegerValue{IntegerValue: 1}},
+					{Type: &objectsv1beta2.Value_StringValue{StringValue: "a"}},
+					{Type: &objectsv1beta2.Value_MapValue{MapValue: &objectsv1beta2.Map{
+						Fields: map[string]*objectsv1beta2.Value{
+							"b": {Type: &objectsv1beta2.Value_BoolValue{BoolValue: false}},
+						},
+					}}},
+				},
+			}}},
+			"set": {Value: &authorizationv1beta1.InputParam_ArrayValue{ArrayValue: &objectsv1beta2.Array{
+				Values: []*objectsv1beta2.Value{
+					{Type: &objectsv1beta2.Value_StringValue{StringValue: "x"}},
+				},
+			}}},
+			"map": {Value: &authorizationv1beta1.InputParam_MapValue{MapValue: &objectsv1beta2.Map{
+				Fields: map[string]*objectsv1beta2.Value{
+					"nested": {Type: &objectsv1beta2.Value_MapValue{MapValue: &objectsv1beta2.Map{
+						Fields: map[string]*objectsv1beta2.Value{
+							"value": {Type: &objectsv1beta2.Value_DoubleValue{DoubleValue: 1.5}},
+						},
+					}}},
+				},
+			}}},
+		}))
+	})
+
+	It("Converts RFC3339 strings to time when enabled", func() {
+		term := ast.MustParseTerm(`{
+			"time": "2024-02-22T15:18:22.5+01:00",
+			"text": "2024-02-22",
+			"list": ["2024-02-22T15:18:22Z"]
+		}`)
+
+		res, err := utilities.ParseNativeInputParams(term, 3, true)
+		Expect(err).To(Succeed())
+		Expect(res).To(matchInputParams(map[string]*authorizationv1beta1.InputParam{
+			"time": {Value: &authorizationv1beta1.InputParam_TimeValue{
+				TimeValue: timestamppb.New(time.Date(2024, 2, 22, 14, 18, 22, 5e8, time.UTC)),
+			}},
+			"text": {Value: &authorizationv1beta1.InputParam_StringValue{StringValue: "2024-02-22"}},
+			"list": {Value: &authorizationv1beta1.InputParam_ArrayValue{ArrayValue: &objectsv1beta2.Array{
+				Values: []*objectsv1beta2.Value{{Type: &objectsv1beta2.Value_TimeValue{
+					TimeValue: timestamppb.New(time.Date(2024, 2, 22, 15, 18, 22, 0, time.UTC)),
+				}}},
+			}}},
+		}))
+	})
+
+	DescribeTable("Errors",
+		func(term *ast.Term, errMsg string) {
+			res, err := utilities.ParseNativeInputParams(term, 3, false)
+			Expect(res).To(BeNil())
+			if errMsg == "" {
+				Expect(err).To(Succeed())
+			} else {
+				Expect(err).To(MatchError(ContainSubstring(errMsg)))
+			}
+		},
+		Entry("nil term", nil, ""),
+		Entry("not an object", ast.StringTerm("sth"), "operand 3 must be object but got string"),
+		Entry("null value", ast.MustParseTerm(`{"a": null}`),
+			`operand 3 invalid input parameter "a": unsupported value: null`),
+		Entry("non string map key", ast.MustParseTerm(`{"a": {1: "x"}}`), "invalid map key: 1"),
+	)
+})
+
+// matchInputParams compares maps of proto messages with proto.Equal.
+func matchInputParams(expected map[string]*authorizationv1beta1.InputParam) OmegaMatcher {
+	matchers := make([]OmegaMatcher, 0, len(expected)+1)
+	matchers = append(matchers, HaveLen(len(expected)))
+	for key, value := range expected {
+		matchers = append(matchers, HaveKeyWithValue(key, test.EqualProto(value)))
+	}
+	return SatisfyAll(matchers...)
+}
@@ -259,7 +259,11 @@ func getMapValue(value ast.Object) (*objects.Value, error) {
 		if err != nil {
 			return nil, err
 		}
-		fields[string(key.Value.(ast.String))] = v
+		name, ok := key.Value.(ast.String)
+		if !ok {
+			return nil, fmt.Errorf("invalid map key: %v", key)
+		}
+		fields[string(name)] = v
 	}
 	return &objects.Value{
 		Type: &objects.Value_MapValue{
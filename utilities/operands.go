@@ -0,0 +1,80 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utilities
+
+import (
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown/builtins"
+)
+
+// Operands of builtins are type checked only when known at compile time. Values from input or data
+// are not, so helpers below validate them at runtime and return operand errors instead of panicking.
+
+// StringField returns string value of key in obj, which is operand at pos.
+// Returns false, when key is missing. Non-string value is reported as operand error.
+func StringField(obj ast.Object, key string, pos int) (string, bool, error) {
+	term := obj.Get(ast.StringTerm(key))
+	if term == nil {
+		return "", false, nil
+	}
+	s, ok := term.Value.(ast.String)
+	if !ok {
+		return "", false, builtins.NewOperandErr(pos, "%s must be string but got %s", key, ast.TypeName(term.Value))
+	}
+	return string(s), true, nil
+}
+
+// RequiredStringField returns string value of key in obj, which is operand at pos.
+// Missing key and non-string value are reported as operand error.
+func RequiredStringField(obj ast.Object, key string, pos int) (string, error) {
+	s, found, err := StringField(obj, key, pos)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", builtins.NewOperandErr(pos, "missing %s", key)
+	}
+	return s, nil
+}
+
+// StringArrayOperand converts operand at pos, which must be array of strings. Nil term is returned as nil.
+func StringArrayOperand(term *ast.Term, pos int) ([]string, error) {
+	if term == nil {
+		return nil, nil
+	}
+	arr, err := builtins.ArrayOperand(term.Value, pos)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, arr.Len())
+	for i := range arr.Len() {
+		s, ok := arr.Elem(i).Value.(ast.String)
+		if !ok {
+			return nil, builtins.NewOperandErr(pos, "element %d must be string but got %s",
+				i, ast.TypeName(arr.Elem(i).Value))
+		}
+		result[i] = string(s)
+	}
+	return result, nil
+}
+
+// ObjectKey returns key of object operand at pos, which must be string.
+func ObjectKey(key *ast.Term, pos int) (string, error) {
+	s, ok := key.Value.(ast.String)
+	if !ok {
+		return "", builtins.NewOperandErr(pos, "key %v must be string but got %s", key, ast.TypeName(key.Value))
+	}
+	return string(s), nil
+}
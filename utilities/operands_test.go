@@ -0,0 +1,45 @@
+// Copyright (c) 2024 IndyKite
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utilities_test
+
+import (
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+
+	"github.com/indykite/opa-indykite-plugin/utilities"
+)
+
+func FuzzParseInputParams(f *testing.F) {
+	for _, seed := range []string{
+		`{"a": {"stringValue": "b"}}`,
+		`{"a": {"integerValue": 1}, "b": {"timeValue": "2024-02-22T15:18:22Z"}}`,
+		`{"a": {"arrayValue": {"values": [{"boolValue": true}]}}}`,
+		`{"a": [1, "b", {"c": null}], "d": {"e"}}`,
+		`{1: "a"}`,
+		`["a"]`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		term, err := ast.ParseTerm(data)
+		if err != nil || !term.IsGround() {
+			t.Skip()
+		}
+		_, _ = utilities.ParseInputParams(term, 3)
+		_, _ = utilities.ParseNativeInputParams(term, 3, false)
+		_, _ = utilities.ParseNativeInputParams(term, 3, true)
+	})
+}